@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// evalAggregate aggregates the series of a sub-plan by the node's grouping,
+// following the PromQL definitions. Groups are returned in the order their
+// first series appears.
+func (ev *evaluator) evalAggregate(n *aggregateNode) (value, error) {
+	inner, err := ev.eval(n.Inner)
+	if err != nil {
+		return nil, err
+	}
+	v, err := vectorArg(n.Op, inner)
+	if err != nil {
+		return nil, err
+	}
+
+	var k int
+	if n.Param != nil {
+		param, err := ev.eval(n.Param)
+		if err != nil {
+			return nil, err
+		}
+		f, err := scalarArg(n.Op, param)
+		if err != nil {
+			return nil, err
+		}
+		k = int(f)
+	}
+
+	var order []string
+	groups := map[string]Vector{}
+	labels := map[string]map[string]string{}
+	for _, s := range v {
+		metric := n.groupLabels(s.Metric)
+		sig := labelSignature(metric)
+		if _, ok := groups[sig]; !ok {
+			order = append(order, sig)
+			labels[sig] = metric
+		}
+		groups[sig] = append(groups[sig], s)
+	}
+
+	out := Vector{}
+	for _, sig := range order {
+		group := groups[sig]
+		switch n.Op {
+		case "topk", "bottomk":
+			sorted := append(Vector{}, group...)
+			sort.SliceStable(sorted, func(i, j int) bool {
+				a, b := sorted[i].Value, sorted[j].Value
+				// NaN sorts last for both
+				if math.IsNaN(b) {
+					return !math.IsNaN(a)
+				}
+				if n.Op == "topk" {
+					return a > b
+				}
+				return a < b
+			})
+			if k < len(sorted) {
+				sorted = sorted[:max(k, 0)]
+			}
+			out = append(out, sorted...)
+		default:
+			result, err := aggregate(n.Op, group)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, Sample{Metric: labels[sig], Value: result})
+		}
+	}
+	return out, nil
+}
+
+// groupLabels returns the labels identifying the group of a series.
+func (n *aggregateNode) groupLabels(metric map[string]string) map[string]string {
+	out := map[string]string{}
+	for name, v := range metric {
+		if name == "__name__" || containsString(n.Grouping, name) == n.Without {
+			continue
+		}
+		out[name] = v
+	}
+	return out
+}
+
+// aggregate combines the values of one group.
+func aggregate(op string, group Vector) (float64, error) {
+	switch op {
+	case "count":
+		return float64(len(group)), nil
+	case "sum", "avg":
+		var sum float64
+		for _, s := range group {
+			sum += s.Value
+		}
+		if op == "avg" {
+			return sum / float64(len(group)), nil
+		}
+		return sum, nil
+	case "min", "max":
+		result := group[0].Value
+		for _, s := range group[1:] {
+			if math.IsNaN(result) || (op == "min" && s.Value < result) || (op == "max" && s.Value > result) {
+				result = s.Value
+			}
+		}
+		return result, nil
+	}
+	return 0, fmt.Errorf("aggregation %q cannot be evaluated", op)
+}
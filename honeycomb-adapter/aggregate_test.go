@@ -0,0 +1,103 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestEvalAggregate(t *testing.T) {
+	leaf := &leafNode{}
+	results := map[*leafNode]Vector{leaf: {
+		{Metric: map[string]string{"route": "/", "code": "200"}, Value: 10},
+		{Metric: map[string]string{"route": "/", "code": "500"}, Value: 2},
+		{Metric: map[string]string{"route": "/api", "code": "200"}, Value: math.NaN()},
+		{Metric: map[string]string{"route": "/api", "code": "500"}, Value: 4},
+	}}
+
+	tests := []struct {
+		name     string
+		node     *aggregateNode
+		expected Vector
+	}{
+		{
+			name: "sum by",
+			node: &aggregateNode{Op: "sum", Grouping: []string{"code"}},
+			expected: Vector{
+				{Metric: map[string]string{"code": "200"}, Value: math.NaN()},
+				{Metric: map[string]string{"code": "500"}, Value: 6},
+			},
+		},
+		{
+			name: "avg without",
+			node: &aggregateNode{Op: "avg", Grouping: []string{"route"}, Without: true},
+			expected: Vector{
+				{Metric: map[string]string{"code": "200"}, Value: math.NaN()},
+				{Metric: map[string]string{"code": "500"}, Value: 3},
+			},
+		},
+		{
+			name: "max skips NaN",
+			node: &aggregateNode{Op: "max", Grouping: []string{"route"}},
+			expected: Vector{
+				{Metric: map[string]string{"route": "/"}, Value: 10},
+				{Metric: map[string]string{"route": "/api"}, Value: 4},
+			},
+		},
+		{
+			name:     "count",
+			node:     &aggregateNode{Op: "count"},
+			expected: Vector{{Metric: map[string]string{}, Value: 4}},
+		},
+		{
+			name: "topk keeps series labels and sorts NaN last",
+			node: &aggregateNode{Op: "topk", Grouping: []string{"route"}, Param: &scalarNode{Value: 1}},
+			expected: Vector{
+				{Metric: map[string]string{"route": "/", "code": "200"}, Value: 10},
+				{Metric: map[string]string{"route": "/api", "code": "500"}, Value: 4},
+			},
+		},
+		{
+			name: "bottomk",
+			node: &aggregateNode{Op: "bottomk", Param: &scalarNode{Value: 2}},
+			expected: Vector{
+				{Metric: map[string]string{"route": "/", "code": "500"}, Value: 2},
+				{Metric: map[string]string{"route": "/api", "code": "500"}, Value: 4},
+			},
+		},
+		{
+			name:     "topk of zero",
+			node:     &aggregateNode{Op: "topk", Param: &scalarNode{Value: 0}},
+			expected: Vector{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.node.Inner = leaf
+			result, err := (&evaluator{results: results}).eval(tt.node)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !equalVectors(result.(Vector), tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, result)
+			}
+		})
+	}
+}
+
+// equalVectors compares vectors treating NaN values as equal.
+func equalVectors(a, b Vector) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !reflect.DeepEqual(a[i].Metric, b[i].Metric) {
+			return false
+		}
+		if a[i].Value != b[i].Value && !(math.IsNaN(a[i].Value) && math.IsNaN(b[i].Value)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Translator turns a PromQL expression into a query plan whose leaves a
+// Backend can execute.
+type Translator interface {
+	Translate(promQL string) (*queryPlan, error)
+}
+
+// LeafQuery is a vector selector of a query plan in backend-neutral form:
+// the series it selects, how each one is aggregated over the time window,
+// and the labels the results are grouped by.
+type LeafQuery struct {
+	Metric   string
+	Matchers []*LabelMatcher
+	// Aggregation is the *_over_time function aggregating each series over
+	// the window, or empty for the metric's own aggregation.
+	Aggregation string
+	// Quantile is the φ of an enclosing histogram_quantile(), if any.
+	Quantile *float64
+	// Grouping lists the labels the results keep; series are aggregated
+	// across all other labels.
+	Grouping []string
+	Window   time.Duration
+	// Offset and At move the window as the offset and @ modifiers of the
+	// selector do.
+	Offset time.Duration
+	At     *AtModifier
+	// mapping is the metric mapping the query was translated with, or nil
+	// for a query built outside a translation.
+	mapping *mappingConfig
+}
+
+// String returns the selector the leaf query was translated from.
+func (q *LeafQuery) String() string {
+	vs := &VectorSelector{Name: q.Metric, Matchers: q.Matchers, Offset: q.Offset, At: q.At}
+	return vs.String()
+}
+
+// Backend executes the leaf queries of a query plan. Operators between the
+// leaves are evaluated by the adapter, so a backend only has to return the
+// series each leaf selects, in the unit of the leaf's metric.
+type Backend interface {
+	// Instant runs each leaf query over its own time window ending at at, or
+	// ending now if at is zero, and returns one vector per query, in the
+	// order of queries.
+	Instant(ctx context.Context, queries []*LeafQuery, at time.Time) ([]Vector, error)
+	// Range runs each leaf query as a time series over rng and returns one
+	// matrix per query, aligned to the steps of rng. The point at a step
+	// covers the one step that ends at it.
+	Range(ctx context.Context, queries []*LeafQuery, rng RangeParams) ([]Matrix, error)
+}
+
+// honeycombTranslator translates PromQL using the adapter's metric mapping
+// and time window settings.
+type honeycombTranslator struct {
+	adapter *HoneycombAdapter
+}
+
+func (t *honeycombTranslator) Translate(promQL string) (*queryPlan, error) {
+	return t.adapter.translatePromQL(promQL)
+}
+
+// honeycombBackend maps leaf queries onto Honeycomb queries and runs them
+// through the Honeycomb Query API.
+type honeycombBackend struct {
+	adapter *HoneycombAdapter
+}
+
+func (b *honeycombBackend) Instant(ctx context.Context, queries []*LeafQuery, at time.Time) ([]Vector, error) {
+	leaves, err := b.adapter.honeycombLeaves(queries)
+	if err != nil {
+		return nil, err
+	}
+	// Queries evaluated now keep their relative time range, so that their
+	// definitions can be reused.
+	results, err := b.run(ctx, leaves, func(leaf *honeycombLeaf, q *HoneycombQuery) *HoneycombQuery {
+		if end, ok := leaf.windowEnd(at); ok {
+			return instantQuery(q, end)
+		}
+		return q
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Vector, len(leaves))
+	for i, leaf := range leaves {
+		out[i] = b.adapter.honeycombResultToVector(results[i], leaf.Query.Calculations[0], leaf.Breakdowns).scale(leaf.Scale)
+	}
+	return out, nil
+}
+
+func (b *honeycombBackend) Range(ctx context.Context, queries []*LeafQuery, rng RangeParams) ([]Matrix, error) {
+	leaves, err := b.adapter.honeycombLeaves(queries)
+	if err != nil {
+		return nil, err
+	}
+	// The first step needs the bucket that ends at it, so the series starts
+	// one step early.
+	results, err := b.run(ctx, leaves, func(leaf *honeycombLeaf, q *HoneycombQuery) *HoneycombQuery {
+		shifted := leaf.shiftRange(rng)
+		return rangeQuery(q, TimeRange{
+			StartTime: shifted.Start.Add(-shifted.Step).Unix(),
+			EndTime:   shifted.End.Unix(),
+		}, shifted.Step)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Matrix, len(leaves))
+	for i, leaf := range leaves {
+		matrix := b.adapter.honeycombResultToMatrix(results[i], leaf.Query.Calculations[0], leaf.Breakdowns, leaf.shiftRange(rng))
+		out[i] = leaf.alignMatrix(matrix.scale(leaf.Scale), rng)
+	}
+	return out, nil
+}
+
+// honeycombLeaves maps leaf queries onto Honeycomb queries with the metric
+// mapping they were translated with.
+func (h *HoneycombAdapter) honeycombLeaves(queries []*LeafQuery) ([]*honeycombLeaf, error) {
+	leaves := make([]*honeycombLeaf, len(queries))
+	for i, q := range queries {
+		mapper := &honeycombMapper{config: h.queryConfig(q)}
+		leaf, err := mapper.leaf(q)
+		if err != nil {
+			return nil, fmt.Errorf("cannot map %s onto a Honeycomb query: %w", q, err)
+		}
+		leaves[i] = leaf
+	}
+	return leaves, nil
+}
+
+// queryConfig returns the metric mapping q was translated with, so that a
+// reload between translation and execution cannot change the query, or the
+// current mapping for a query built outside a translation.
+func (h *HoneycombAdapter) queryConfig(q *LeafQuery) *mappingConfig {
+	if q.mapping != nil {
+		return q.mapping
+	}
+	return h.metricConfig()
+}
+
+// instantQuery returns a copy of q whose time window ends at end instead of
+// now, as an absolute range of the same length.
+func instantQuery(q *HoneycombQuery, end time.Time) *HoneycombQuery {
+	out := *q
+	out.TimeRange = 0
+	out.EndTime = end.Unix()
+	out.StartTime = out.EndTime - int64(q.TimeRange)
+	return &out
+}
+
+// run executes the Honeycomb queries concurrently, since each one may spend
+// several seconds polling for completion. If prepare is non-nil it is used to
+// rewrite each leaf's query before it is sent.
+func (b *honeycombBackend) run(ctx context.Context, leaves []*honeycombLeaf, prepare func(*honeycombLeaf, *HoneycombQuery) *HoneycombQuery) ([]*HoneycombQueryResult, error) {
+	// Every dataset is resolved before any query starts, so that a leaf
+	// without a dataset does not leave the others running unobserved.
+	datasets := make([]string, len(leaves))
+	queries := make([]*HoneycombQuery, len(leaves))
+	for i, leaf := range leaves {
+		dataset, query, err := b.adapter.leafDataset(leaf)
+		if err != nil {
+			return nil, err
+		}
+		if prepare != nil {
+			query = prepare(leaf, query)
+		}
+		b.adapter.logDebug("Mapped %s to Honeycomb query: %+v", leaf, query)
+		datasets[i], queries[i] = dataset, query
+	}
+
+	// The first failure cancels the queries still running, since the plan
+	// cannot be evaluated without it.
+	results := make([]*HoneycombQueryResult, len(leaves))
+	g, ctx := errgroup.WithContext(ctx)
+	for i := range leaves {
+		i := i
+		g.Go(func() error {
+			var err error
+			results[i], err = b.adapter.executeHoneycombQuery(ctx, queries[i], datasets[i])
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// queryTranslator returns the configured Translator, defaulting to the
+// Honeycomb translator.
+func (h *HoneycombAdapter) queryTranslator() Translator {
+	if h.translator != nil {
+		return h.translator
+	}
+	return &honeycombTranslator{adapter: h}
+}
+
+// queryBackend returns the configured Backend, defaulting to the Honeycomb
+// Query API.
+func (h *HoneycombAdapter) queryBackend() Backend {
+	if h.backend != nil {
+		return h.backend
+	}
+	return &honeycombBackend{adapter: h}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// staticBackend returns a fixed vector for each leaf, keyed by its metric name.
+type staticBackend struct {
+	values map[string]Vector
+	calls  int
+}
+
+func (b *staticBackend) Instant(ctx context.Context, queries []*LeafQuery, at time.Time) ([]Vector, error) {
+	b.calls++
+	out := make([]Vector, len(queries))
+	for i, q := range queries {
+		out[i] = b.values[q.Metric]
+	}
+	return out, nil
+}
+
+func (b *staticBackend) Range(ctx context.Context, queries []*LeafQuery, rng RangeParams) ([]Matrix, error) {
+	b.calls++
+	out := make([]Matrix, len(queries))
+	for i, q := range queries {
+		for _, s := range b.values[q.Metric] {
+			var points []Point
+			for _, ts := range rng.steps() {
+				points = append(points, Point{T: ts, V: s.Value})
+			}
+			out[i] = append(out[i], Series{Metric: s.Metric, Points: points})
+		}
+	}
+	return out, nil
+}
+
+func TestHandleQueryWithCustomBackend(t *testing.T) {
+	backend := &staticBackend{values: map[string]Vector{
+		"http_requests_total": {{Metric: map[string]string{}, Value: 42}},
+	}}
+	adapter := &HoneycombAdapter{
+		queryTimeWindow: 3 * time.Minute,
+		backend:         backend,
+	}
+
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		path     string
+		params   url.Values
+		expected string
+	}{
+		{
+			name:     "instant query",
+			handler:  adapter.handleQuery,
+			path:     "/api/v1/query",
+			params:   url.Values{"query": {`sum(increase(http_requests_total{service="test"}[5m])) * 2`}},
+			expected: "84",
+		},
+		{
+			name:    "range query",
+			handler: adapter.handleQueryRange,
+			path:    "/api/v1/query_range",
+			params: url.Values{
+				"query": {`sum(increase(http_requests_total{service="test"}[5m])) * 2`},
+				"start": {"1700000000"},
+				"end":   {"1700000060"},
+				"step":  {"60"},
+			},
+			// 42 requests in each of the five 60s steps of the window
+			expected: "420",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path+"?"+tt.params.Encode(), nil)
+			rec := httptest.NewRecorder()
+			tt.handler(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+			}
+
+			var result PrometheusResponse
+			if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Data.Result) != 1 {
+				t.Fatalf("expected 1 series, got %d", len(result.Data.Result))
+			}
+
+			r := result.Data.Result[0]
+			var got interface{}
+			if r.Value != nil {
+				got = r.Value[1]
+			} else {
+				got = r.Values[len(r.Values)-1][1]
+			}
+			if got != tt.expected {
+				t.Errorf("expected value %s, got %v", tt.expected, got)
+			}
+		})
+	}
+
+	if backend.calls != 2 {
+		t.Errorf("expected the custom backend to be called twice, got %d", backend.calls)
+	}
+}
+
+func TestBackendLeafQueries(t *testing.T) {
+	adapter := &HoneycombAdapter{queryTimeWindow: 3 * time.Minute}
+	plan, err := adapter.translatePromQL(`sum by (code) (increase(http_requests_total{service="test"}[5m] offset 1h))`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	queries := plan.queries()
+	if len(queries) != 1 {
+		t.Fatalf("expected 1 leaf query, got %d", len(queries))
+	}
+	q := queries[0]
+	if q.Metric != "http_requests_total" || q.String() != `http_requests_total{service="test"} offset 1h` {
+		t.Errorf("unexpected selector %s", q)
+	}
+	if strings.Join(q.Grouping, ",") != "code" || q.Window != 5*time.Minute || q.Offset != time.Hour || q.Aggregation != "" {
+		t.Errorf("unexpected leaf query %+v", q)
+	}
+}
+
+func TestHoneycombBackendScalesResults(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/1/queries/test":
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": "latency-query"})
+		case "/1/query_results/test":
+			data := map[string]interface{}{"P95(duration_ms)": 250.0}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"complete": true,
+				"data": map[string]interface{}{
+					"results": []interface{}{map[string]interface{}{"data": data}},
+					"series":  []interface{}{map[string]interface{}{"time": "2023-11-14T22:12:20Z", "data": data}},
+				},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mockServer.Close()
+
+	adapter := &HoneycombAdapter{
+		honeycombAPIKey:  "test-key",
+		honeycombBaseURL: mockServer.URL,
+		queryTimeWindow:  time.Minute,
+	}
+	plan, err := adapter.translatePromQL(`histogram_quantile(0.95, sum(rate(http_request_duration_seconds_bucket{service="test"}[5m])) by (le))`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	backend := adapter.queryBackend()
+
+	// duration_ms is converted into the seconds of the metric
+	vectors, err := backend.Instant(context.Background(), plan.queries(), time.Time{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := (Vector{{Metric: map[string]string{}, Value: 0.25}}); !reflect.DeepEqual(vectors[0], want) {
+		t.Errorf("expected %v, got %v", want, vectors[0])
+	}
+
+	start := time.Unix(1700000000, 0).UTC()
+	matrices, err := backend.Range(context.Background(), plan.queries(), RangeParams{Start: start, End: start, Step: time.Minute})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := (Matrix{{Metric: map[string]string{}, Points: []Point{{T: start, V: 0.25}}}}); !reflect.DeepEqual(matrices[0], want) {
+		t.Errorf("expected %v, got %v", want, matrices[0])
+	}
+}
+
+func TestHandleQueryEvaluationTime(t *testing.T) {
+	var sent []HoneycombQuery
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/1/queries/test":
+			var q HoneycombQuery
+			json.NewDecoder(r.Body).Decode(&q)
+			sent = append(sent, q)
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": "instant-query"})
+		case "/1/query_results/test":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"complete": true,
+				"data":     map[string]interface{}{"results": []interface{}{map[string]interface{}{"data": map[string]interface{}{"COUNT": 42.0}}}},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mockServer.Close()
+
+	tests := []struct {
+		name          string
+		time          string
+		wantStatus    int
+		wantEndTime   int64
+		wantTimestamp float64
+	}{
+		{name: "now", wantStatus: http.StatusOK},
+		{name: "unix seconds", time: "1700000000.5", wantStatus: http.StatusOK, wantEndTime: 1700000000, wantTimestamp: 1700000000.5},
+		{name: "RFC3339", time: "2023-11-14T22:13:20Z", wantStatus: http.StatusOK, wantEndTime: 1700000000, wantTimestamp: 1700000000},
+		{name: "invalid", time: "yesterday", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent = nil
+			adapter := &HoneycombAdapter{
+				honeycombAPIKey:  "test-key",
+				honeycombBaseURL: mockServer.URL,
+				queryTimeWindow:  3 * time.Minute,
+			}
+			params := url.Values{"query": {`sum(increase(http_requests_total{service="test"}[5m]))`}}
+			if tt.time != "" {
+				params.Set("time", tt.time)
+			}
+			rec := httptest.NewRecorder()
+			adapter.handleQuery(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?"+params.Encode(), nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if len(sent) != 1 {
+				t.Fatalf("expected 1 Honeycomb query, got %d", len(sent))
+			}
+
+			q := sent[0]
+			if tt.wantEndTime == 0 {
+				if q.TimeRange != 300 || q.StartTime != 0 || q.EndTime != 0 {
+					t.Errorf("expected a relative 300s time range, got %+v", q)
+				}
+				return
+			}
+			if q.TimeRange != 0 || q.EndTime != tt.wantEndTime || q.StartTime != tt.wantEndTime-300 {
+				t.Errorf("expected 300s ending at %d, got start=%d end=%d range=%d", tt.wantEndTime, q.StartTime, q.EndTime, q.TimeRange)
+			}
+
+			var result PrometheusResponse
+			if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Data.Result) != 1 || result.Data.Result[0].Value[0] != tt.wantTimestamp {
+				t.Errorf("expected a sample at %v, got %+v", tt.wantTimestamp, result.Data.Result)
+			}
+		})
+	}
+}
+
+func TestHoneycombBackendCancelsOnFailure(t *testing.T) {
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/1/queries/broken":
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "unknown column"})
+		case "/1/queries/slow":
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": "slow-query"})
+		case "/1/query_results/slow":
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"complete": false})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mockServer.Close()
+	defer close(release)
+
+	adapter := &HoneycombAdapter{
+		honeycombAPIKey:  "test-key",
+		honeycombBaseURL: mockServer.URL,
+		queryTimeWindow:  3 * time.Minute,
+	}
+	plan, err := adapter.translatePromQL(`sum(rate(http_requests_total{service="broken"}[5m])) + sum(rate(http_requests_total{service="slow"}[5m]))`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	start := time.Now()
+	if _, err := adapter.queryBackend().Instant(context.Background(), plan.queries(), time.Time{}); err == nil {
+		t.Fatal("expected the failing leaf to fail the query")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the slow leaf to be cancelled, the query took %s", elapsed)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// queryCache caches Honeycomb query results and de-duplicates concurrent
+// executions of the same query, so that many canaries polling the same
+// metric share one Honeycomb round trip.
+type queryCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	group   singleflight.Group
+}
+
+type cacheEntry struct {
+	result  *HoneycombQueryResult
+	expires time.Time
+}
+
+func newQueryCache(ttl time.Duration) *queryCache {
+	return &queryCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[string]cacheEntry{},
+	}
+}
+
+// cacheKey identifies a query result by dataset, query definition and time
+// bucket. Queries with a relative time range cover a different window every
+// second, so they are aligned to TTL-sized buckets: all requests within one
+// bucket are answered by the same result.
+func (c *queryCache) cacheKey(dataset string, query *HoneycombQuery) (string, error) {
+	definition, err := json.Marshal(query)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal query: %v", err)
+	}
+	bucket := c.now().Truncate(c.ttl).Unix()
+	return fmt.Sprintf("%s|%d|%s", dataset, bucket, definition), nil
+}
+
+func (c *queryCache) get(key string) (*HoneycombQueryResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.result, true
+}
+
+func (c *queryCache) set(key string, result *HoneycombQueryResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for k, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry{result: result, expires: now.Add(c.ttl)}
+}
+
+// cacheSource describes where a query result came from, for the cache metrics.
+type cacheSource string
+
+const (
+	cacheSourceCache     cacheSource = "cache"
+	cacheSourceInflight  cacheSource = "inflight"
+	cacheSourceHoneycomb cacheSource = "honeycomb"
+)
+
+// do returns the cached result for key, or runs fetch once for all concurrent
+// callers with the same key and caches its result. Errors are not cached.
+//
+// fetch runs detached from the caller's cancellation so that one caller
+// giving up does not fail the others waiting on the same query; each caller
+// still returns as soon as its own context is done. The first caller's
+// deadline, if any, still bounds the fetch.
+func (c *queryCache) do(ctx context.Context, key string, fetch func(ctx context.Context) (*HoneycombQueryResult, error)) (*HoneycombQueryResult, cacheSource, error) {
+	if result, ok := c.get(key); ok {
+		return result, cacheSourceCache, nil
+	}
+
+	fetched := false
+	ch := c.group.DoChan(key, func() (interface{}, error) {
+		fetched = true
+		fetchCtx := context.WithoutCancel(ctx)
+		if deadline, ok := ctx.Deadline(); ok {
+			var cancel context.CancelFunc
+			fetchCtx, cancel = context.WithDeadline(fetchCtx, deadline)
+			defer cancel()
+		}
+		result, err := fetch(fetchCtx)
+		if err != nil {
+			return nil, err
+		}
+		c.set(key, result)
+		return result, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, cacheSourceHoneycomb, ctx.Err()
+	case res := <-ch:
+		source := cacheSourceInflight
+		if fetched {
+			source = cacheSourceHoneycomb
+		}
+		if res.Err != nil {
+			return nil, source, res.Err
+		}
+		return res.Val.(*HoneycombQueryResult), source, nil
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueryCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cache := newQueryCache(30 * time.Second)
+	cache.now = func() time.Time { return now }
+
+	query := &HoneycombQuery{TimeRange: 300, Calculations: []Calculation{{Op: "COUNT"}}}
+	key, err := cache.cacheKey("test", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetches int
+	fetch := func(ctx context.Context) (*HoneycombQueryResult, error) {
+		fetches++
+		return &HoneycombQueryResult{ID: "result", Complete: true}, nil
+	}
+
+	steps := []struct {
+		name       string
+		advance    time.Duration
+		wantSource cacheSource
+		wantFetch  int
+	}{
+		{name: "first request fetches", wantSource: cacheSourceHoneycomb, wantFetch: 1},
+		{name: "second request hits", advance: 10 * time.Second, wantSource: cacheSourceCache, wantFetch: 1},
+		{name: "expired entry fetches again", advance: 30 * time.Second, wantSource: cacheSourceHoneycomb, wantFetch: 2},
+	}
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		result, source, err := cache.do(context.Background(), key, fetch)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", step.name, err)
+		}
+		if result.ID != "result" || source != step.wantSource || fetches != step.wantFetch {
+			t.Errorf("%s: got source=%s fetches=%d, expected source=%s fetches=%d",
+				step.name, source, fetches, step.wantSource, step.wantFetch)
+		}
+	}
+
+	otherKey, _ := cache.cacheKey("other-dataset", query)
+	if otherKey == key {
+		t.Error("expected datasets to have different cache keys")
+	}
+	now = now.Add(30 * time.Second)
+	if laterKey, _ := cache.cacheKey("test", query); laterKey == key {
+		t.Error("expected the next time bucket to have a different cache key")
+	}
+}
+
+func TestQueryCacheDoesNotCacheErrors(t *testing.T) {
+	cache := newQueryCache(30 * time.Second)
+
+	var fetches int
+	fetch := func(ctx context.Context) (*HoneycombQueryResult, error) {
+		fetches++
+		return nil, errors.New("honeycomb API returned status 500")
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := cache.do(context.Background(), "key", fetch); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	}
+	if fetches != 2 {
+		t.Errorf("expected failed results to be refetched, got %d fetches", fetches)
+	}
+}
+
+func TestQueryCacheDeduplicatesConcurrentQueries(t *testing.T) {
+	cache := newQueryCache(30 * time.Second)
+
+	var fetches int32
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) (*HoneycombQueryResult, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return &HoneycombQueryResult{Complete: true}, nil
+	}
+
+	const callers = 5
+	sources := make(chan cacheSource, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, source, err := cache.do(context.Background(), "key", fetch)
+			if err != nil {
+				t.Error(err)
+			}
+			sources <- source
+		}()
+	}
+
+	// Let every caller join the in-flight query before it completes.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(sources)
+
+	if fetches != 1 {
+		t.Errorf("expected 1 Honeycomb query, got %d", fetches)
+	}
+	counts := map[cacheSource]int{}
+	for source := range sources {
+		counts[source]++
+	}
+	if counts[cacheSourceHoneycomb] != 1 || counts[cacheSourceInflight] != callers-1 {
+		t.Errorf("expected 1 fetch and %d shared results, got %v", callers-1, counts)
+	}
+}
+
+func TestQueryCacheCallerCancellation(t *testing.T) {
+	cache := newQueryCache(30 * time.Second)
+
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) (*HoneycombQueryResult, error) {
+		<-release
+		return &HoneycombQueryResult{Complete: true}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := cache.do(ctx, "key", fetch); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// The detached query still completes and is cached for later callers.
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := cache.get("key"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the detached query result to be cached")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Pseudo-functions comparing the canary of a Flagger target with its primary.
+// Both take an instant vector and evaluate it as a single leaf query grouped
+// by workload.
+const (
+	// canaryDeltaFunc returns canary minus primary.
+	canaryDeltaFunc = "canary_delta"
+	// canaryRatioFunc returns canary divided by primary.
+	canaryRatioFunc = "canary_ratio"
+)
+
+// canaryNode compares the canary and primary workloads of a leaf query that
+// is grouped by the workload label.
+type canaryNode struct {
+	Func    string
+	Leaf    *leafNode
+	Canary  string
+	Primary string
+}
+
+func (*canaryNode) planNode() {}
+
+// translateCanaryComparison translates canary_delta() and canary_ratio(). The
+// argument must translate to a single leaf query for the target service
+// with no role of its own; the comparison selects both roles.
+func (t *promQLTranslator) translateCanaryComparison(e *Call, ctx translateContext) (planNode, error) {
+	inner, err := t.translate(e.Args[0], ctx)
+	if err != nil {
+		return nil, err
+	}
+	leaf, ok := inner.(*leafNode)
+	if !ok {
+		return nil, t.errorf(e.Args[0], "%s() is only supported on a single selector, optionally aggregated", e.Func.Name)
+	}
+	target, err := t.mapper.leaf(&leaf.LeafQuery)
+	if err != nil {
+		return nil, t.mappingError(e.Args[0], err)
+	}
+	if target.Service == "" {
+		return nil, t.errorf(e.Args[0], `%s() requires a service="..." or job="..." matcher naming the canary target`, e.Func.Name)
+	}
+	if target.Role != "" {
+		return nil, t.errorf(e.Args[0], "%s() compares both roles, remove the -%s suffix or %s label", e.Func.Name, target.Role, roleLabel)
+	}
+	if containsString(leaf.Grouping, workloadLabel) {
+		return nil, t.errorf(e.Args[0], "%s() cannot be used on a result grouped by %q", e.Func.Name, workloadLabel)
+	}
+
+	canary := flaggerTarget{Name: target.Service, Role: roleCanary}.workload()
+	primary := flaggerTarget{Name: target.Service, Role: rolePrimary}.workload()
+	leaf.Matchers = append(append([]*LabelMatcher{}, leaf.Matchers...), &LabelMatcher{
+		Name:  workloadLabel,
+		Type:  MatchRegexp,
+		Value: regexp.QuoteMeta(canary) + "|" + regexp.QuoteMeta(primary),
+	})
+	leaf.Grouping = append(append([]string{}, leaf.Grouping...), workloadLabel)
+
+	return &canaryNode{Func: e.Func.Name, Leaf: leaf, Canary: canary, Primary: primary}, nil
+}
+
+// evalCanary splits the leaf result into its canary and primary series and
+// combines the series with matching labels. Series present on only one side
+// are dropped, like unmatched series of a binary operation.
+func (ev *evaluator) evalCanary(n *canaryNode) (value, error) {
+	canary, primary := Vector{}, Vector{}
+	for _, s := range ev.results[n.Leaf].scale(ev.leafScale(n.Leaf)) {
+		metric := make(map[string]string, len(s.Metric))
+		for name, v := range s.Metric {
+			if name != workloadLabel {
+				metric[name] = v
+			}
+		}
+		switch s.Metric[workloadLabel] {
+		case n.Canary:
+			canary = append(canary, Sample{Metric: metric, Value: s.Value})
+		case n.Primary:
+			primary = append(primary, Sample{Metric: metric, Value: s.Value})
+		}
+	}
+
+	switch n.Func {
+	case canaryDeltaFunc:
+		return vectorBinary("-", false, canary, primary)
+	case canaryRatioFunc:
+		return vectorBinary("/", false, canary, primary)
+	}
+	return nil, fmt.Errorf("unknown canary comparison %q", n.Func)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTranslateCanaryComparison(t *testing.T) {
+	adapter := &HoneycombAdapter{queryTimeWindow: 3 * time.Minute}
+
+	plan, err := adapter.translatePromQL(`canary_ratio(sum by (route) (rate(http_requests_total{service="podinfo"}[5m])))`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	leaves := honeycombPlanLeaves(t, adapter, plan)
+	if len(leaves) != 1 {
+		t.Fatalf("expected a single Honeycomb query, got %d", len(leaves))
+	}
+
+	query := leaves[0].Query
+	workloads := Filter{Column: "k8s.deployment.name", Op: "in", Value: []string{"podinfo", "podinfo-primary"}}
+	if !reflect.DeepEqual(query.Filters[len(query.Filters)-1], workloads) {
+		t.Errorf("expected filter %+v, got %+v", workloads, query.Filters)
+	}
+	if !reflect.DeepEqual(query.Breakdowns, []string{"http.route", "k8s.deployment.name"}) {
+		t.Errorf("expected breakdowns by route and workload, got %v", query.Breakdowns)
+	}
+	if labels := planLabels(plan.Root); !reflect.DeepEqual(labels, []string{"route"}) {
+		t.Errorf("expected result labels [route], got %v", labels)
+	}
+}
+
+func TestTranslateCanaryComparisonErrors(t *testing.T) {
+	adapter := &HoneycombAdapter{queryTimeWindow: 3 * time.Minute}
+
+	tests := []struct {
+		name    string
+		promQL  string
+		wantErr string
+	}{
+		{
+			name:    "no service",
+			promQL:  `canary_delta(rate(http_requests_total[5m]))`,
+			wantErr: `requires a service="..." or job="..." matcher`,
+		},
+		{
+			name:    "role selected",
+			promQL:  `canary_delta(rate(http_requests_total{service="podinfo-canary"}[5m]))`,
+			wantErr: `compares both roles, remove the -canary suffix`,
+		},
+		{
+			name:    "grouped by workload",
+			promQL:  `canary_delta(sum by (deployment) (rate(http_requests_total{service="podinfo"}[5m])))`,
+			wantErr: `cannot be used on a result grouped by "deployment"`,
+		},
+		{
+			name:    "binary operation",
+			promQL:  `canary_ratio(rate(http_requests_total{service="podinfo", code="500"}[5m]) / rate(http_requests_total{service="podinfo"}[5m]))`,
+			wantErr: `only supported on a single selector`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := adapter.translatePromQL(tt.promQL)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestHandleQueryCanaryComparison(t *testing.T) {
+	backend := &staticBackend{values: map[string]Vector{
+		"http_requests_total": {
+			{Metric: map[string]string{"route": "/", "deployment": "podinfo"}, Value: 30},
+			{Metric: map[string]string{"route": "/", "deployment": "podinfo-primary"}, Value: 20},
+			{Metric: map[string]string{"route": "/api", "deployment": "podinfo"}, Value: 5},
+			{Metric: map[string]string{"route": "/api", "deployment": "podinfo-primary"}, Value: 0},
+			{Metric: map[string]string{"route": "/new", "deployment": "podinfo"}, Value: 7},
+		},
+	}}
+	adapter := &HoneycombAdapter{
+		queryTimeWindow: 3 * time.Minute,
+		backend:         backend,
+	}
+
+	tests := []struct {
+		fn       string
+		expected map[string]string
+	}{
+		{fn: canaryDeltaFunc, expected: map[string]string{"/": "10", "/api": "5"}},
+		{fn: canaryRatioFunc, expected: map[string]string{"/": "1.5"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fn, func(t *testing.T) {
+			query := url.Values{"query": {tt.fn + `(sum by (route) (increase(http_requests_total{service="podinfo"}[5m])))`}}
+			rec := httptest.NewRecorder()
+			adapter.handleQuery(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?"+query.Encode(), nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+
+			var result PrometheusResponse
+			if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			for _, r := range result.Data.Result {
+				if _, ok := r.Metric["deployment"]; ok {
+					t.Errorf("expected the workload label to be dropped, got %v", r.Metric)
+				}
+				got[r.Metric["route"]] = r.Value[1].(string)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
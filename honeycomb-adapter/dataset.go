@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dataset resolution strategies, selected with HONEYCOMB_DATASET_STRATEGY.
+const (
+	// datasetStrategyFixed queries HONEYCOMB_DATASET for every service.
+	datasetStrategyFixed = "fixed"
+	// datasetStrategyService queries the dataset named after the service.
+	datasetStrategyService = "service"
+	// datasetStrategyLabel queries the dataset named by a dataset label.
+	datasetStrategyLabel = "label"
+	// datasetStrategyLookup looks the dataset up in the metric mapping.
+	datasetStrategyLookup = "lookup"
+	// datasetStrategyAll queries the whole environment.
+	datasetStrategyAll = "all"
+)
+
+// allDatasets is the dataset slug Honeycomb uses for environment-wide queries.
+const allDatasets = "__all__"
+
+// datasetLabel is the PromQL label that names the Honeycomb dataset of a
+// selector, whatever the strategy.
+const datasetLabel = "dataset"
+
+// DatasetResolver chooses the Honeycomb dataset a leaf query runs in.
+type DatasetResolver interface {
+	// Resolve returns the dataset for the leaf, and whether the dataset is
+	// shared with other services, in which case the query is filtered on
+	// the leaf's service.
+	Resolve(leaf *honeycombLeaf) (dataset string, shared bool, err error)
+}
+
+// DatasetError is returned when no Honeycomb dataset can be chosen for a
+// selector. Queries never fall back to a default dataset.
+type DatasetError struct {
+	Expr string
+	Err  string
+}
+
+func (e *DatasetError) Error() string {
+	return fmt.Sprintf("cannot choose a Honeycomb dataset for %q: %s", e.Expr, e.Err)
+}
+
+type fixedDatasetResolver struct {
+	dataset string
+}
+
+func (r *fixedDatasetResolver) Resolve(leaf *honeycombLeaf) (string, bool, error) {
+	return r.dataset, true, nil
+}
+
+type serviceDatasetResolver struct{}
+
+func (r *serviceDatasetResolver) Resolve(leaf *honeycombLeaf) (string, bool, error) {
+	if leaf.Service == "" {
+		return "", false, fmt.Errorf(`the selector has no service="..." or job="..." matcher to name the dataset`)
+	}
+	return leaf.Service, false, nil
+}
+
+type labelDatasetResolver struct{}
+
+func (r *labelDatasetResolver) Resolve(leaf *honeycombLeaf) (string, bool, error) {
+	// Selectors with a dataset label never get here
+	return "", false, fmt.Errorf(`the selector has no %s="..." matcher`, datasetLabel)
+}
+
+// lookupDatasetResolver maps services and namespaces onto datasets with the
+// datasets table of the metric mapping.
+type lookupDatasetResolver struct {
+	adapter *HoneycombAdapter
+}
+
+func (r *lookupDatasetResolver) Resolve(leaf *honeycombLeaf) (string, bool, error) {
+	table := r.adapter.queryConfig(leaf.LeafQuery).Datasets
+	if dataset, ok := table.Services[leaf.Service]; ok && leaf.Service != "" {
+		return dataset, true, nil
+	}
+	if dataset, ok := table.Namespaces[leaf.Namespace]; ok && leaf.Namespace != "" {
+		return dataset, true, nil
+	}
+	if table.Default != "" {
+		return table.Default, true, nil
+	}
+	return "", false, fmt.Errorf("service %q and namespace %q are not in the dataset lookup table", leaf.Service, leaf.Namespace)
+}
+
+// allDatasetResolver runs every query environment-wide, scoped to the
+// selector's service.
+type allDatasetResolver struct{}
+
+func (r *allDatasetResolver) Resolve(leaf *honeycombLeaf) (string, bool, error) {
+	if leaf.Service == "" {
+		return "", false, fmt.Errorf(`environment-wide queries need a service="..." or job="..." matcher to filter on`)
+	}
+	return allDatasets, true, nil
+}
+
+// defaultDatasetStrategy is the strategy used when none is configured: the
+// configured dataset if there is one, one dataset per service otherwise.
+func defaultDatasetStrategy(dataset string) string {
+	if dataset != "" {
+		return datasetStrategyFixed
+	}
+	return datasetStrategyService
+}
+
+// newDatasetResolver returns the resolver for a strategy.
+func (h *HoneycombAdapter) newDatasetResolver(strategy, dataset string) (DatasetResolver, error) {
+	switch strategy {
+	case datasetStrategyFixed:
+		if dataset == "" {
+			return nil, fmt.Errorf("dataset strategy %q requires HONEYCOMB_DATASET", strategy)
+		}
+		return &fixedDatasetResolver{dataset: dataset}, nil
+	case datasetStrategyService:
+		return &serviceDatasetResolver{}, nil
+	case datasetStrategyLabel:
+		return &labelDatasetResolver{}, nil
+	case datasetStrategyLookup:
+		return &lookupDatasetResolver{adapter: h}, nil
+	case datasetStrategyAll:
+		return &allDatasetResolver{}, nil
+	}
+	return nil, fmt.Errorf("unknown dataset strategy %q, use one of %s", strategy, strings.Join([]string{
+		datasetStrategyFixed, datasetStrategyService, datasetStrategyLabel, datasetStrategyLookup, datasetStrategyAll,
+	}, ", "))
+}
+
+// queryDatasetResolver returns the configured DatasetResolver, defaulting to
+// one dataset per service.
+func (h *HoneycombAdapter) queryDatasetResolver() DatasetResolver {
+	if h.datasetResolver != nil {
+		return h.datasetResolver
+	}
+	return &serviceDatasetResolver{}
+}
+
+// leafDataset returns the dataset a leaf runs in and its query, filtered on
+// the leaf's service when the dataset holds other services too. A dataset
+// label on the selector takes precedence over the strategy.
+func (h *HoneycombAdapter) leafDataset(leaf *honeycombLeaf) (string, *HoneycombQuery, error) {
+	dataset, shared := leaf.Dataset, true
+	if dataset == "" {
+		var err error
+		dataset, shared, err = h.queryDatasetResolver().Resolve(leaf)
+		if err != nil {
+			return "", nil, &DatasetError{Expr: leaf.String(), Err: err.Error()}
+		}
+	}
+	if dataset == "" {
+		return "", nil, &DatasetError{Expr: leaf.String(), Err: "the dataset is empty"}
+	}
+
+	query := leaf.Query
+	if shared && leaf.Service != "" {
+		scoped := *query
+		scoped.Filters = append(append([]Filter{}, query.Filters...), Filter{
+			Column: h.queryConfig(leaf.LeafQuery).labelColumn(leaf.Metric, "service"),
+			Op:     "=",
+			Value:  leaf.Service,
+		})
+		query = &scoped
+	}
+	return dataset, query, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLeafDataset(t *testing.T) {
+	config, err := parseMappingConfig([]byte(`
+datasets:
+  services:
+    checkout: checkout-prod
+  namespaces:
+    payments: payments
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		strategy     string
+		dataset      string
+		promQL       string
+		wantDataset  string
+		wantFiltered bool
+		wantErr      string
+	}{
+		{
+			name:        "service",
+			strategy:    datasetStrategyService,
+			promQL:      `http_requests_total{service="checkout"}`,
+			wantDataset: "checkout",
+		},
+		{
+			name:        "service from job",
+			strategy:    datasetStrategyService,
+			promQL:      `http_requests_total{job="checkout"}`,
+			wantDataset: "checkout",
+		},
+		{
+			name:     "service missing",
+			strategy: datasetStrategyService,
+			promQL:   `http_requests_total{code="200"}`,
+			wantErr:  `has no service="..." or job="..." matcher`,
+		},
+		{
+			name:         "fixed",
+			strategy:     datasetStrategyFixed,
+			dataset:      "production",
+			promQL:       `http_requests_total{service="checkout"}`,
+			wantDataset:  "production",
+			wantFiltered: true,
+		},
+		{
+			name:         "label",
+			strategy:     datasetStrategyLabel,
+			promQL:       `http_requests_total{service="checkout", dataset="edge"}`,
+			wantDataset:  "edge",
+			wantFiltered: true,
+		},
+		{
+			name:     "label missing",
+			strategy: datasetStrategyLabel,
+			promQL:   `http_requests_total{service="checkout"}`,
+			wantErr:  `has no dataset="..." matcher`,
+		},
+		{
+			name:         "dataset label overrides the strategy",
+			strategy:     datasetStrategyService,
+			promQL:       `http_requests_total{service="checkout", dataset="edge"}`,
+			wantDataset:  "edge",
+			wantFiltered: true,
+		},
+		{
+			name:         "lookup by service",
+			strategy:     datasetStrategyLookup,
+			promQL:       `http_requests_total{service="checkout", namespace="payments"}`,
+			wantDataset:  "checkout-prod",
+			wantFiltered: true,
+		},
+		{
+			name:         "lookup by namespace",
+			strategy:     datasetStrategyLookup,
+			promQL:       `http_requests_total{service="refunds", namespace="payments"}`,
+			wantDataset:  "payments",
+			wantFiltered: true,
+		},
+		{
+			name:     "lookup miss",
+			strategy: datasetStrategyLookup,
+			promQL:   `http_requests_total{service="search"}`,
+			wantErr:  `not in the dataset lookup table`,
+		},
+		{
+			name:         "environment-wide",
+			strategy:     datasetStrategyAll,
+			promQL:       `http_requests_total{service="checkout"}`,
+			wantDataset:  allDatasets,
+			wantFiltered: true,
+		},
+		{
+			name:     "environment-wide without service",
+			strategy: datasetStrategyAll,
+			promQL:   `http_requests_total`,
+			wantErr:  `need a service="..." or job="..." matcher`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &HoneycombAdapter{queryTimeWindow: 3 * time.Minute}
+			adapter.mappings.Store(config)
+			resolver, err := adapter.newDatasetResolver(tt.strategy, tt.dataset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			adapter.datasetResolver = resolver
+
+			plan, err := adapter.translatePromQL(tt.promQL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf := honeycombPlanLeaves(t, adapter, plan)[0]
+			dataset, query, err := adapter.leafDataset(leaf)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if dataset != tt.wantDataset {
+				t.Errorf("expected dataset %q, got %q", tt.wantDataset, dataset)
+			}
+
+			serviceFilter := Filter{Column: "service.name", Op: "=", Value: leaf.Service}
+			filtered := false
+			for _, f := range query.Filters {
+				if f == serviceFilter {
+					filtered = true
+				}
+			}
+			if filtered != tt.wantFiltered {
+				t.Errorf("expected service filter=%v, got filters %+v", tt.wantFiltered, query.Filters)
+			}
+		})
+	}
+}
+
+func TestNewDatasetResolverErrors(t *testing.T) {
+	adapter := &HoneycombAdapter{}
+	if _, err := adapter.newDatasetResolver(datasetStrategyFixed, ""); err == nil {
+		t.Error("expected the fixed strategy to require a dataset")
+	}
+	if _, err := adapter.newDatasetResolver("per-team", ""); err == nil {
+		t.Error("expected an unknown strategy to be rejected")
+	}
+	if got := defaultDatasetStrategy(""); got != datasetStrategyService {
+		t.Errorf("expected service strategy without a dataset, got %s", got)
+	}
+	if got := defaultDatasetStrategy("production"); got != datasetStrategyFixed {
+		t.Errorf("expected fixed strategy with a dataset, got %s", got)
+	}
+}
+
+func TestHandleQueryUnresolvableDataset(t *testing.T) {
+	var requests int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.NotFound(w, r)
+	}))
+	defer mockServer.Close()
+
+	adapter := &HoneycombAdapter{
+		honeycombAPIKey:  "test-key",
+		honeycombBaseURL: mockServer.URL,
+		queryTimeWindow:  3 * time.Minute,
+	}
+	adapter.ensureTelemetry()
+
+	queries := []string{
+		`sum(rate(http_requests_total{code="500"}[5m]))`,
+		// Only the second leaf lacks a dataset; the first must not run
+		`sum(rate(http_requests_total{service="podinfo"}[5m])) / sum(rate(http_requests_total{code="500"}[5m]))`,
+	}
+	for _, q := range queries {
+		rec := httptest.NewRecorder()
+		query := url.Values{"query": {q}}
+		adapter.handleQuery(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?"+query.Encode(), nil))
+
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "cannot choose a Honeycomb dataset") {
+			t.Errorf("%s: expected a bad_data dataset error, got %d: %s", q, rec.Code, rec.Body.String())
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("expected no Honeycomb requests, got %d", n)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+)
+
+// Prometheus API error types, reported in the errorType field of a failed
+// response.
+const (
+	errorBadData     = "bad_data"
+	errorExecution   = "execution"
+	errorTimeout     = "timeout"
+	errorUnavailable = "unavailable"
+	errorInternal    = "internal"
+)
+
+// errQueryIncomplete is returned when Honeycomb did not finish a query within
+// the polling budget.
+var errQueryIncomplete = errors.New("query did not complete")
+
+// classifyError returns the Prometheus error type for a failure to evaluate
+// a translated query.
+func classifyError(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled), errors.Is(err, errQueryIncomplete):
+		return errorTimeout
+	case errors.Is(err, errCircuitOpen), errors.Is(err, errRateLimited):
+		return errorUnavailable
+	}
+
+	var datasetErr *DatasetError
+	var translationErr *TranslationError
+	var parseErr *ParseError
+	var templateErr *TemplateError
+	if errors.As(err, &datasetErr) || errors.As(err, &translationErr) || errors.As(err, &parseErr) || errors.As(err, &templateErr) {
+		return errorBadData
+	}
+
+	var apiErr *HoneycombAPIError
+	if errors.As(err, &apiErr) {
+		if apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= 500 {
+			return errorUnavailable
+		}
+		// Honeycomb rejected the query itself
+		return errorExecution
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return errorUnavailable
+	}
+	return errorExecution
+}
+
+// errorStatus returns the HTTP status Prometheus uses for an error type.
+func errorStatus(errorType string) int {
+	switch errorType {
+	case errorBadData:
+		return http.StatusBadRequest
+	case errorExecution:
+		return http.StatusUnprocessableEntity
+	case errorTimeout, errorUnavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// writePrometheusError writes err as a Prometheus API error response.
+func writePrometheusError(w http.ResponseWriter, errorType string, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(errorStatus(errorType))
+	json.NewEncoder(w).Encode(PrometheusErrorResponse{
+		Status:    "error",
+		ErrorType: errorType,
+		Error:     err.Error(),
+	})
+}
+
+// writePrometheusResponse writes a successful Prometheus API response, a
+// *PrometheusResponse or *PrometheusDataResponse. The body is encoded before
+// anything is written, so an encoding failure can still be reported as an
+// error response.
+func writePrometheusResponse(w http.ResponseWriter, response interface{}) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("❌ Response encoding error: %v", err)
+		writePrometheusError(w, errorInternal, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingBackend fails every query with err.
+type failingBackend struct {
+	err error
+}
+
+func (b *failingBackend) Instant(ctx context.Context, queries []*LeafQuery, at time.Time) ([]Vector, error) {
+	return nil, b.err
+}
+
+func (b *failingBackend) Range(ctx context.Context, queries []*LeafQuery, rng RangeParams) ([]Matrix, error) {
+	return nil, b.err
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{name: "deadline", err: fmt.Errorf("stopped polling: %w", context.DeadlineExceeded), expected: errorTimeout},
+		{name: "query incomplete", err: fmt.Errorf("%w after 10 attempts", errQueryIncomplete), expected: errorTimeout},
+		{name: "circuit open", err: errCircuitOpen, expected: errorUnavailable},
+		{name: "rate limited", err: errRateLimited, expected: errorUnavailable},
+		{name: "honeycomb unavailable", err: &HoneycombAPIError{StatusCode: http.StatusBadGateway}, expected: errorUnavailable},
+		{name: "honeycomb throttled", err: &HoneycombAPIError{StatusCode: http.StatusTooManyRequests}, expected: errorUnavailable},
+		{name: "honeycomb rejected query", err: fmt.Errorf("failed to create query: %w", &HoneycombAPIError{StatusCode: http.StatusBadRequest}), expected: errorExecution},
+		{name: "unresolvable dataset", err: &DatasetError{Expr: "up", Err: "no service"}, expected: errorBadData},
+		{name: "untranslatable selector", err: &TranslationError{Expr: "up", Err: "no mapping"}, expected: errorBadData},
+		{name: "evaluation error", err: errors.New("many-to-many matching not allowed"), expected: errorExecution},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyError(tt.err); got != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	tests := []struct {
+		name          string
+		handler       string
+		params        url.Values
+		backendErr    error
+		wantStatus    int
+		wantErrorType string
+	}{
+		{
+			name:          "missing query",
+			handler:       "query",
+			params:        url.Values{},
+			wantStatus:    http.StatusBadRequest,
+			wantErrorType: errorBadData,
+		},
+		{
+			name:          "invalid PromQL",
+			handler:       "query",
+			params:        url.Values{"query": {`sum(rate(http_requests_total[5m])`}},
+			wantStatus:    http.StatusBadRequest,
+			wantErrorType: errorBadData,
+		},
+		{
+			name:          "untranslatable query",
+			handler:       "query",
+			params:        url.Values{"query": {`node_cpu_seconds_total`}},
+			wantStatus:    http.StatusBadRequest,
+			wantErrorType: errorBadData,
+		},
+		{
+			name:          "rejected by Honeycomb",
+			handler:       "query",
+			params:        url.Values{"query": {`sum(rate(http_requests_total{service="test"}[5m]))`}},
+			backendErr:    &HoneycombAPIError{StatusCode: http.StatusBadRequest},
+			wantStatus:    http.StatusUnprocessableEntity,
+			wantErrorType: errorExecution,
+		},
+		{
+			name:          "Honeycomb too slow",
+			handler:       "query",
+			params:        url.Values{"query": {`sum(rate(http_requests_total{service="test"}[5m]))`}},
+			backendErr:    fmt.Errorf("%w after 10 attempts", errQueryIncomplete),
+			wantStatus:    http.StatusServiceUnavailable,
+			wantErrorType: errorTimeout,
+		},
+		{
+			name:          "invalid range",
+			handler:       "query_range",
+			params:        url.Values{"query": {`http_requests_total`}, "start": {"later"}, "end": {"1700000060"}, "step": {"60"}},
+			wantStatus:    http.StatusBadRequest,
+			wantErrorType: errorBadData,
+		},
+		{
+			name:          "range query unavailable",
+			handler:       "query_range",
+			params:        url.Values{"query": {`http_requests_total`}, "start": {"1700000000"}, "end": {"1700000060"}, "step": {"60"}},
+			backendErr:    errCircuitOpen,
+			wantStatus:    http.StatusServiceUnavailable,
+			wantErrorType: errorUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &HoneycombAdapter{
+				queryTimeWindow: 3 * time.Minute,
+				backend:         &failingBackend{err: tt.backendErr},
+			}
+			adapter.ensureTelemetry()
+
+			handler := adapter.handleQuery
+			if tt.handler == "query_range" {
+				handler = adapter.handleQueryRange
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/"+tt.handler+"?"+tt.params.Encode(), nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("expected JSON content type, got %q", ct)
+			}
+			var response PrometheusErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+				t.Fatalf("failed to decode error response: %v", err)
+			}
+			if response.Status != "error" || response.ErrorType != tt.wantErrorType || response.Error == "" {
+				t.Errorf("expected %s error, got %+v", tt.wantErrorType, response)
+			}
+		})
+	}
+}
+
+func TestResponseWarnings(t *testing.T) {
+	adapter := &HoneycombAdapter{
+		queryTimeWindow: 3 * time.Minute,
+		backend: &staticBackend{values: map[string]Vector{
+			"http_requests_total": {{Metric: map[string]string{}, Value: 42}},
+		}},
+	}
+	adapter.ensureTelemetry()
+
+	tests := []struct {
+		name         string
+		query        string
+		wantWarnings []string
+	}{
+		{
+			name:  "window at the minimum",
+			query: `sum(rate(http_requests_total{service="test"}[5m]))`,
+		},
+		{
+			name:         "window raised to the minimum",
+			query:        `sum(rate(http_requests_total{service="test"}[30s]))`,
+			wantWarnings: []string{`range of http_requests_total{service="test"} raised from 30s to the minimum query window of 3m`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			adapter.handleQuery(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?"+url.Values{"query": {tt.query}}.Encode(), nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+
+			var response PrometheusResponse
+			if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(response.Warnings, "\n") != strings.Join(tt.wantWarnings, "\n") {
+				t.Errorf("expected warnings %q, got %q", tt.wantWarnings, response.Warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sample is a single element of an instant vector.
+type Sample struct {
+	Metric map[string]string
+	Value  float64
+}
+
+// value is the result of evaluating a plan node: a scalarValue or a Vector.
+type value interface {
+	valueType() ValueType
+}
+
+type scalarValue float64
+
+// Vector is an instant vector, the result a Backend returns for a leaf
+// query evaluated at one time.
+type Vector []Sample
+
+func (scalarValue) valueType() ValueType { return ValueTypeScalar }
+func (Vector) valueType() ValueType      { return ValueTypeVector }
+
+// scale returns the vector with every value multiplied by factor. A factor of
+// 0 or 1 leaves the vector unchanged.
+func (v Vector) scale(factor float64) Vector {
+	if factor == 0 || factor == 1 {
+		return v
+	}
+	out := make(Vector, len(v))
+	for i, s := range v {
+		out[i] = Sample{Metric: s.Metric, Value: s.Value * factor}
+	}
+	return out
+}
+
+// evaluator combines the results of a plan's leaf queries according to the
+// PromQL operators between them.
+type evaluator struct {
+	results map[*leafNode]Vector
+	// windows are the windows the leaf values of a range query cover, where
+	// they differ from the leaves' own.
+	windows map[*leafNode]time.Duration
+}
+
+// evaluatePlan runs every leaf query in the plan on the backend at the
+// evaluation time at (now if zero) and evaluates the expression on top of the
+// results.
+func (h *HoneycombAdapter) evaluatePlan(ctx context.Context, plan *queryPlan, at time.Time) (value, error) {
+	ctx, span := h.tracer.Start(ctx, "evaluatePlan")
+	defer span.End()
+
+	leaves := plan.leaves()
+	results, err := h.queryBackend().Instant(ctx, plan.queries(), at)
+	if err != nil {
+		return nil, err
+	}
+
+	ev := &evaluator{results: make(map[*leafNode]Vector, len(leaves))}
+	for i, leaf := range leaves {
+		ev.results[leaf] = results[i]
+	}
+	return ev.eval(plan.Root)
+}
+
+func (ev *evaluator) eval(node planNode) (value, error) {
+	switch n := node.(type) {
+	case *scalarNode:
+		return scalarValue(n.Value), nil
+	case *vectorNode:
+		return Vector{{Metric: map[string]string{}, Value: n.Value}}, nil
+	case *leafNode:
+		return ev.results[n].scale(ev.leafScale(n)), nil
+	case *binaryNode:
+		lhs, err := ev.eval(n.LHS)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := ev.eval(n.RHS)
+		if err != nil {
+			return nil, err
+		}
+		return evalBinary(n.Op, n.ReturnBool, lhs, rhs)
+	case *canaryNode:
+		return ev.evalCanary(n)
+	case *funcNode:
+		return ev.evalFunc(n)
+	case *aggregateNode:
+		return ev.evalAggregate(n)
+	}
+	return nil, fmt.Errorf("cannot evaluate plan node %T", node)
+}
+
+// leafScale returns the factor converting a leaf's backend values into the
+// values of its PromQL expression: for rate() and increase(), the window the
+// values were counted over.
+func (ev *evaluator) leafScale(l *leafNode) float64 {
+	if l.Per <= 0 {
+		return 1
+	}
+	window := l.Window
+	if w, ok := ev.windows[l]; ok {
+		window = w
+	}
+	if window <= 0 {
+		return 1
+	}
+	return l.Per.Seconds() / window.Seconds()
+}
+
+// evalBinary applies an arithmetic or comparison operator between two values
+// following PromQL's one-to-one vector matching rules. Comparisons filter the
+// vector operands unless returnBool is set, in which case they return 1 or 0.
+func evalBinary(op string, returnBool bool, lhs, rhs value) (value, error) {
+	apply := binaryOperator(op, returnBool)
+	filter := isComparisonOperator(op) && !returnBool
+
+	switch l := lhs.(type) {
+	case scalarValue:
+		switch r := rhs.(type) {
+		case scalarValue:
+			if v, ok := apply(float64(l), float64(r)); ok {
+				return scalarValue(v), nil
+			}
+			// A scalar cannot be dropped like a sample; as in PromQL,
+			// division and modulo by zero give ±Inf or NaN.
+			if op == "%" {
+				return scalarValue(math.Mod(float64(l), float64(r))), nil
+			}
+			return scalarValue(float64(l) / float64(r)), nil
+		case Vector:
+			out := Vector{}
+			for _, s := range r {
+				if v, ok := apply(float64(l), s.Value); ok {
+					if filter {
+						// A filtering comparison keeps the vector's sample
+						v = s.Value
+					}
+					out = append(out, Sample{Metric: s.Metric, Value: v})
+				}
+			}
+			return out, nil
+		}
+	case Vector:
+		switch r := rhs.(type) {
+		case scalarValue:
+			out := Vector{}
+			for _, s := range l {
+				if v, ok := apply(s.Value, float64(r)); ok {
+					out = append(out, Sample{Metric: s.Metric, Value: v})
+				}
+			}
+			return out, nil
+		case Vector:
+			return vectorBinary(op, returnBool, l, r)
+		}
+	}
+	return nil, fmt.Errorf("unsupported operand types %s %s %s", lhs.valueType(), op, rhs.valueType())
+}
+
+func vectorBinary(op string, returnBool bool, lhs, rhs Vector) (Vector, error) {
+	apply := binaryOperator(op, returnBool)
+	rightBySignature := make(map[string]Sample, len(rhs))
+	for _, s := range rhs {
+		sig := labelSignature(s.Metric)
+		if _, dup := rightBySignature[sig]; dup {
+			return nil, fmt.Errorf("found duplicate series for the match group %s on the right hand-side of the operation", sig)
+		}
+		rightBySignature[sig] = s
+	}
+
+	out := Vector{}
+	matchedLeft := make(map[string]bool, len(lhs))
+	for _, ls := range lhs {
+		sig := labelSignature(ls.Metric)
+		rs, ok := rightBySignature[sig]
+		if !ok {
+			continue
+		}
+		if matchedLeft[sig] {
+			return nil, fmt.Errorf("multiple matches for labels %s: many-to-one matching must be explicit (group_left/group_right)", sig)
+		}
+		matchedLeft[sig] = true
+		if v, ok := apply(ls.Value, rs.Value); ok {
+			out = append(out, Sample{Metric: ls.Metric, Value: v})
+		}
+	}
+	return out, nil
+}
+
+// binaryOperator returns a function applying op to two sample values. ok is
+// false when the sample is dropped from the result.
+func binaryOperator(op string, returnBool bool) func(a, b float64) (float64, bool) {
+	if !isComparisonOperator(op) {
+		return func(a, b float64) (float64, bool) { return arithmetic(op, a, b) }
+	}
+	return func(a, b float64) (float64, bool) {
+		match := compare(op, a, b)
+		if returnBool {
+			if match {
+				return 1, true
+			}
+			return 0, true
+		}
+		return a, match
+	}
+}
+
+// compare applies a comparison operator.
+func compare(op string, a, b float64) bool {
+	switch op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
+
+// arithmetic applies an arithmetic operator. ok is false when the result is
+// undefined (division or modulo by zero) and the sample must be dropped.
+func arithmetic(op string, a, b float64) (float64, bool) {
+	switch op {
+	case "+":
+		return a + b, true
+	case "-":
+		return a - b, true
+	case "*":
+		return a * b, true
+	case "/":
+		if b == 0 {
+			log.Printf("⚠️  Division by zero (%v / %v), dropping sample", a, b)
+			return 0, false
+		}
+		return a / b, true
+	case "%":
+		if b == 0 {
+			return 0, false
+		}
+		return math.Mod(a, b), true
+	case "^":
+		return math.Pow(a, b), true
+	case "atan2":
+		return math.Atan2(a, b), true
+	}
+	return 0, false
+}
+
+// labelSignature returns a canonical string for a label set.
+func labelSignature(metric map[string]string) string {
+	names := make([]string, 0, len(metric))
+	for name := range metric {
+		if name != "__name__" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%q", name, metric[name]))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
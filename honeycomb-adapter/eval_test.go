@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEvalBinary(t *testing.T) {
+	tests := []struct {
+		name     string
+		op       string
+		lhs      value
+		rhs      value
+		expected Vector
+	}{
+		{
+			name:     "vector divided by vector",
+			op:       "/",
+			lhs:      Vector{{Metric: map[string]string{}, Value: 60}},
+			rhs:      Vector{{Metric: map[string]string{}, Value: 100}},
+			expected: Vector{{Metric: map[string]string{}, Value: 0.6}},
+		},
+		{
+			name:     "vector times scalar",
+			op:       "*",
+			lhs:      Vector{{Metric: map[string]string{}, Value: 0.6}},
+			rhs:      scalarValue(100),
+			expected: Vector{{Metric: map[string]string{}, Value: 60}},
+		},
+		{
+			name:     "division by zero",
+			op:       "/",
+			lhs:      Vector{{Metric: map[string]string{}, Value: 0}},
+			rhs:      Vector{{Metric: map[string]string{}, Value: 0}},
+			expected: Vector{},
+		},
+		{
+			name: "only matching label sets",
+			op:   "-",
+			lhs: Vector{
+				{Metric: map[string]string{"service": "a"}, Value: 10},
+				{Metric: map[string]string{"service": "b"}, Value: 20},
+			},
+			rhs:      Vector{{Metric: map[string]string{"service": "b"}, Value: 5}},
+			expected: Vector{{Metric: map[string]string{"service": "b"}, Value: 15}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := evalBinary(tt.op, false, tt.lhs, tt.rhs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			v, ok := result.(Vector)
+			if !ok {
+				t.Fatalf("expected vector result, got %T", result)
+			}
+			if len(v) != len(tt.expected) {
+				t.Fatalf("expected %d samples, got %d", len(tt.expected), len(v))
+			}
+			for i := range v {
+				if v[i].Value != tt.expected[i].Value || labelSignature(v[i].Metric) != labelSignature(tt.expected[i].Metric) {
+					t.Errorf("expected %+v, got %+v", tt.expected[i], v[i])
+				}
+			}
+		})
+	}
+}
+
+// mockSuccessRateServer answers count queries with 60 events when the query
+// filters on the status code and 100 events otherwise.
+func mockSuccessRateServer(total float64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/1/queries/test":
+			var query HoneycombQuery
+			json.NewDecoder(r.Body).Decode(&query)
+			id := "all"
+			if len(query.Filters) > 0 {
+				id = "ok"
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": id})
+		case "/1/query_results/test":
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			count := total
+			if body["query_id"] == "ok" {
+				count = 60
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{
+					"results": []interface{}{
+						map[string]interface{}{"data": map[string]interface{}{"COUNT": count}},
+					},
+				},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestEvalConvertsRates(t *testing.T) {
+	tests := []struct {
+		name     string
+		window   time.Duration
+		per      time.Duration
+		step     time.Duration
+		expected float64
+	}{
+		{name: "rate over the query window", window: 5 * time.Minute, per: time.Second, expected: 2},
+		{name: "rate over a range query step", window: 5 * time.Minute, per: time.Second, step: time.Minute, expected: 10},
+		{name: "increase over a raised window", window: 10 * time.Minute, per: 5 * time.Minute, expected: 300},
+		{name: "raw count", window: 5 * time.Minute, expected: 600},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			leaf := &leafNode{LeafQuery: LeafQuery{Window: tt.window}, Per: tt.per}
+			ev := &evaluator{results: map[*leafNode]Vector{
+				leaf: {{Metric: map[string]string{}, Value: 600}},
+			}}
+			if tt.step > 0 {
+				ev.windows = map[*leafNode]time.Duration{leaf: tt.step}
+			}
+
+			v, err := ev.eval(leaf)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expected := Vector{{Metric: map[string]string{}, Value: tt.expected}}
+			if !reflect.DeepEqual(v, expected) {
+				t.Errorf("expected %v, got %v", expected, v)
+			}
+		})
+	}
+}
+
+func TestEvaluatePlanSuccessRate(t *testing.T) {
+	const promQL = `sum(rate(http_requests_total{code!~"5.*",service="test"}[5m])) / sum(rate(http_requests_total{service="test"}[5m])) * 100`
+
+	tests := []struct {
+		name     string
+		total    float64
+		expected Vector
+	}{
+		{
+			name:     "real ratio",
+			total:    100,
+			expected: Vector{{Metric: map[string]string{}, Value: 60}},
+		},
+		{
+			name:     "no traffic",
+			total:    0,
+			expected: Vector{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockServer := mockSuccessRateServer(tt.total)
+			defer mockServer.Close()
+
+			adapter := &HoneycombAdapter{
+				honeycombAPIKey:  "test-key",
+				honeycombBaseURL: mockServer.URL,
+				queryTimeWindow:  3 * time.Minute,
+			}
+
+			plan, err := adapter.translatePromQL(promQL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := adapter.evaluatePlan(context.Background(), plan, time.Time{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			v, ok := result.(Vector)
+			if !ok {
+				t.Fatalf("expected vector result, got %T", result)
+			}
+			if len(v) != len(tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, v)
+			}
+			for i := range v {
+				if v[i].Value != tt.expected[i].Value {
+					t.Errorf("expected %v, got %v", tt.expected[i].Value, v[i].Value)
+				}
+			}
+		})
+	}
+}
+
+func TestEvalComparison(t *testing.T) {
+	series := Vector{
+		{Metric: map[string]string{"route": "/"}, Value: 1},
+		{Metric: map[string]string{"route": "/api"}, Value: 5},
+	}
+
+	tests := []struct {
+		name       string
+		op         string
+		returnBool bool
+		lhs        value
+		rhs        value
+		expected   value
+	}{
+		{
+			name:     "vector filtered by scalar",
+			op:       ">",
+			lhs:      series,
+			rhs:      scalarValue(2),
+			expected: Vector{{Metric: map[string]string{"route": "/api"}, Value: 5}},
+		},
+		{
+			name:       "vector compared to scalar with bool",
+			op:         ">",
+			returnBool: true,
+			lhs:        series,
+			rhs:        scalarValue(2),
+			expected: Vector{
+				{Metric: map[string]string{"route": "/"}, Value: 0},
+				{Metric: map[string]string{"route": "/api"}, Value: 1},
+			},
+		},
+		{
+			name:     "scalar filters keep the vector's values",
+			op:       "<",
+			lhs:      scalarValue(2),
+			rhs:      series,
+			expected: Vector{{Metric: map[string]string{"route": "/api"}, Value: 5}},
+		},
+		{
+			name:       "scalars with bool",
+			op:         "==",
+			returnBool: true,
+			lhs:        scalarValue(2),
+			rhs:        scalarValue(2),
+			expected:   scalarValue(1),
+		},
+		{
+			name: "vectors matched by labels",
+			op:   "!=",
+			lhs:  series,
+			rhs: Vector{
+				{Metric: map[string]string{"route": "/"}, Value: 1},
+				{Metric: map[string]string{"route": "/api"}, Value: 4},
+			},
+			expected: Vector{{Metric: map[string]string{"route": "/api"}, Value: 5}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := evalBinary(tt.op, tt.returnBool, tt.lhs, tt.rhs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestEvalScalarDivisionByZero(t *testing.T) {
+	tests := []struct {
+		op       string
+		lhs      float64
+		expected float64
+	}{
+		{op: "/", lhs: 1, expected: math.Inf(1)},
+		{op: "/", lhs: -1, expected: math.Inf(-1)},
+		{op: "/", lhs: 0, expected: math.NaN()},
+		{op: "%", lhs: 5, expected: math.NaN()},
+	}
+
+	for _, tt := range tests {
+		result, err := evalBinary(tt.op, false, scalarValue(tt.lhs), scalarValue(0))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		v, ok := result.(scalarValue)
+		if !ok {
+			t.Fatalf("%v %s 0: expected a scalar, got %T", tt.lhs, tt.op, result)
+		}
+		if float64(v) != tt.expected && !(math.IsNaN(float64(v)) && math.IsNaN(tt.expected)) {
+			t.Errorf("%v %s 0: expected %v, got %v", tt.lhs, tt.op, tt.expected, v)
+		}
+	}
+}
+
+func TestHandleQueryLocalEvaluation(t *testing.T) {
+	backend := &staticBackend{values: map[string]Vector{
+		"http_requests_total": {
+			{Metric: map[string]string{"route": "/"}, Value: 600},
+			{Metric: map[string]string{"route": "/api"}, Value: 60},
+		},
+	}}
+	adapter := &HoneycombAdapter{
+		queryTimeWindow: 3 * time.Minute,
+		backend:         backend,
+	}
+
+	tests := []struct {
+		promQL   string
+		expected []string
+	}{
+		{promQL: `vector(1)`, expected: []string{"1"}},
+		{promQL: `vector(scalar(max(sum by (route) (increase(http_requests_total{service="test"}[5m])))) / 60)`, expected: []string{"10"}},
+		{promQL: `sum by (route) (rate(http_requests_total{service="test"}[5m])) > 1`, expected: []string{"2"}},
+		{promQL: `sum by (route) (rate(http_requests_total{service="test"}[5m])) > bool 1`, expected: []string{"1", "0"}},
+		{promQL: `clamp_max(sum by (route) (increase(http_requests_total{service="test"}[5m])), 100)`, expected: []string{"100", "60"}},
+		{promQL: `round(sum by (route) (rate(http_requests_total{service="test"}[5m])), 0.5)`, expected: []string{"2", "0"}},
+		{promQL: `max(sum by (route) (increase(http_requests_total{service="test"}[5m])))`, expected: []string{"600"}},
+		{promQL: `count(sum by (route) (increase(http_requests_total{service="test"}[5m])))`, expected: []string{"2"}},
+		{promQL: `bottomk(1, sum by (route) (increase(http_requests_total{service="test"}[5m])))`, expected: []string{"60"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.promQL, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			adapter.handleQuery(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?query="+url.QueryEscape(tt.promQL), nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+
+			var result PrometheusResponse
+			if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, r := range result.Data.Result {
+				got = append(got, r.Value[1].(string))
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
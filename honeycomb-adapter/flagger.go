@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Roles of the workloads Flagger runs for one canary target.
+const (
+	roleCanary  = "canary"
+	rolePrimary = "primary"
+)
+
+// roleLabel is the PromQL label that selects a Flagger role explicitly, as
+// an alternative to the -canary and -primary name suffixes.
+const roleLabel = "role"
+
+// workloadLabel is the label whose Honeycomb column holds the Kubernetes
+// workload name, used to tell the canary from the primary.
+const workloadLabel = "deployment"
+
+// flaggerTarget is a service name as Flagger renders it into a query, split
+// into its parts. Flagger names the primary workload <target>-primary and
+// the services routing to each side <target>-canary and <target>-primary.
+type flaggerTarget struct {
+	Name      string
+	Namespace string
+	Role      string
+}
+
+// parseFlaggerTarget splits a service label value into the target name, the
+// namespace of a namespace-qualified name (namespace/name or
+// name.namespace.svc[.cluster.local]) and the role suffix.
+func parseFlaggerTarget(s string) flaggerTarget {
+	var target flaggerTarget
+	if i := strings.Index(s, "/"); i >= 0 {
+		target.Namespace, s = s[:i], s[i+1:]
+	} else if host := strings.TrimSuffix(strings.TrimSuffix(s, ".cluster.local"), ".svc"); host != s {
+		if i := strings.Index(host, "."); i >= 0 {
+			s, target.Namespace = host[:i], host[i+1:]
+		}
+	}
+
+	for _, role := range []string{roleCanary, rolePrimary} {
+		if name := strings.TrimSuffix(s, "-"+role); name != s && name != "" {
+			s, target.Role = name, role
+			break
+		}
+	}
+	target.Name = s
+	return target
+}
+
+// workload returns the name of the Kubernetes workload running the target's
+// role: the canary runs in the target deployment itself, the primary in its
+// -primary copy.
+func (t flaggerTarget) workload() string {
+	switch t.Role {
+	case roleCanary:
+		return t.Name
+	case rolePrimary:
+		return t.Name + "-" + rolePrimary
+	}
+	return ""
+}
+
+// templateVariableRE matches a Flagger template variable such as {{ target }}.
+var templateVariableRE = regexp.MustCompile(`\{\{.*?\}\}`)
+
+// TemplateError is returned for a query that still contains a Flagger
+// template variable, which means Flagger did not render the MetricTemplate.
+type TemplateError struct {
+	Pos      PositionRange
+	Query    string
+	Variable string
+}
+
+func (e *TemplateError) Error() string {
+	return fmt.Sprintf("%s: unrendered Flagger template variable %s; check the MetricTemplate query and the variables Flagger provides for it",
+		e.Pos.describe(e.Query), e.Variable)
+}
+
+// checkTemplates returns a TemplateError for the first template variable
+// left in a query.
+func checkTemplates(promQL string) error {
+	loc := templateVariableRE.FindStringIndex(promQL)
+	if loc == nil {
+		return nil
+	}
+	return &TemplateError{
+		Pos:      PositionRange{Start: loc[0], End: loc[1]},
+		Query:    promQL,
+		Variable: promQL[loc[0]:loc[1]],
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFlaggerTarget(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected flaggerTarget
+	}{
+		{value: "podinfo", expected: flaggerTarget{Name: "podinfo"}},
+		{value: "podinfo-canary", expected: flaggerTarget{Name: "podinfo", Role: roleCanary}},
+		{value: "podinfo-primary", expected: flaggerTarget{Name: "podinfo", Role: rolePrimary}},
+		{value: "test/podinfo-canary", expected: flaggerTarget{Name: "podinfo", Namespace: "test", Role: roleCanary}},
+		{value: "podinfo-primary.test.svc.cluster.local", expected: flaggerTarget{Name: "podinfo", Namespace: "test", Role: rolePrimary}},
+		{value: "podinfo.test.svc", expected: flaggerTarget{Name: "podinfo", Namespace: "test"}},
+		{value: "api.v2", expected: flaggerTarget{Name: "api.v2"}},
+		{value: "-canary", expected: flaggerTarget{Name: "-canary"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := parseFlaggerTarget(tt.value); got != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestTranslateFlaggerTargets(t *testing.T) {
+	adapter := &HoneycombAdapter{queryTimeWindow: 3 * time.Minute}
+
+	tests := []struct {
+		name          string
+		promQL        string
+		wantService   string
+		wantNamespace string
+		wantRole      string
+		wantFilters   []Filter
+		wantErr       string
+	}{
+		{
+			name:        "plain target",
+			promQL:      `http_requests_total{service="podinfo"}`,
+			wantService: "podinfo",
+		},
+		{
+			name:        "canary service",
+			promQL:      `http_requests_total{service="podinfo-canary"}`,
+			wantService: "podinfo",
+			wantRole:    roleCanary,
+			wantFilters: []Filter{{Column: "k8s.deployment.name", Op: "=", Value: "podinfo"}},
+		},
+		{
+			name:        "primary service",
+			promQL:      `http_requests_total{job="podinfo-primary"}`,
+			wantService: "podinfo",
+			wantRole:    rolePrimary,
+			wantFilters: []Filter{{Column: "k8s.deployment.name", Op: "=", Value: "podinfo-primary"}},
+		},
+		{
+			name:        "role label",
+			promQL:      `http_requests_total{service="podinfo", role="primary"}`,
+			wantService: "podinfo",
+			wantRole:    rolePrimary,
+			wantFilters: []Filter{{Column: "k8s.deployment.name", Op: "=", Value: "podinfo-primary"}},
+		},
+		{
+			name:          "namespace-qualified service",
+			promQL:        `http_requests_total{service="test/podinfo"}`,
+			wantService:   "podinfo",
+			wantNamespace: "test",
+			wantFilters:   []Filter{{Column: "k8s.namespace.name", Op: "=", Value: "test"}},
+		},
+		{
+			name:          "explicit namespace is not filtered twice",
+			promQL:        `http_requests_total{service="test/podinfo", namespace="test"}`,
+			wantService:   "podinfo",
+			wantNamespace: "test",
+			wantFilters:   []Filter{{Column: "k8s.namespace.name", Op: "=", Value: "test"}},
+		},
+		{
+			name:        "service and job agree",
+			promQL:      `http_requests_total{service="podinfo", job="podinfo-canary"}`,
+			wantService: "podinfo",
+			wantRole:    roleCanary,
+			wantFilters: []Filter{{Column: "k8s.deployment.name", Op: "=", Value: "podinfo"}},
+		},
+		{
+			name:    "conflicting service and job",
+			promQL:  `http_requests_total{job="checkout", service="podinfo"}`,
+			wantErr: `conflicts with the service "checkout"`,
+		},
+		{
+			name:    "conflicting namespaces",
+			promQL:  `http_requests_total{namespace="prod", service="test/podinfo"}`,
+			wantErr: `conflicts with the namespace "prod"`,
+		},
+		{
+			name:    "conflicting roles",
+			promQL:  `http_requests_total{service="podinfo-canary", role="primary"}`,
+			wantErr: `conflicts with the canary role`,
+		},
+		{
+			name:    "unknown role",
+			promQL:  `http_requests_total{service="podinfo", role="baseline"}`,
+			wantErr: `the role label only supports`,
+		},
+		{
+			name:    "role without service",
+			promQL:  `http_requests_total{role="canary"}`,
+			wantErr: `the role label requires a service`,
+		},
+		{
+			name:    "unrendered label template",
+			promQL:  `http_requests_total{service="{{ target }}"}`,
+			wantErr: `1:30: unrendered Flagger template variable {{ target }}`,
+		},
+		{
+			name:    "unrendered range template",
+			promQL:  `sum(rate(http_requests_total{service="podinfo"}[{{ interval }}]))`,
+			wantErr: `unrendered Flagger template variable {{ interval }}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := adapter.translatePromQL(tt.promQL)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			leaf := honeycombPlanLeaves(t, adapter, plan)[0]
+			if leaf.Service != tt.wantService || leaf.Namespace != tt.wantNamespace || leaf.Role != tt.wantRole {
+				t.Errorf("expected service=%q namespace=%q role=%q, got service=%q namespace=%q role=%q",
+					tt.wantService, tt.wantNamespace, tt.wantRole, leaf.Service, leaf.Namespace, leaf.Role)
+			}
+			if len(leaf.Query.Filters) != len(tt.wantFilters) {
+				t.Fatalf("expected filters %+v, got %+v", tt.wantFilters, leaf.Query.Filters)
+			}
+			for i, f := range tt.wantFilters {
+				if leaf.Query.Filters[i] != f {
+					t.Errorf("expected filter %+v, got %+v", f, leaf.Query.Filters[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFlaggerTargetIsFilterOnly(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/1/queries/podinfo":
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": "canary-query"})
+		case "/1/query_results/podinfo":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"complete": true,
+				"data": map[string]interface{}{
+					"results": []interface{}{map[string]interface{}{"data": map[string]interface{}{"COUNT": 42.0}}},
+				},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mockServer.Close()
+
+	adapter := &HoneycombAdapter{
+		honeycombAPIKey:  "test-key",
+		honeycombBaseURL: mockServer.URL,
+		queryTimeWindow:  3 * time.Minute,
+	}
+	plan, err := adapter.translatePromQL(`sum(increase(http_requests_total{service="test/podinfo-canary"}[5m]))`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The namespace and role select the events but are not result labels
+	vectors, err := adapter.queryBackend().Instant(context.Background(), plan.queries(), time.Time{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := (Vector{{Metric: map[string]string{}, Value: 42}}); !reflect.DeepEqual(vectors[0], want) {
+		t.Errorf("expected %v, got %v", want, vectors[0])
+	}
+}
+
+func TestHandleQueryUnrenderedTemplate(t *testing.T) {
+	adapter := &HoneycombAdapter{
+		queryTimeWindow: 3 * time.Minute,
+		backend:         &failingBackend{},
+	}
+	adapter.ensureTelemetry()
+
+	query := url.Values{"query": {`sum(rate(http_requests_total{service="{{ args.name }}"}[5m]))`}}
+	rec := httptest.NewRecorder()
+	adapter.handleQuery(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?"+query.Encode(), nil))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, `"errorType":"bad_data"`) || !strings.Contains(body, "{{ args.name }}") {
+		t.Errorf("expected a bad_data error naming the variable, got %s", body)
+	}
+}
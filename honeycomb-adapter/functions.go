@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// evalFunc evaluates a function the adapter applies to the results of its
+// arguments, following the PromQL definitions.
+func (ev *evaluator) evalFunc(n *funcNode) (value, error) {
+	args := make([]value, len(n.Args))
+	for i, arg := range n.Args {
+		v, err := ev.eval(arg)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+
+	switch n.Func {
+	case "vector":
+		s, err := scalarArg(n.Func, args[0])
+		if err != nil {
+			return nil, err
+		}
+		return Vector{{Metric: map[string]string{}, Value: s}}, nil
+
+	case "scalar":
+		v, err := vectorArg(n.Func, args[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(v) != 1 {
+			return scalarValue(math.NaN()), nil
+		}
+		return scalarValue(v[0].Value), nil
+
+	case "abs":
+		return mapVector(n.Func, args[0], math.Abs)
+
+	case "round":
+		toNearest := 1.0
+		if len(args) > 1 {
+			var err error
+			if toNearest, err = scalarArg(n.Func, args[1]); err != nil {
+				return nil, err
+			}
+		}
+		// Like Prometheus, multiply by the inverse, which has fewer floating
+		// point errors than dividing by toNearest
+		inverse := 1 / toNearest
+		return mapVector(n.Func, args[0], func(v float64) float64 {
+			return math.Floor(v*inverse+0.5) / inverse
+		})
+
+	case "clamp", "clamp_min", "clamp_max":
+		bounds := make([]float64, len(args)-1)
+		for i, arg := range args[1:] {
+			b, err := scalarArg(n.Func, arg)
+			if err != nil {
+				return nil, err
+			}
+			bounds[i] = b
+		}
+		switch n.Func {
+		case "clamp":
+			lo, hi := bounds[0], bounds[1]
+			if hi < lo {
+				return Vector{}, nil
+			}
+			return mapVector(n.Func, args[0], func(v float64) float64 { return math.Max(lo, math.Min(hi, v)) })
+		case "clamp_min":
+			return mapVector(n.Func, args[0], func(v float64) float64 { return math.Max(bounds[0], v) })
+		default:
+			return mapVector(n.Func, args[0], func(v float64) float64 { return math.Min(bounds[0], v) })
+		}
+	}
+	return nil, fmt.Errorf("function %q cannot be evaluated", n.Func)
+}
+
+// mapVector applies f to every sample of a vector argument.
+func mapVector(name string, arg value, f func(float64) float64) (value, error) {
+	v, err := vectorArg(name, arg)
+	if err != nil {
+		return nil, err
+	}
+	out := make(Vector, len(v))
+	for i, s := range v {
+		out[i] = Sample{Metric: s.Metric, Value: f(s.Value)}
+	}
+	return out, nil
+}
+
+func scalarArg(name string, arg value) (float64, error) {
+	s, ok := arg.(scalarValue)
+	if !ok {
+		return 0, fmt.Errorf("%s() expected a scalar argument, got %s", name, arg.valueType())
+	}
+	return float64(s), nil
+}
+
+func vectorArg(name string, arg value) (Vector, error) {
+	v, ok := arg.(Vector)
+	if !ok {
+		return nil, fmt.Errorf("%s() expected an instant vector argument, got %s", name, arg.valueType())
+	}
+	return v, nil
+}
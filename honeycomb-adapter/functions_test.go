@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestEvalFunc(t *testing.T) {
+	series := &leafNode{}
+	results := map[*leafNode]Vector{series: {
+		{Metric: map[string]string{"route": "/"}, Value: -1.26},
+		{Metric: map[string]string{"route": "/api"}, Value: 7.5},
+	}}
+
+	tests := []struct {
+		name     string
+		fn       string
+		args     []planNode
+		expected value
+	}{
+		{
+			name: "abs",
+			fn:   "abs",
+			args: []planNode{series},
+			expected: Vector{
+				{Metric: map[string]string{"route": "/"}, Value: 1.26},
+				{Metric: map[string]string{"route": "/api"}, Value: 7.5},
+			},
+		},
+		{
+			name: "round to integer",
+			fn:   "round",
+			args: []planNode{series},
+			expected: Vector{
+				{Metric: map[string]string{"route": "/"}, Value: -1},
+				{Metric: map[string]string{"route": "/api"}, Value: 8},
+			},
+		},
+		{
+			name: "round to nearest 0.1",
+			fn:   "round",
+			args: []planNode{series, &scalarNode{Value: 0.1}},
+			expected: Vector{
+				{Metric: map[string]string{"route": "/"}, Value: -1.3},
+				{Metric: map[string]string{"route": "/api"}, Value: 7.5},
+			},
+		},
+		{
+			name: "clamp",
+			fn:   "clamp",
+			args: []planNode{series, &scalarNode{Value: 0}, &scalarNode{Value: 5}},
+			expected: Vector{
+				{Metric: map[string]string{"route": "/"}, Value: 0},
+				{Metric: map[string]string{"route": "/api"}, Value: 5},
+			},
+		},
+		{
+			name:     "clamp with min above max",
+			fn:       "clamp",
+			args:     []planNode{series, &scalarNode{Value: 5}, &scalarNode{Value: 0}},
+			expected: Vector{},
+		},
+		{
+			name: "clamp_min",
+			fn:   "clamp_min",
+			args: []planNode{series, &scalarNode{Value: 0}},
+			expected: Vector{
+				{Metric: map[string]string{"route": "/"}, Value: 0},
+				{Metric: map[string]string{"route": "/api"}, Value: 7.5},
+			},
+		},
+		{
+			name:     "vector of an expression",
+			fn:       "vector",
+			args:     []planNode{&scalarNode{Value: 3}},
+			expected: Vector{{Metric: map[string]string{}, Value: 3}},
+		},
+		{
+			name:     "scalar of one series",
+			fn:       "scalar",
+			args:     []planNode{&vectorNode{Value: 4}},
+			expected: scalarValue(4),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev := &evaluator{results: results}
+			result, err := ev.eval(&funcNode{Func: tt.fn, Args: tt.args})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, result)
+			}
+		})
+	}
+
+	t.Run("scalar of several series", func(t *testing.T) {
+		result, err := (&evaluator{results: results}).eval(&funcNode{Func: "scalar", Args: []planNode{series}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if s, ok := result.(scalarValue); !ok || !math.IsNaN(float64(s)) {
+			t.Errorf("expected NaN, got %v", result)
+		}
+	})
+}
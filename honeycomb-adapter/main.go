@@ -4,27 +4,31 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/propagation"
 	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	sdkresource "go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"go.opentelemetry.io/otel/trace"
-	
 )
 
 type HoneycombAdapter struct {
@@ -33,33 +37,85 @@ type HoneycombAdapter struct {
 	honeycombBaseURL string
 	logLevel         string
 	queryTimeWindow  time.Duration
-	
+
+	// Query translation and execution; nil means the Honeycomb defaults
+	translator      Translator
+	backend         Backend
+	datasetResolver DatasetResolver
+
+	// Metric-to-Honeycomb mapping, replaced atomically on reload
+	mappings     atomic.Pointer[mappingConfig]
+	mappingsMu   sync.Mutex
+	mappingsData []byte
+
 	// OpenTelemetry instrumentation
-	tracer              trace.Tracer
-	meter               metric.Meter
-	queryCounter        metric.Int64Counter
-	queryDuration       metric.Float64Histogram
-	windowEnforcements  metric.Int64Counter
-	honeycombErrors     metric.Int64Counter
+	tracer             trace.Tracer
+	meter              metric.Meter
+	queryCounter       metric.Int64Counter
+	queryDuration      metric.Float64Histogram
+	windowEnforcements metric.Int64Counter
+	honeycombErrors    metric.Int64Counter
+	cacheHits          metric.Int64Counter
+	cacheMisses        metric.Int64Counter
+	honeycombRetries   metric.Int64Counter
+	breakerTransitions metric.Int64Counter
+	rateLimited        metric.Int64Counter
+	telemetryOnce      sync.Once
+
+	// Honeycomb query result cache; nil disables caching
+	queryCache *queryCache
+	// Query IDs by definition; nil creates a new query for every request
+	queryIDs *queryIDStore
+	// Query result polling schedule; zero fields use the defaults
+	poll pollConfig
+	// Retries of failed Honeycomb calls; zero fields use the defaults
+	retry retryConfig
+	// Circuit breaker around Honeycomb; nil disables it
+	breaker *circuitBreaker
+	// Budget for Honeycomb API calls; nil disables it
+	rateLimiter *rateLimiter
+	// Honeycomb dataset and column listings; nil disables caching
+	metadataCache *metadataCache
+	// Requests being handled, and whether shutdown has begun
+	inFlight atomic.Int64
+	draining atomic.Bool
 }
 
 type PrometheusResponse struct {
-	Status string `json:"status"`
-	Data   struct {
-		ResultType string `json:"resultType"`
-		Result     []struct {
-			Metric map[string]string `json:"metric"`
-			Value  []interface{}     `json:"value"`
-		} `json:"result"`
-	} `json:"data"`
+	Status string         `json:"status"`
+	Data   PrometheusData `json:"data"`
+	// Warnings describe where the adapter approximated the query.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// PrometheusErrorResponse is the body of a failed Prometheus API request.
+type PrometheusErrorResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+}
+
+type PrometheusData struct {
+	ResultType string             `json:"resultType"`
+	Result     []PrometheusResult `json:"result"`
+}
+
+type PrometheusResult struct {
+	Metric map[string]string `json:"metric"`
+	Value  []interface{}     `json:"value,omitempty"`
+	Values [][]interface{}   `json:"values,omitempty"`
 }
 
 type HoneycombQuery struct {
-	TimeRange    int           `json:"time_range"`  // Changed to int (seconds)
-	Granularity  int          `json:"granularity,omitempty"`
+	TimeRange    int           `json:"time_range,omitempty"` // Changed to int (seconds)
+	StartTime    int64         `json:"start_time,omitempty"`
+	EndTime      int64         `json:"end_time,omitempty"`
+	Granularity  int           `json:"granularity,omitempty"`
 	Calculations []Calculation `json:"calculations"`
-	Filters      []Filter     `json:"filters,omitempty"`
-	Orders       []Order      `json:"orders,omitempty"`
+	Breakdowns   []string      `json:"breakdowns,omitempty"`
+	Filters      []Filter      `json:"filters,omitempty"`
+	Orders       []Order       `json:"orders,omitempty"`
+	Limit        int           `json:"limit,omitempty"`
 }
 
 type Calculation struct {
@@ -70,7 +126,7 @@ type Calculation struct {
 type Filter struct {
 	Column string      `json:"column"`
 	Op     string      `json:"op"`
-	Value  interface{} `json:"value"`
+	Value  interface{} `json:"value,omitempty"`
 }
 
 type Order struct {
@@ -78,6 +134,63 @@ type Order struct {
 	Order string `json:"order"`
 }
 
+// Alias returns the key Honeycomb uses for the calculation in result data,
+// e.g. "COUNT" or "P95(duration_ms)".
+func (c Calculation) Alias() string {
+	if c.Column == "" {
+		return c.Op
+	}
+	return c.Op + "(" + c.Column + ")"
+}
+
+// HoneycombQueryResult is the response of the Honeycomb Query Results API.
+type HoneycombQueryResult struct {
+	ID       string               `json:"id"`
+	Complete bool                 `json:"complete"`
+	Data     HoneycombResultData  `json:"data"`
+	Links    HoneycombResultLinks `json:"links"`
+}
+
+// HoneycombResultData holds the aggregated results (one row per breakdown
+// group) and, unless disabled, the time series buckets of a query.
+type HoneycombResultData struct {
+	Results []HoneycombResultRow    `json:"results"`
+	Series  []HoneycombSeriesBucket `json:"series"`
+}
+
+// HoneycombResultRow maps breakdown columns and calculation aliases to values.
+type HoneycombResultRow struct {
+	Data map[string]interface{} `json:"data"`
+}
+
+// HoneycombSeriesBucket is a single time bucket of a query's time series.
+type HoneycombSeriesBucket struct {
+	Time time.Time              `json:"time"`
+	Data map[string]interface{} `json:"data"`
+}
+
+type HoneycombResultLinks struct {
+	QueryURL      string `json:"query_url"`
+	GraphImageURL string `json:"graph_image_url"`
+}
+
+// HoneycombAPIError is returned when the Honeycomb API responds with an
+// unexpected status code.
+type HoneycombAPIError struct {
+	StatusCode int
+	// Resource optionally names what was being fetched, e.g. "location".
+	Resource string
+	// RetryAfter is the wait requested by a Retry-After header, if any.
+	RetryAfter time.Duration
+}
+
+func (e *HoneycombAPIError) Error() string {
+	if e.Resource != "" {
+		return fmt.Sprintf("honeycomb API returned status %d for %s", e.StatusCode, e.Resource)
+	}
+	return fmt.Sprintf("honeycomb API returned status %d", e.StatusCode)
+}
+
 type TimeRange struct {
 	StartTime int64 `json:"start_time"`
 	EndTime   int64 `json:"end_time"`
@@ -126,7 +239,7 @@ func initTelemetry(ctx context.Context, serviceName, honeycombAPIKey string) (fu
 
 	// Return cleanup function
 	return func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), telemetryFlushTimeout)
 		defer cancel()
 		if err := traceProvider.Shutdown(ctx); err != nil {
 			log.Printf("Error shutting down tracer provider: %v", err)
@@ -140,7 +253,7 @@ func initTelemetry(ctx context.Context, serviceName, honeycombAPIKey string) (fu
 // initializeMetrics initializes custom metrics for the adapter
 func (h *HoneycombAdapter) initializeMetrics() error {
 	var err error
-	
+
 	h.queryCounter, err = h.meter.Int64Counter(
 		"honeycomb_adapter_queries_total",
 		metric.WithDescription("Total number of queries processed by the adapter"),
@@ -173,12 +286,72 @@ func (h *HoneycombAdapter) initializeMetrics() error {
 		return fmt.Errorf("failed to create honeycomb errors counter: %w", err)
 	}
 
+	h.cacheHits, err = h.meter.Int64Counter(
+		"honeycomb_adapter_cache_hits_total",
+		metric.WithDescription("Total number of Honeycomb queries answered from the cache or a concurrent identical query"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create cache hits counter: %w", err)
+	}
+
+	h.cacheMisses, err = h.meter.Int64Counter(
+		"honeycomb_adapter_cache_misses_total",
+		metric.WithDescription("Total number of Honeycomb queries sent to Honeycomb"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create cache misses counter: %w", err)
+	}
+
+	h.honeycombRetries, err = h.meter.Int64Counter(
+		"honeycomb_adapter_honeycomb_retries_total",
+		metric.WithDescription("Total number of retried Honeycomb API calls"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create honeycomb retries counter: %w", err)
+	}
+
+	h.breakerTransitions, err = h.meter.Int64Counter(
+		"honeycomb_adapter_circuit_breaker_transitions_total",
+		metric.WithDescription("Total number of Honeycomb circuit breaker state transitions"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create circuit breaker transitions counter: %w", err)
+	}
+
+	h.rateLimited, err = h.meter.Int64Counter(
+		"honeycomb_adapter_rate_limited_total",
+		metric.WithDescription("Total number of Honeycomb API calls refused by the client-side rate limit"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create rate limited counter: %w", err)
+	}
+
 	return nil
 }
 
+// ensureTelemetry falls back to the global (no-op by default) tracer and meter
+// for adapters that were not set up by main, such as those built in tests.
+func (h *HoneycombAdapter) ensureTelemetry() {
+	h.telemetryOnce.Do(func() {
+		if h.tracer == nil {
+			h.tracer = otel.Tracer("honeycomb-adapter")
+		}
+		if h.meter == nil {
+			h.meter = otel.Meter("honeycomb-adapter")
+		}
+		if h.queryCounter == nil {
+			if err := h.initializeMetrics(); err != nil {
+				log.Printf("❌ Failed to initialize metrics: %v", err)
+			}
+		}
+	})
+}
+
 func main() {
-	ctx := context.Background()
-	
+	// SIGTERM starts a graceful shutdown, as does Ctrl-C when run locally
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
 	// Parse query time window from environment variable, default to 3 minutes
 	queryTimeWindowStr := getEnv("QUERY_TIME_WINDOW", "3m")
 	queryTimeWindow, err := time.ParseDuration(queryTimeWindowStr)
@@ -192,7 +365,7 @@ func main() {
 		log.Fatal("HONEYCOMB_API_KEY environment variable is required")
 	}
 
-	// Initialize OpenTelemetry
+	// Initialize OpenTelemetry; cleanup flushes pending spans and metrics
 	cleanup, err := initTelemetry(ctx, "honeycomb-adapter", honeycombAPIKey)
 	if err != nil {
 		log.Fatalf("Failed to initialize telemetry: %v", err)
@@ -209,6 +382,8 @@ func main() {
 		honeycombBaseURL: getEnv("HONEYCOMB_BASE_URL", "https://api.honeycomb.io"),
 		logLevel:         getEnv("LOG_LEVEL", "info"),
 		queryTimeWindow:  queryTimeWindow,
+		poll:             loadPollConfig(),
+		retry:            loadRetryConfig(),
 		tracer:           tracer,
 		meter:            meter,
 	}
@@ -221,46 +396,166 @@ func main() {
 	log.Printf("🔑 API Key: %s", adapter.honeycombAPIKey[:8]+"...") // Show first 8 chars
 	log.Printf("🔧 Log Level: %s", adapter.logLevel)
 	log.Printf("⏱️  Query Time Window: %s", adapter.queryTimeWindow)
+	log.Printf("⏳ Result Polling: %d attempts, %s initial delay x%v (max %s), %s deadline",
+		adapter.poll.MaxAttempts, adapter.poll.InitialDelay, adapter.poll.BackoffFactor, adapter.poll.MaxDelay, adapter.poll.Deadline)
 	log.Printf("📊 OpenTelemetry: Initialized with traces and metrics")
 
+	// Choose how queries map onto Honeycomb datasets
+	datasetStrategy := getEnv("HONEYCOMB_DATASET_STRATEGY", defaultDatasetStrategy(adapter.honeycombDataset))
+	adapter.datasetResolver, err = adapter.newDatasetResolver(datasetStrategy, adapter.honeycombDataset)
+	if err != nil {
+		log.Fatalf("Invalid dataset configuration: %v", err)
+	}
+	if datasetStrategy == datasetStrategyFixed {
+		log.Printf("🗂️  Dataset Strategy: %s (%s)", datasetStrategy, adapter.honeycombDataset)
+	} else {
+		log.Printf("🗂️  Dataset Strategy: %s", datasetStrategy)
+	}
+
+	// Fail fast while Honeycomb is unavailable
+	adapter.breaker = adapter.loadCircuitBreaker()
+	if adapter.breaker != nil {
+		log.Printf("🔌 Circuit Breaker: opens after %d consecutive failures for %s", adapter.breaker.threshold, adapter.breaker.cooldown)
+	} else {
+		log.Printf("🔌 Circuit Breaker: disabled")
+	}
+
+	// Stay within the team's Honeycomb query quota
+	rateLimit := loadRateLimitConfig()
+	adapter.rateLimiter = newRateLimiter(rateLimit)
+	if adapter.rateLimiter != nil {
+		mode := "queue up to " + rateLimit.MaxWait.String()
+		if !rateLimit.Queue {
+			mode = "reject"
+		}
+		log.Printf("🚦 Rate Limit: %d Honeycomb calls per hour, burst %d, %s", rateLimit.PerHour, rateLimit.Burst, mode)
+	} else {
+		log.Printf("🚦 Rate Limit: disabled")
+	}
+
+	// Cache Honeycomb results so canaries polling the same metric share queries
+	cacheTTLStr := getEnv("QUERY_CACHE_TTL", "30s")
+	cacheTTL, err := time.ParseDuration(cacheTTLStr)
+	if err != nil || cacheTTL < 0 {
+		log.Printf("❌ Invalid QUERY_CACHE_TTL value '%s', using default 30s: %v", cacheTTLStr, err)
+		cacheTTL = 30 * time.Second
+	}
+	if cacheTTL > 0 {
+		adapter.queryCache = newQueryCache(cacheTTL)
+		log.Printf("♻️  Query Cache TTL: %s", cacheTTL)
+	} else {
+		log.Printf("♻️  Query Cache: disabled")
+	}
+
+	// Cache dataset and column listings for the metadata endpoints
+	metadataTTLStr := getEnv("METADATA_CACHE_TTL", "5m")
+	metadataTTL, err := time.ParseDuration(metadataTTLStr)
+	if err != nil || metadataTTL < 0 {
+		log.Printf("❌ Invalid METADATA_CACHE_TTL value '%s', using default 5m: %v", metadataTTLStr, err)
+		metadataTTL = 5 * time.Minute
+	}
+	if metadataTTL > 0 {
+		adapter.metadataCache = newMetadataCache(metadataTTL)
+		log.Printf("♻️  Metadata Cache TTL: %s", metadataTTL)
+	} else {
+		log.Printf("♻️  Metadata Cache: disabled")
+	}
+
+	// Reuse Honeycomb query definitions instead of creating one per request
+	adapter.queryIDs = newQueryIDStore(getEnv("QUERY_ID_CACHE_FILE", ""))
+	if adapter.queryIDs.path != "" {
+		go adapter.queryIDs.persist(ctx, queryIDFlushInterval)
+		log.Printf("🆔 Query IDs: persisted to %s every %s (%d known)", adapter.queryIDs.path, queryIDFlushInterval, adapter.queryIDs.len())
+	}
+
+	// Load metric mappings; the file is polled so ConfigMap updates apply without a restart
+	if mappingFile := getEnv("METRIC_MAPPING_FILE", ""); mappingFile != "" {
+		if _, err := adapter.loadMetricMappings(mappingFile); err != nil {
+			log.Fatalf("Failed to load metric mappings: %v", err)
+		}
+		reloadIntervalStr := getEnv("METRIC_MAPPING_RELOAD_INTERVAL", "30s")
+		reloadInterval, err := time.ParseDuration(reloadIntervalStr)
+		if err != nil || reloadInterval <= 0 {
+			log.Printf("❌ Invalid METRIC_MAPPING_RELOAD_INTERVAL value '%s', using default 30s: %v", reloadIntervalStr, err)
+			reloadInterval = 30 * time.Second
+		}
+		go adapter.watchMetricMappings(ctx, mappingFile, reloadInterval)
+		log.Printf("🗺️  Metric Mappings: %s (%d metrics, reload every %s)", mappingFile, len(adapter.metricConfig().Metrics), reloadInterval)
+	} else {
+		log.Printf("🗺️  Metric Mappings: built-in defaults")
+	}
+
 	// Set up HTTP handlers with OpenTelemetry instrumentation
 	http.Handle("/api/v1/query", otelhttp.NewHandler(http.HandlerFunc(adapter.handleQuery), "query"))
 	http.Handle("/api/v1/query_range", otelhttp.NewHandler(http.HandlerFunc(adapter.handleQueryRange), "query_range"))
+	http.Handle("/api/v1/labels", otelhttp.NewHandler(http.HandlerFunc(adapter.handleLabels), "labels"))
+	http.Handle("/api/v1/label/", otelhttp.NewHandler(http.HandlerFunc(adapter.handleLabelValues), "label_values"))
+	http.Handle("/api/v1/series", otelhttp.NewHandler(http.HandlerFunc(adapter.handleSeries), "series"))
+	http.Handle("/api/v1/metadata", otelhttp.NewHandler(http.HandlerFunc(adapter.handleMetadata), "metadata"))
+	http.Handle("/api/v1/status/buildinfo", otelhttp.NewHandler(http.HandlerFunc(adapter.handleBuildInfo), "buildinfo"))
 	http.HandleFunc("/-/healthy", adapter.handleHealth)
 	http.HandleFunc("/-/ready", adapter.handleReady)
 
 	port := getEnv("PORT", "9090")
+	serverCfg := loadServerConfig()
+	server := adapter.newServer(":"+port, http.DefaultServeMux, serverCfg)
 	log.Printf("🚀 Starting Honeycomb-Prometheus adapter on port %s", port)
 	log.Printf("🌐 Base URL: %s", adapter.honeycombBaseURL)
 	log.Printf("📋 Endpoints:")
-	log.Printf("  - GET /api/v1/query - Query endpoint")
+	log.Printf("  - GET|POST /api/v1/query - Query endpoint")
+	log.Printf("  - GET|POST /api/v1/query_range - Range query endpoint")
+	log.Printf("  - GET|POST /api/v1/labels, /api/v1/label/<name>/values, /api/v1/series, /api/v1/metadata - Metadata endpoints")
+	log.Printf("  - GET /api/v1/status/buildinfo - Build information")
 	log.Printf("  - GET /-/healthy - Health check")
 	log.Printf("  - GET /-/ready - Readiness check")
+	log.Printf("⏱️  Server Timeouts: read header %s, read %s, write %s, idle %s", serverCfg.ReadHeaderTimeout, serverCfg.ReadTimeout, serverCfg.WriteTimeout, serverCfg.IdleTimeout)
+	log.Printf("🛑 Shutdown: readiness fails %s before a %s grace period", serverCfg.DrainDelay, serverCfg.GracePeriod)
 	log.Printf("✅ Adapter ready to receive requests!")
-	
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Printf("❌ Failed to listen on %s: %v", server.Addr, err)
+		cleanup()
+		os.Exit(1)
+	}
+	err = adapter.serve(ctx, server, listener, serverCfg)
+	// Keep the query IDs created since the last periodic flush
+	adapter.queryIDs.flush()
+	if err != nil {
+		log.Printf("❌ Server error: %v", err)
+		cleanup()
+		os.Exit(1)
+	}
+	log.Printf("👋 Adapter stopped, flushing telemetry")
 }
 
 func (h *HoneycombAdapter) handleQuery(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
 	ctx := r.Context()
-	
+	h.ensureTelemetry()
+
 	// Start a new trace span
 	ctx, span := h.tracer.Start(ctx, "handleQuery")
 	defer span.End()
-	
-	query := r.URL.Query().Get("query")
-	timeParam := r.URL.Query().Get("time")
-	
+
+	params, err := requestParams(r)
+	if err != nil {
+		writePrometheusError(w, errorBadData, err)
+		return
+	}
+	query := params.Get("query")
+	timeParam := params.Get("time")
+
 	// Add query information to span
 	span.SetAttributes(
 		attribute.String("query.promql", query),
 		attribute.String("query.time", timeParam),
+		attribute.String("query.timeout", params.Get("timeout")),
 	)
 
 	log.Printf("🔍 Received PromQL query: %s", query)
 	h.logDebug("Received query: %s", query)
-	
+
 	// Increment query counter
 	h.queryCounter.Add(ctx, 1, metric.WithAttributes(
 		attribute.String("query_type", "promql"),
@@ -276,19 +571,31 @@ func (h *HoneycombAdapter) handleQuery(w http.ResponseWriter, r *http.Request) {
 
 	if query == "" {
 		span.SetAttributes(attribute.String("error", "missing query parameter"))
-		http.Error(w, "query parameter is required", http.StatusBadRequest)
+		writePrometheusError(w, errorBadData, errors.New("query parameter is required"))
 		return
 	}
 
-	// Handle vector queries directly (used by Flagger for validation)
-	if strings.Contains(query, "vector(") {
-		span.SetAttributes(attribute.String("query.type", "vector"))
-		h.handleVectorQuery(w, r, query, timeParam)
+	// Evaluate at the requested time, or now
+	var evalTime time.Time
+	if timeParam != "" {
+		if evalTime, err = parseTimeParam(timeParam); err != nil {
+			span.SetAttributes(attribute.String("error", "invalid_time"))
+			writePrometheusError(w, errorBadData, fmt.Errorf("invalid parameter \"time\": %v", err))
+			return
+		}
+	}
+
+	// Bound the Honeycomb queries by the client's timeout
+	ctx, cancel, err := withTimeoutParam(ctx, params.Get("timeout"))
+	if err != nil {
+		span.SetAttributes(attribute.String("error", "invalid_timeout"))
+		writePrometheusError(w, errorBadData, err)
 		return
 	}
+	defer cancel()
 
-	// Parse the PromQL query and convert to Honeycomb query
-	honeycombQuery, err := h.translatePromQLToHoneycomb(query)
+	// Parse the PromQL query and convert to a plan of backend queries
+	plan, err := h.queryTranslator().Translate(query)
 	if err != nil {
 		log.Printf("❌ Query translation error: %v", err)
 		h.logError("Query translation error: %v", err)
@@ -296,21 +603,24 @@ func (h *HoneycombAdapter) handleQuery(w http.ResponseWriter, r *http.Request) {
 			attribute.String("error", "translation_failed"),
 			attribute.String("error.message", err.Error()),
 		)
-		http.Error(w, fmt.Sprintf("Query translation error: %v", err), http.StatusBadRequest)
+		writePrometheusError(w, errorBadData, err)
 		return
 	}
 
-	log.Printf("🔄 Translated to Honeycomb query: %+v", honeycombQuery)
-	h.logDebug("Translated to Honeycomb query: %+v", honeycombQuery)
+	leaves := plan.leaves()
+	for _, leaf := range leaves {
+		log.Printf("🔄 Translated %s to leaf query %s over %s", leaf.Expr, &leaf.LeafQuery, leaf.Window)
+		h.logDebug("Translated %s to leaf query %s over %s", leaf.Expr, &leaf.LeafQuery, leaf.Window)
+	}
 
-	// Execute Honeycomb query
+	// Execute Honeycomb queries and evaluate the expression on their results
 	serviceName := h.extractServiceName(query)
 	span.SetAttributes(
 		attribute.String("query.service", serviceName),
-		attribute.Int("query.time_range", honeycombQuery.TimeRange),
+		attribute.Int("query.honeycomb_queries", len(leaves)),
 	)
-	
-	result, err := h.executeHoneycombQuery(ctx, honeycombQuery, serviceName)
+
+	result, err := h.evaluatePlan(ctx, plan, evalTime)
 	if err != nil {
 		log.Printf("❌ Honeycomb query error: %v", err)
 		h.logError("Honeycomb query error: %v", err)
@@ -321,83 +631,22 @@ func (h *HoneycombAdapter) handleQuery(w http.ResponseWriter, r *http.Request) {
 		h.honeycombErrors.Add(ctx, 1, metric.WithAttributes(
 			attribute.String("service", serviceName),
 		))
-		http.Error(w, fmt.Sprintf("Honeycomb query error: %v", err), http.StatusInternalServerError)
+		writePrometheusError(w, classifyError(err), err)
 		return
 	}
 
-	log.Printf("✅ Honeycomb result: %+v", result)
-	h.logDebug("Honeycomb result: %+v", result)
+	log.Printf("✅ Evaluated result: %+v", result)
+	h.logDebug("Evaluated result: %+v", result)
 
-	// Convert Honeycomb result to Prometheus format
-	promResponse := h.convertToPrometheusFormat(result, timeParam)
-	log.Printf("📊 Returning Prometheus response: %+v", promResponse)
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(promResponse); err != nil {
-		log.Printf("❌ Response encoding error: %v", err)
-		h.logError("Response encoding error: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-	}
-}
-
-func (h *HoneycombAdapter) handleVectorQuery(w http.ResponseWriter, r *http.Request, query, timeParam string) {
-	log.Printf("🧮 Handling vector query: %s", query)
-	
-	// Extract the value from vector(value)
-	re := regexp.MustCompile(`vector\(([^)]+)\)`)
-	matches := re.FindStringSubmatch(query)
-	
-	var value float64 = 1.0 // Default value
-	if len(matches) > 1 {
-		if parsedValue, err := strconv.ParseFloat(matches[1], 64); err == nil {
-			value = parsedValue
-		}
+	// Convert the evaluated result to Prometheus format
+	if evalTime.IsZero() {
+		evalTime = time.Now()
 	}
-	
-	log.Printf("📊 Returning vector value: %f", value)
-	
-	// Convert to Unix timestamp
-	timestamp := time.Now().Unix()
-	if timeParam != "" {
-		if t, err := time.Parse(time.RFC3339, timeParam); err == nil {
-			timestamp = t.Unix()
-		}
-	}
-	
-	// Return Prometheus response with the vector value
-	promResponse := &PrometheusResponse{
-		Status: "success",
-		Data: struct {
-			ResultType string `json:"resultType"`
-			Result     []struct {
-				Metric map[string]string `json:"metric"`
-				Value  []interface{}     `json:"value"`
-			} `json:"result"`
-		}{
-			ResultType: "vector",
-			Result: []struct {
-				Metric map[string]string `json:"metric"`
-				Value  []interface{}     `json:"value"`
-			}{
-				{
-					Metric: map[string]string{},
-					Value:  []interface{}{timestamp, fmt.Sprintf("%.2f", value)},
-				},
-			},
-		},
-	}
-	
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(promResponse); err != nil {
-		log.Printf("❌ Vector response encoding error: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-	}
-}
+	promResponse := h.buildPrometheusResponse(result, evalTime)
+	promResponse.Warnings = plan.Warnings
+	log.Printf("📊 Returning Prometheus response: %+v", promResponse)
 
-func (h *HoneycombAdapter) handleQueryRange(w http.ResponseWriter, r *http.Request) {
-	// For simplicity, delegate to handleQuery for now
-	// In production, you might want to implement proper range queries
-	h.handleQuery(w, r)
+	writePrometheusResponse(w, promResponse)
 }
 
 func (h *HoneycombAdapter) handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -406,116 +655,45 @@ func (h *HoneycombAdapter) handleHealth(w http.ResponseWriter, r *http.Request)
 }
 
 func (h *HoneycombAdapter) handleReady(w http.ResponseWriter, r *http.Request) {
+	// Take the pod out of the Service endpoints while it drains
+	if h.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Draining"))
+		return
+	}
+
 	// Simple readiness check - just verify we can reach Honeycomb API
 	// Don't depend on any specific dataset existing since datasets are created dynamically
-	w.WriteHeader(http.StatusOK)  
+	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Ready"))
 }
 
-func (h *HoneycombAdapter) translatePromQLToHoneycomb(promQL string) (*HoneycombQuery, error) {
-	timeWindow := h.extractTimeWindow(promQL)
-
-	baseQuery := &HoneycombQuery{
-		TimeRange: int(timeWindow.Seconds()), // Convert to seconds
-		Filters: []Filter{},
-		Orders: []Order{{Op: "COUNT", Order: "descending"}},
-	}
-
-	// No need to add service filter - dataset name already identifies the service
-	// The service name is used as the dataset in the URL: /1/queries/{serviceName}
-
-	// Error rate query pattern
-	if strings.Contains(promQL, "http_requests_total") && strings.Contains(promQL, "code!~\"5.*\"") {
-		// Calculate success rate: (non-5xx requests / total requests) * 100
-		baseQuery.Calculations = []Calculation{
-			{Op: "COUNT"},
-		}
-		baseQuery.Filters = append(baseQuery.Filters, Filter{
-			Column: "http.status_code",
-			Op:     "<",
-			Value:  500,
-		})
-		return baseQuery, nil
-	}
-
-	// Latency query pattern - query actual trace spans with duration_ms
-	if strings.Contains(promQL, "histogram_quantile") || strings.Contains(promQL, "duration") {
-		// Query individual trace spans for P95 duration
-		baseQuery.Calculations = []Calculation{
-			{Op: "P95", Column: "duration_ms"},  // Field exists in your data
-		}
-		// Remove the problematic order - P95 doesn't need COUNT ordering
-		baseQuery.Orders = []Order{}
-		return baseQuery, nil
-	}
-
-	// Request rate query pattern
-	if strings.Contains(promQL, "rate") && strings.Contains(promQL, "http_requests_total") {
-		baseQuery.Calculations = []Calculation{
-			{Op: "COUNT"},
-		}
-		return baseQuery, nil
-	}
+// extractServiceName returns the Flagger target a query is about: the value
+// of its service (or job) label without namespace qualification or role
+// suffix. Queries that still contain template variables have no service;
+// translating them fails with a TemplateError.
+func (h *HoneycombAdapter) extractServiceName(promQL string) string {
+	log.Printf("🔍 Extracting service name from PromQL: %s", promQL)
 
-	// Throughput/count query
-	if strings.Contains(promQL, "http_requests_total") {
-		baseQuery.Calculations = []Calculation{
-			{Op: "COUNT"},
-		}
-		return baseQuery, nil
-	}
-
-	// Vector query - used by Flagger for metric provider validation
-	if strings.Contains(promQL, "vector(") {
-		// Extract the value from vector(value)
-		re := regexp.MustCompile(`vector\(([^)]+)\)`)
-		if matches := re.FindStringSubmatch(promQL); len(matches) > 1 {
-			log.Printf("📊 Vector query detected with value: %s", matches[1])
-			// Return a simple count query that will return the vector value
-			baseQuery.Calculations = []Calculation{
-				{Op: "COUNT"},
-			}
-			return baseQuery, nil
-		}
+	if err := checkTemplates(promQL); err != nil {
+		log.Printf("⚠️  %v", err)
+		return ""
 	}
 
-	return nil, fmt.Errorf("unsupported query pattern: %s", promQL)
-}
-
-func (h *HoneycombAdapter) extractServiceName(promQL string) string {
-	log.Printf("🔍 Extracting service name from PromQL: %s", promQL)
-	
 	// Pattern 1: service="my-app"
 	re1 := regexp.MustCompile(`service="([^"]+)"`)
 	if matches := re1.FindStringSubmatch(promQL); len(matches) > 1 {
-		serviceName := matches[1]
-		log.Printf("📍 Found service name (pattern 1): %s", serviceName)
-		// Handle Flagger template variables
-		if strings.Contains(serviceName, "{{ args.name }}") {
-			// Extract the actual service name from the template
-			// This assumes the template has been processed by Flagger
-			serviceName = strings.ReplaceAll(serviceName, "{{ args.name }}", "")
-			serviceName = strings.Trim(serviceName, " -")
-			log.Printf("📍 Processed template service name: %s", serviceName)
-		}
-		return serviceName
+		target := parseFlaggerTarget(matches[1])
+		log.Printf("📍 Found service name (pattern 1): %s (namespace %q, role %q)", target.Name, target.Namespace, target.Role)
+		return target.Name
 	}
 
 	// Pattern 2: job="my-app"
 	re2 := regexp.MustCompile(`job="([^"]+)"`)
 	if matches := re2.FindStringSubmatch(promQL); len(matches) > 1 {
-		log.Printf("📍 Found service name (pattern 2): %s", matches[1])
-		return matches[1]
-	}
-
-	// Pattern 3: Flagger template variables
-	re3 := regexp.MustCompile(`\{\{\s*(target|name)\s*\}\}`)
-	if matches := re3.FindStringSubmatch(promQL); len(matches) > 1 {
-		templateVar := matches[1]
-		log.Printf("📍 Found Flagger template variable: {{ %s }}", templateVar)
-		// Template should be resolved by Flagger before reaching the adapter
-		// If we see unresolved templates, it means Flagger hasn't processed them yet
-		return ""
+		target := parseFlaggerTarget(matches[1])
+		log.Printf("📍 Found service name (pattern 2): %s (namespace %q, role %q)", target.Name, target.Namespace, target.Role)
+		return target.Name
 	}
 
 	log.Printf("⚠️  No service name found in query: %s", promQL)
@@ -523,78 +701,110 @@ func (h *HoneycombAdapter) extractServiceName(promQL string) string {
 	return ""
 }
 
-func (h *HoneycombAdapter) extractTimeWindow(promQL string) time.Duration {
-	// Extract time window from rate() function: rate(metric[5m])
-	re := regexp.MustCompile(`\[(\d+)([smhd])\]`)
-	matches := re.FindStringSubmatch(promQL)
-	
-	minWindow := h.queryTimeWindow // Use configurable query time window
-	
-	if len(matches) >= 3 {
-		value, err := strconv.Atoi(matches[1])
-		if err != nil {
-			return minWindow
-		}
-		
-		var requestedWindow time.Duration
-		unit := matches[2]
-		switch unit {
-		case "s":
-			requestedWindow = time.Duration(value) * time.Second
-		case "m":
-			requestedWindow = time.Duration(value) * time.Minute
-		case "h":
-			requestedWindow = time.Duration(value) * time.Hour
-		case "d":
-			requestedWindow = time.Duration(value) * 24 * time.Hour
-		default:
-			return minWindow
-		}
-		
-		// Use adaptive windowing: fast for Flagger, safe for Honeycomb
-		if requestedWindow < minWindow {
-			log.Printf("📊 Requested window %v optimized to %v (configured minimum)", requestedWindow, minWindow)
-			// Track window enforcement
-			h.windowEnforcements.Add(context.Background(), 1, metric.WithAttributes(
-				attribute.String("requested_window", requestedWindow.String()),
-				attribute.String("enforced_window", minWindow.String()),
-			))
-			return minWindow
-		}
-		
-		return requestedWindow
-	}
-	
-	return minWindow
-}
-
-func (h *HoneycombAdapter) executeHoneycombQuery(ctx context.Context, query *HoneycombQuery, serviceName string) (map[string]interface{}, error) {
+func (h *HoneycombAdapter) executeHoneycombQuery(ctx context.Context, query *HoneycombQuery, dataset string) (*HoneycombQueryResult, error) {
 	ctx, span := h.tracer.Start(ctx, "executeHoneycombQuery")
 	defer span.End()
-	
+
 	span.SetAttributes(
-		attribute.String("honeycomb.service", serviceName),
+		attribute.String("honeycomb.dataset", dataset),
 		attribute.Int("honeycomb.time_range", query.TimeRange),
 	)
-	// Use service name as dataset - no need to extract from filters
-	dataset := serviceName
 	if dataset == "" {
-		dataset = "cosmic-canary-service"
+		return nil, fmt.Errorf("no Honeycomb dataset given for query")
+	}
+
+	if h.queryCache == nil {
+		return h.runHoneycombQuery(ctx, dataset, query)
+	}
+
+	key, err := h.queryCache.cacheKey(dataset, query)
+	if err != nil {
+		return nil, err
+	}
+	result, source, err := h.queryCache.do(ctx, key, func(ctx context.Context) (*HoneycombQueryResult, error) {
+		return h.runHoneycombQuery(ctx, dataset, query)
+	})
+
+	attrs := metric.WithAttributes(
+		attribute.String("dataset", dataset),
+		attribute.String("source", string(source)),
+	)
+	if source == cacheSourceHoneycomb {
+		h.cacheMisses.Add(ctx, 1, attrs)
+	} else {
+		log.Printf("♻️  Reusing %s result for query on dataset %s", source, dataset)
+		h.cacheHits.Add(ctx, 1, attrs)
 	}
-	
-	// Step 1: Create the query and get the ID
-	queryID, err := h.createHoneycombQuery(dataset, query)
+	span.SetAttributes(attribute.String("honeycomb.cache", string(source)))
+	return result, err
+}
+
+// runHoneycombQuery creates a query in Honeycomb, or reuses the ID of an
+// identical query created earlier, and fetches its results. Each API call is
+// retried and guarded by the circuit breaker.
+func (h *HoneycombAdapter) runHoneycombQuery(ctx context.Context, dataset string, query *HoneycombQuery) (*HoneycombQueryResult, error) {
+	create := func() (string, error) {
+		var queryID string
+		err := h.callHoneycomb(ctx, dataset, "create_query", func() error {
+			var err error
+			queryID, err = h.createHoneycombQuery(ctx, dataset, query)
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to create query: %w", err)
+		}
+		log.Printf("🆔 Created query with ID: %s", queryID)
+		return queryID, nil
+	}
+	execute := func(queryID string) (*HoneycombQueryResult, error) {
+		var result *HoneycombQueryResult
+		err := h.callHoneycomb(ctx, dataset, "query_results", func() error {
+			var err error
+			result, err = h.executeHoneycombQueryByID(ctx, dataset, queryID)
+			return err
+		})
+		return result, err
+	}
+
+	// Queries over an absolute time range are never repeated, so their IDs
+	// are not remembered
+	if h.queryIDs == nil || !reusableQuery(query) {
+		queryID, err := create()
+		if err != nil {
+			return nil, err
+		}
+		return execute(queryID)
+	}
+
+	key, err := queryDefinitionKey(dataset, query)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create query: %v", err)
+		return nil, err
 	}
-	
-	log.Printf("🆔 Created query with ID: %s", queryID)
-	
+
+	// Step 1: Reuse the query ID for this definition, or create the query
+	if queryID, ok := h.queryIDs.lookup(key); ok {
+		log.Printf("🆔 Reusing query ID %s for identical query definition", queryID)
+		result, err := execute(queryID)
+		var apiErr *HoneycombAPIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+			return result, err
+		}
+		// The query no longer exists in Honeycomb; create it again
+		log.Printf("🔄 Query ID %s was not found, recreating query", queryID)
+		h.queryIDs.forget(key)
+	}
+
+	queryID, err := create()
+	if err != nil {
+		return nil, err
+	}
+	h.queryIDs.store(key, queryID)
+
 	// Step 2: Execute the query using the ID
-	return h.executeHoneycombQueryByID(dataset, queryID)
+	return execute(queryID)
 }
 
-func (h *HoneycombAdapter) createHoneycombQuery(dataset string, query *HoneycombQuery) (string, error) {
+func (h *HoneycombAdapter) createHoneycombQuery(ctx context.Context, dataset string, query *HoneycombQuery) (string, error) {
 	// Use the correct Honeycomb API endpoint: /1/queries/{dataset}
 	url := fmt.Sprintf("%s/1/queries/%s", h.honeycombBaseURL, dataset)
 	log.Printf("🎯 Using Honeycomb dataset: %s", dataset)
@@ -607,14 +817,14 @@ func (h *HoneycombAdapter) createHoneycombQuery(dataset string, query *Honeycomb
 	log.Printf("🚀 Creating query in Honeycomb: %s", string(jsonData))
 	h.logDebug("Sending to Honeycomb: %s", string(jsonData))
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return "", fmt.Errorf("failed to create request: %v", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("X-Honeycomb-Team", h.honeycombAPIKey)
-	
+
 	log.Printf("📤 HTTP Request (Create Query):")
 	log.Printf("  URL: %s", url)
 	log.Printf("  Method: POST")
@@ -625,16 +835,16 @@ func (h *HoneycombAdapter) createHoneycombQuery(dataset string, query *Honeycomb
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Printf("❌ HTTP request failed: %v", err)
-		return "", fmt.Errorf("failed to execute request: %v", err)
+		return "", fmt.Errorf("failed to execute request: %w", err)
 	}
 	defer resp.Body.Close()
-	
+
 	log.Printf("📥 HTTP Response (Create Query):")
 	log.Printf("  Status: %d %s", resp.StatusCode, resp.Status)
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
 		log.Printf("❌ Honeycomb API returned status %d", resp.StatusCode)
-		return "", fmt.Errorf("honeycomb API returned status %d", resp.StatusCode)
+		return "", &HoneycombAPIError{StatusCode: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
 	}
 
 	var result map[string]interface{}
@@ -644,19 +854,19 @@ func (h *HoneycombAdapter) createHoneycombQuery(dataset string, query *Honeycomb
 	}
 
 	log.Printf("📊 Query creation response: %+v", result)
-	
+
 	// Extract the query ID
 	if id, ok := result["id"].(string); ok {
 		return id, nil
 	}
-	
+
 	return "", fmt.Errorf("no query ID returned from Honeycomb")
 }
 
-func (h *HoneycombAdapter) executeHoneycombQueryByID(dataset string, queryID string) (map[string]interface{}, error) {
+func (h *HoneycombAdapter) executeHoneycombQueryByID(ctx context.Context, dataset string, queryID string) (*HoneycombQueryResult, error) {
 	// Use the query results endpoint: POST /1/query_results/{dataset}
 	url := fmt.Sprintf("%s/1/query_results/%s", h.honeycombBaseURL, dataset)
-	
+
 	// Create the request body with query_id
 	requestBody := map[string]interface{}{
 		"query_id":                   queryID,
@@ -665,25 +875,25 @@ func (h *HoneycombAdapter) executeHoneycombQueryByID(dataset string, queryID str
 		"disable_other_by_aggregate": true,
 		"limit":                      10000,
 	}
-	
+
 	jsonData, err := json.Marshal(requestBody)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request body: %v", err)
 	}
-	
+
 	log.Printf("🔍 Executing query by ID:")
 	log.Printf("  URL: %s", url)
 	log.Printf("  Query ID: %s", queryID)
 	log.Printf("  Request body: %s", string(jsonData))
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("X-Honeycomb-Team", h.honeycombAPIKey)
-	
+
 	log.Printf("📤 HTTP Request (Execute Query):")
 	log.Printf("  URL: %s", url)
 	log.Printf("  Method: POST")
@@ -694,16 +904,16 @@ func (h *HoneycombAdapter) executeHoneycombQueryByID(dataset string, queryID str
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Printf("❌ HTTP request failed: %v", err)
-		return nil, fmt.Errorf("failed to execute request: %v", err)
+		return nil, fmt.Errorf("failed to execute request: %w", err)
 	}
 	defer resp.Body.Close()
-	
+
 	log.Printf("📥 HTTP Response (Execute Query):")
 	log.Printf("  Status: %d %s", resp.StatusCode, resp.Status)
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
 		log.Printf("❌ Honeycomb API returned status %d", resp.StatusCode)
-		return nil, fmt.Errorf("honeycomb API returned status %d", resp.StatusCode)
+		return nil, &HoneycombAPIError{StatusCode: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
 	}
 
 	// Check if we got HTTP 201 (Created) with Location header
@@ -711,56 +921,66 @@ func (h *HoneycombAdapter) executeHoneycombQueryByID(dataset string, queryID str
 		location := resp.Header.Get("Location")
 		if location != "" {
 			log.Printf("🔗 Got HTTP 201 with Location header: %s", location)
-			
+
 			// Follow the Location header to get actual results
-			return h.getQueryResultsByLocation(dataset, location)
+			return h.getQueryResultsByLocation(ctx, dataset, location)
 		}
 	}
 
-	var result map[string]interface{}
+	var result HoneycombQueryResult
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		log.Printf("❌ Failed to decode response: %v", err)
 		return nil, fmt.Errorf("failed to decode response: %v", err)
 	}
 
+	// A result that is still running has to be polled by its ID
+	if !result.Complete && result.ID != "" {
+		log.Printf("🔗 Query result %s is not complete yet, polling", result.ID)
+		return h.getQueryResultsByLocation(ctx, dataset, fmt.Sprintf("/1/query_results/%s/%s", dataset, result.ID))
+	}
+
 	log.Printf("📊 Query execution results: %+v", result)
-	return result, nil
+	return &result, nil
 }
 
-func (h *HoneycombAdapter) getQueryResultsByLocation(dataset string, location string) (map[string]interface{}, error) {
+func (h *HoneycombAdapter) getQueryResultsByLocation(ctx context.Context, dataset string, location string) (*HoneycombQueryResult, error) {
 	// The location header gives us the path, we need to construct the full URL
 	fullURL := fmt.Sprintf("%s%s", h.honeycombBaseURL, location)
-	
+
 	log.Printf("🔗 Following Location header to get actual results:")
 	log.Printf("  URL: %s", fullURL)
 
 	client := &http.Client{Timeout: 30 * time.Second}
-	
-	// Poll until query completes (max 10 attempts, 3 seconds apart)
-	maxAttempts := 10
-	for attempt := 1; attempt <= maxAttempts; attempt++ {
-		log.Printf("⏳ Polling attempt %d/%d for query completion...", attempt, maxAttempts)
-		
-		req, err := http.NewRequest("GET", fullURL, nil)
+
+	// Poll with backoff until the query completes, the attempts or overall
+	// deadline run out, or the caller gives up
+	poll := h.pollSettings()
+	ctx, cancel := context.WithTimeout(ctx, poll.Deadline)
+	defer cancel()
+
+	for attempt := 1; attempt <= poll.MaxAttempts; attempt++ {
+		log.Printf("⏳ Polling attempt %d/%d for query completion...", attempt, poll.MaxAttempts)
+
+		req, err := http.NewRequestWithContext(ctx, "GET", fullURL, nil)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create request for location: %v", err)
 		}
 
 		req.Header.Set("X-Honeycomb-Team", h.honeycombAPIKey)
-		
+
 		resp, err := client.Do(req)
 		if err != nil {
 			log.Printf("❌ HTTP request failed: %v", err)
-			return nil, fmt.Errorf("failed to execute location request: %v", err)
+			return nil, fmt.Errorf("failed to execute location request: %w", err)
 		}
-		
+
 		if resp.StatusCode != http.StatusOK {
 			resp.Body.Close()
 			log.Printf("❌ Honeycomb API returned status %d for location", resp.StatusCode)
-			return nil, fmt.Errorf("honeycomb API returned status %d for location", resp.StatusCode)
+			return nil, &HoneycombAPIError{StatusCode: resp.StatusCode, Resource: "location", RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
 		}
 
-		var result map[string]interface{}
+		var result HoneycombQueryResult
 		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 			resp.Body.Close()
 			log.Printf("❌ Failed to decode location response: %v", err)
@@ -769,145 +989,148 @@ func (h *HoneycombAdapter) getQueryResultsByLocation(dataset string, location st
 		resp.Body.Close()
 
 		// Check if query is complete
-		if complete, ok := result["complete"].(bool); ok && complete {
+		if result.Complete {
 			log.Printf("✅ Query completed on attempt %d!", attempt)
 			log.Printf("📊 Final query results: %+v", result)
-			return result, nil
+			return &result, nil
 		}
-		
-		log.Printf("🔄 Query still running... waiting 3 seconds before next attempt")
-		if attempt < maxAttempts {
-			time.Sleep(3 * time.Second)
+
+		if attempt < poll.MaxAttempts {
+			delay := poll.delay(attempt)
+			log.Printf("🔄 Query still running... waiting %s before next attempt", delay)
+			if err := sleepContext(ctx, delay); err != nil {
+				log.Printf("❌ Stopped polling for query results: %v", err)
+				return nil, fmt.Errorf("stopped polling for query results after %d attempts: %w", attempt, err)
+			}
 		}
 	}
-	
-	log.Printf("❌ Query did not complete after %d attempts", maxAttempts)
-	return nil, fmt.Errorf("query did not complete after %d attempts", maxAttempts)
-}
-
-func (h *HoneycombAdapter) convertToPrometheusFormat(honeycombResult map[string]interface{}, timeParam string) *PrometheusResponse {
-	value := h.extractValueFromHoneycombResult(honeycombResult)
-	
-	// Check if this was a success rate query - convert count to percentage
-	if query, ok := honeycombResult["query"].(map[string]interface{}); ok {
-		if filters, ok := query["filters"].([]interface{}); ok {
-			for _, filter := range filters {
-				if f, ok := filter.(map[string]interface{}); ok {
-					if f["column"] == "http.status_code" && value > 0 {
-						// Success rate: assume ~99% success for testing
-						// In production, you'd do two queries: successful/total * 100
-						log.Printf("📊 Converting success count %f to success rate percentage", value)
-						if value > 50 {  // If we have a good amount of traffic
-							value = 99.5  // High success rate
-						} else {
-							value = 97.0  // Lower but still passing success rate
-						}
-						break
-					}
-				}
-			}
+
+	log.Printf("❌ Query did not complete after %d attempts", poll.MaxAttempts)
+	return nil, fmt.Errorf("%w after %d attempts", errQueryIncomplete, poll.MaxAttempts)
+}
+
+// honeycombResultToVector converts a Honeycomb query result into an instant
+// vector with one sample per breakdown group, taking each sample's value from
+// the given calculation.
+func (h *HoneycombAdapter) honeycombResultToVector(honeycombResult *HoneycombQueryResult, calculation Calculation, breakdowns []breakdown) Vector {
+	if len(breakdowns) == 0 {
+		if value, ok := h.extractValueFromHoneycombResult(honeycombResult, calculation); ok {
+			return Vector{{Metric: map[string]string{}, Value: value}}
 		}
+		return Vector{}
 	}
 
-	// Convert to Unix timestamp
-	timestamp := time.Now().Unix()
-	if timeParam != "" {
-		if t, err := time.Parse(time.RFC3339, timeParam); err == nil {
-			timestamp = t.Unix()
+	log.Printf("📊 Converting %d breakdown groups", len(honeycombResult.Data.Results))
+
+	vector := Vector{}
+	for _, row := range honeycombResult.Data.Results {
+		labels, values := splitBreakdowns(row.Data, breakdowns)
+		if value, ok := h.extractValueFromDataPoint(values, calculation.Alias()); ok {
+			vector = append(vector, Sample{Metric: labels, Value: value})
 		}
 	}
+	return vector
+}
+
+// splitBreakdowns separates the breakdown columns of a Honeycomb data point,
+// returned as Prometheus labels, from its calculated values.
+func splitBreakdowns(dataPoint map[string]interface{}, breakdowns []breakdown) (map[string]string, map[string]interface{}) {
+	labels := make(map[string]string, len(breakdowns))
+	values := make(map[string]interface{}, len(dataPoint))
+	for key, v := range dataPoint {
+		values[key] = v
+	}
+	for _, b := range breakdowns {
+		labels[b.Label] = formatLabelValue(dataPoint[b.Column])
+		delete(values, b.Column)
+	}
+	return labels, values
+}
+
+// formatLabelValue renders a Honeycomb column value as a label value.
+func formatLabelValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// buildPrometheusResponse renders an evaluated value as a Prometheus instant
+// query response stamped with ts. Scalars are returned as a single unlabelled
+// sample, since Flagger only accepts vector results.
+func (h *HoneycombAdapter) buildPrometheusResponse(result value, ts time.Time) *PrometheusResponse {
+	timestamp := float64(ts.UnixMilli()) / 1000
+
+	var samples Vector
+	switch v := result.(type) {
+	case scalarValue:
+		samples = Vector{{Metric: map[string]string{}, Value: float64(v)}}
+	case Vector:
+		samples = v
+	}
 
-	return &PrometheusResponse{
+	response := &PrometheusResponse{
 		Status: "success",
-		Data: struct {
-			ResultType string `json:"resultType"`
-			Result     []struct {
-				Metric map[string]string `json:"metric"`
-				Value  []interface{}     `json:"value"`
-			} `json:"result"`
-		}{
+		Data: PrometheusData{
 			ResultType: "vector",
-			Result: []struct {
-				Metric map[string]string `json:"metric"`
-				Value  []interface{}     `json:"value"`
-			}{
-				{
-					Metric: map[string]string{},
-					Value:  []interface{}{timestamp, fmt.Sprintf("%.2f", value)},
-				},
-			},
+			Result:     []PrometheusResult{},
 		},
 	}
+	for _, s := range samples {
+		response.Data.Result = append(response.Data.Result, PrometheusResult{
+			Metric: s.Metric,
+			Value:  []interface{}{timestamp, strconv.FormatFloat(s.Value, 'f', -1, 64)},
+		})
+	}
+	return response
 }
 
-func (h *HoneycombAdapter) extractValueFromHoneycombResult(result map[string]interface{}) float64 {
-	log.Printf("🔍 Extracting value from Honeycomb result structure...")
-	
-	// Navigate Honeycomb's JSON structure to extract the numeric result
-	if data, ok := result["data"].(map[string]interface{}); ok {
-		log.Printf("📊 Found data field in result")
-		
-		// Try the results array first (this is where the total COUNT is)
-		if results, ok := data["results"].([]interface{}); ok && len(results) > 0 {
-			log.Printf("📊 Found results array with %d items", len(results))
-			
-			if firstResult, ok := results[0].(map[string]interface{}); ok {
-				if dataPoint, ok := firstResult["data"].(map[string]interface{}); ok {
-					log.Printf("📊 Found data point: %+v", dataPoint)
-					
-					// Look for calculated values (COUNT, P95, AVG, etc.)
-					for key, v := range dataPoint {
-						if strings.Contains(strings.ToUpper(key), "COUNT") || 
-						   strings.Contains(strings.ToUpper(key), "AVG") ||
-						   strings.Contains(strings.ToUpper(key), "P95") ||
-						   strings.Contains(strings.ToUpper(key), "DURATION_MS") {
-							if val, ok := v.(float64); ok {
-								log.Printf("✅ Extracted value %f from field %s", val, key)
-								h.logDebug("Extracted value %f from field %s", val, key)
-								return val
-							}
-						}
-					}
-					
-					// Fallback: try any numeric value
-					for key, v := range dataPoint {
-						if val, ok := v.(float64); ok {
-							log.Printf("✅ Extracted fallback value %f from field %s", val, key)
-							h.logDebug("Extracted fallback value: %f", val)
-							return val
-						}
-					}
-				}
-			}
-		}
-		
-		// Fallback: try the old structure for backward compatibility
-		if results, ok := data["results"].([]interface{}); ok && len(results) > 0 {
-			if firstResult, ok := results[0].(map[string]interface{}); ok {
-				if dataPoints, ok := firstResult["data"].([]interface{}); ok && len(dataPoints) > 0 {
-					if point, ok := dataPoints[0].(map[string]interface{}); ok {
-						// Look for calculated values (COUNT, P95, AVG, etc.)
-						for key, v := range point {
-							if strings.Contains(strings.ToLower(key), "count") || 
-							   strings.Contains(strings.ToLower(key), "avg") ||
-							   strings.Contains(strings.ToLower(key), "p95") ||
-							   strings.Contains(strings.ToLower(key), "duration_ms") {
-								if val, ok := v.(float64); ok {
-									log.Printf("✅ Extracted value %f from field %s (old structure)", val, key)
-									h.logDebug("Extracted value %f from field %s", val, key)
-									return val
-								}
-							}
-						}
-					}
-				}
-			}
+// extractValueFromHoneycombResult returns the value of calculation in a
+// result without breakdowns. A query that matched no events returns no rows,
+// which is a count of zero but leaves other calculations undefined.
+func (h *HoneycombAdapter) extractValueFromHoneycombResult(result *HoneycombQueryResult, calculation Calculation) (float64, bool) {
+	alias := calculation.Alias()
+	log.Printf("🔍 Extracting %s from Honeycomb result...", alias)
+
+	if len(result.Data.Results) > 0 {
+		log.Printf("📊 Found data point: %+v", result.Data.Results[0].Data)
+		if val, ok := h.extractValueFromDataPoint(result.Data.Results[0].Data, alias); ok {
+			return val, true
 		}
 	}
 
-	log.Printf("❌ No numeric value found in Honeycomb result, returning 0")
-	h.logDebug("No numeric value found in Honeycomb result, returning 0")
-	return 0.0
+	if emptyIsZero(calculation) {
+		log.Printf("📊 No results for %s, treating as 0 events", alias)
+		return 0, true
+	}
+	log.Printf("❌ No value for %s in Honeycomb result", alias)
+	h.logDebug("No value for %s in Honeycomb result", alias)
+	return 0, false
+}
+
+// emptyIsZero reports whether a calculation over no events is 0, as a COUNT
+// or SUM is, rather than undefined.
+func emptyIsZero(calculation Calculation) bool {
+	return calculation.Op == "COUNT" || calculation.Op == "SUM"
+}
+
+// extractValueFromDataPoint returns the value stored under a calculation alias
+// in a Honeycomb result row or series bucket.
+func (h *HoneycombAdapter) extractValueFromDataPoint(dataPoint map[string]interface{}, alias string) (float64, bool) {
+	val, ok := dataPoint[alias].(float64)
+	if !ok {
+		h.logDebug("No numeric value for %s in data point %+v", alias, dataPoint)
+		return 0, false
+	}
+	log.Printf("✅ Extracted value %f from field %s", val, alias)
+	h.logDebug("Extracted value %f from field %s", val, alias)
+	return val, true
 }
 
 func (h *HoneycombAdapter) logDebug(format string, args ...interface{}) {
@@ -925,4 +1148,4 @@ func getEnv(key, defaultValue string) string {
 		return value
 	}
 	return defaultValue
-}
\ No newline at end of file
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -33,6 +34,21 @@ func TestExtractServiceName(t *testing.T) {
 			promQL:   `sum(rate(http_requests_total{service="{{ args.name }}"}[5m]))`,
 			expected: "",
 		},
+		{
+			name:     "flagger canary service",
+			promQL:   `sum(rate(http_requests_total{service="podinfo-canary"}[5m]))`,
+			expected: "podinfo",
+		},
+		{
+			name:     "namespace-qualified primary",
+			promQL:   `sum(rate(http_requests_total{service="podinfo-primary.test.svc.cluster.local"}[5m]))`,
+			expected: "podinfo",
+		},
+		{
+			name:     "unrendered target",
+			promQL:   `sum(rate(http_requests_total{service="{{ target }}"}[5m]))`,
+			expected: "",
+		},
 		{
 			name:     "no service name",
 			promQL:   `sum(rate(http_requests_total[5m]))`,
@@ -50,7 +66,7 @@ func TestExtractServiceName(t *testing.T) {
 	}
 }
 
-func TestExtractTimeWindow(t *testing.T) {
+func TestTranslateTimeWindow(t *testing.T) {
 	adapter := &HoneycombAdapter{
 		queryTimeWindow: 3 * time.Minute,
 	}
@@ -75,6 +91,21 @@ func TestExtractTimeWindow(t *testing.T) {
 			promQL:   `sum(rate(http_requests_total[1h]))`,
 			expected: 1 * time.Hour,
 		},
+		{
+			name:     "compound duration",
+			promQL:   `sum(rate(http_requests_total[4m30s]))`,
+			expected: 4*time.Minute + 30*time.Second,
+		},
+		{
+			name:     "weeks",
+			promQL:   `sum(increase(http_requests_total[1w]))`,
+			expected: 7 * 24 * time.Hour,
+		},
+		{
+			name:     "offset",
+			promQL:   `sum(rate(http_requests_total[10m] offset 1h))`,
+			expected: 10 * time.Minute,
+		},
 		{
 			name:     "no time window",
 			promQL:   `sum(http_requests_total)`,
@@ -84,24 +115,27 @@ func TestExtractTimeWindow(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := adapter.extractTimeWindow(tt.promQL)
-			if result != tt.expected {
-				t.Errorf("expected %v, got %v", tt.expected, result)
+			plan, err := adapter.translatePromQL(tt.promQL)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if window := plan.leaves()[0].Window; window != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, window)
 			}
 		})
 	}
 }
 
-func TestTranslatePromQLToHoneycomb(t *testing.T) {
+func TestTranslatePromQLCalculation(t *testing.T) {
 	adapter := &HoneycombAdapter{
 		queryTimeWindow: 3 * time.Minute,
 	}
 
 	tests := []struct {
-		name     string
-		promQL   string
-		wantErr  bool
-		checkOp  string
+		name    string
+		promQL  string
+		wantErr bool
+		checkOp string
 	}{
 		{
 			name:    "error rate query",
@@ -130,8 +164,12 @@ func TestTranslatePromQLToHoneycomb(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result, err := adapter.translatePromQLToHoneycomb(tt.promQL)
-			
+			var leaves []*honeycombLeaf
+			plan, err := adapter.translatePromQL(tt.promQL)
+			if err == nil {
+				leaves, err = adapter.honeycombLeaves(plan.queries())
+			}
+
 			if tt.wantErr {
 				if err == nil {
 					t.Errorf("expected error, got nil")
@@ -144,6 +182,7 @@ func TestTranslatePromQLToHoneycomb(t *testing.T) {
 				return
 			}
 
+			result := leaves[0].Query
 			if len(result.Calculations) == 0 {
 				t.Error("expected calculations, got none")
 				return
@@ -183,27 +222,23 @@ func TestHealthEndpoint(t *testing.T) {
 	}
 }
 
-func TestConvertToPrometheusFormat(t *testing.T) {
+func TestBuildPrometheusResponse(t *testing.T) {
 	adapter := &HoneycombAdapter{
 		queryTimeWindow: 3 * time.Minute,
 	}
 
 	// Mock Honeycomb response
-	honeycombResult := map[string]interface{}{
-		"data": map[string]interface{}{
-			"results": []interface{}{
-				map[string]interface{}{
-					"data": []interface{}{
-						map[string]interface{}{
-							"count": 42.0,
-						},
-					},
-				},
+	honeycombResult := &HoneycombQueryResult{
+		Complete: true,
+		Data: HoneycombResultData{
+			Results: []HoneycombResultRow{
+				{Data: map[string]interface{}{"COUNT": 42.0}},
 			},
 		},
 	}
 
-	result := adapter.convertToPrometheusFormat(honeycombResult, "")
+	vector := adapter.honeycombResultToVector(honeycombResult, Calculation{Op: "COUNT"}, nil)
+	result := adapter.buildPrometheusResponse(vector, time.Now())
 
 	if result.Status != "success" {
 		t.Errorf("expected status 'success', got %s", result.Status)
@@ -214,7 +249,7 @@ func TestConvertToPrometheusFormat(t *testing.T) {
 	}
 
 	if len(result.Data.Result) != 1 {
-		t.Errorf("expected 1 result, got %d", len(result.Data.Result))
+		t.Fatalf("expected 1 result, got %d", len(result.Data.Result))
 	}
 
 	if len(result.Data.Result[0].Value) != 2 {
@@ -228,55 +263,76 @@ func TestExtractValueFromHoneycombResult(t *testing.T) {
 		queryTimeWindow: 3 * time.Minute,
 	}
 
+	// A query with several calculations returns one key per calculation alias.
+	multiCalculation := &HoneycombQueryResult{
+		Data: HoneycombResultData{
+			Results: []HoneycombResultRow{
+				{Data: map[string]interface{}{
+					"COUNT":             42.0,
+					"AVG(duration_ms)":  123.45,
+					"P95(duration_ms)":  310.0,
+					"P99(duration_ms)":  870.0,
+					"COUNT_DISTINCT(x)": 7.0,
+				}},
+			},
+		},
+	}
+
 	tests := []struct {
-		name     string
-		input    map[string]interface{}
-		expected float64
+		name        string
+		input       *HoneycombQueryResult
+		calculation Calculation
+		expected    float64
+		wantOK      bool
 	}{
 		{
-			name: "valid count result",
-			input: map[string]interface{}{
-				"data": map[string]interface{}{
-					"results": []interface{}{
-						map[string]interface{}{
-							"data": []interface{}{
-								map[string]interface{}{
-									"count": 42.0,
-								},
-							},
-						},
-					},
-				},
-			},
-			expected: 42.0,
+			name:        "valid count result",
+			input:       multiCalculation,
+			calculation: Calculation{Op: "COUNT"},
+			expected:    42.0,
+			wantOK:      true,
 		},
 		{
-			name: "valid avg result",
-			input: map[string]interface{}{
-				"data": map[string]interface{}{
-					"results": []interface{}{
-						map[string]interface{}{
-							"data": []interface{}{
-								map[string]interface{}{
-									"avg": 123.45,
-								},
-							},
-						},
-					},
-				},
-			},
-			expected: 123.45,
+			name:        "valid avg result",
+			input:       multiCalculation,
+			calculation: Calculation{Op: "AVG", Column: "duration_ms"},
+			expected:    123.45,
+			wantOK:      true,
 		},
 		{
-			name:     "empty result",
-			input:    map[string]interface{}{},
-			expected: 0.0,
+			name:        "percentile selected by exact alias",
+			input:       multiCalculation,
+			calculation: Calculation{Op: "P99", Column: "duration_ms"},
+			expected:    870.0,
+			wantOK:      true,
+		},
+		{
+			name:        "calculation missing from result",
+			input:       multiCalculation,
+			calculation: Calculation{Op: "P50", Column: "duration_ms"},
+			wantOK:      false,
+		},
+		{
+			name:        "empty count result is zero",
+			input:       &HoneycombQueryResult{},
+			calculation: Calculation{Op: "COUNT"},
+			expected:    0.0,
+			wantOK:      true,
+		},
+		{
+			name:        "empty percentile result has no value",
+			input:       &HoneycombQueryResult{},
+			calculation: Calculation{Op: "P95", Column: "duration_ms"},
+			wantOK:      false,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := adapter.extractValueFromHoneycombResult(tt.input)
+			result, ok := adapter.extractValueFromHoneycombResult(tt.input, tt.calculation)
+			if ok != tt.wantOK {
+				t.Fatalf("expected ok=%v, got %v", tt.wantOK, ok)
+			}
 			if result != tt.expected {
 				t.Errorf("expected %f, got %f", tt.expected, result)
 			}
@@ -284,6 +340,48 @@ func TestExtractValueFromHoneycombResult(t *testing.T) {
 	}
 }
 
+func TestHoneycombResultToVectorBreakdowns(t *testing.T) {
+	adapter := &HoneycombAdapter{
+		queryTimeWindow: 3 * time.Minute,
+	}
+
+	honeycombResult := &HoneycombQueryResult{
+		Data: HoneycombResultData{
+			Results: []HoneycombResultRow{
+				{Data: map[string]interface{}{"service.name": "app-primary", "http.status_code": 200.0, "COUNT": 90.0}},
+				{Data: map[string]interface{}{"service.name": "app-canary", "http.status_code": 500.0, "COUNT": 10.0}},
+			},
+		},
+	}
+	breakdowns := []breakdown{
+		{Label: "service", Column: "service.name"},
+		{Label: "code", Column: "http.status_code"},
+	}
+
+	vector := adapter.honeycombResultToVector(honeycombResult, Calculation{Op: "COUNT"}, breakdowns)
+	if len(vector) != 2 {
+		t.Fatalf("expected 2 samples, got %d", len(vector))
+	}
+
+	expected := []struct {
+		service string
+		code    string
+		value   float64
+	}{
+		{service: "app-primary", code: "200", value: 90},
+		{service: "app-canary", code: "500", value: 10},
+	}
+	for i, want := range expected {
+		got := vector[i]
+		if got.Metric["service"] != want.service || got.Metric["code"] != want.code {
+			t.Errorf("sample %d: expected labels service=%s code=%s, got %v", i, want.service, want.code, got.Metric)
+		}
+		if got.Value != want.value {
+			t.Errorf("sample %d: expected value %f, got %f", i, want.value, got.Value)
+		}
+	}
+}
+
 // Mock Honeycomb server for integration testing
 func mockHoneycombServer() *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -353,4 +451,51 @@ func TestQueryIntegration(t *testing.T) {
 	if result.Status != "success" {
 		t.Errorf("expected status 'success', got %s", result.Status)
 	}
-}
\ No newline at end of file
+}
+
+func TestExecuteHoneycombQueryPollsIncompleteResult(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/1/queries/test":
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": "query-1"})
+		case r.URL.Path == "/1/query_results/test" && r.Method == "POST":
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": "result-1", "complete": false})
+		case r.URL.Path == "/1/query_results/test/result-1" && r.Method == "GET":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":       "result-1",
+				"complete": true,
+				"data": map[string]interface{}{
+					"results": []interface{}{
+						map[string]interface{}{"data": map[string]interface{}{"COUNT": 12.0}},
+					},
+				},
+				"links": map[string]interface{}{"query_url": "https://ui.honeycomb.io/q/1"},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mockServer.Close()
+
+	adapter := &HoneycombAdapter{
+		honeycombAPIKey:  "test-key",
+		honeycombBaseURL: mockServer.URL,
+		queryTimeWindow:  3 * time.Minute,
+	}
+	adapter.ensureTelemetry()
+
+	result, err := adapter.executeHoneycombQuery(context.Background(), &HoneycombQuery{
+		TimeRange:    180,
+		Calculations: []Calculation{{Op: "COUNT"}},
+	}, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Complete || result.Links.QueryURL == "" {
+		t.Errorf("expected the completed result, got %+v", result)
+	}
+	if v, ok := adapter.extractValueFromHoneycombResult(result, Calculation{Op: "COUNT"}); !ok || v != 12 {
+		t.Errorf("expected COUNT 12, got %v (ok=%v)", v, ok)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// histogramCalculation is the pseudo-calculation for *_bucket metrics that are
+// only meaningful inside histogram_quantile(); the percentile is chosen from
+// the quantile argument.
+const histogramCalculation = "HISTOGRAM"
+
+// metricMapping describes the Honeycomb calculation behind a Prometheus metric.
+type metricMapping struct {
+	// Calculation is the Honeycomb calculation op (COUNT, SUM, AVG, ...) or
+	// HISTOGRAM for bucket metrics consumed by histogram_quantile().
+	Calculation string `yaml:"calculation"`
+	// Column is the Honeycomb column the calculation is applied to.
+	Column string `yaml:"column,omitempty"`
+	// Unit is the time unit of Column (ns, us, ms or s). When it differs from
+	// the unit in the metric name, e.g. duration_ms behind a *_seconds metric,
+	// results are converted. Columns ending in a unit suffix need not set it.
+	Unit string `yaml:"unit,omitempty"`
+	// Filters are always added to queries for this metric.
+	Filters []Filter `yaml:"filters,omitempty"`
+	// Labels renames Prometheus labels to Honeycomb columns for this metric,
+	// taking precedence over the global label mapping.
+	Labels map[string]string `yaml:"labels,omitempty"`
+	// Window bounds the time window of this metric's queries, taking
+	// precedence over the bounds of its dataset.
+	Window *windowPolicy `yaml:"window,omitempty"`
+}
+
+// mappingConfig is the metric-to-Honeycomb mapping, optionally loaded from the
+// file named by METRIC_MAPPING_FILE.
+type mappingConfig struct {
+	// Labels maps Prometheus label names onto Honeycomb columns. Labels not
+	// listed here are assumed to have a column of the same name.
+	Labels  map[string]string        `yaml:"labels"`
+	Metrics map[string]metricMapping `yaml:"metrics"`
+	// Datasets is the lookup table of the "lookup" dataset strategy.
+	Datasets datasetMapping `yaml:"datasets"`
+}
+
+// datasetMapping maps services and namespaces onto Honeycomb datasets. A
+// service entry wins over a namespace entry; Default catches the rest.
+type datasetMapping struct {
+	Services   map[string]string `yaml:"services"`
+	Namespaces map[string]string `yaml:"namespaces"`
+	Default    string            `yaml:"default"`
+	// Windows bounds the time window of queries by dataset, whatever the
+	// dataset strategy.
+	Windows map[string]windowPolicy `yaml:"windows"`
+}
+
+// defaultMappingConfig returns the mapping used when no file is configured.
+func defaultMappingConfig() *mappingConfig {
+	return &mappingConfig{
+		Labels: map[string]string{
+			"service": "service.name",
+			"code":    "http.status_code",
+			"method":  "http.method",
+			"route":   "http.route",
+			// Set by the OpenTelemetry Kubernetes attributes processor
+			"namespace": "k8s.namespace.name",
+			// Tells Flagger's canary and primary workloads apart
+			workloadLabel: "k8s.deployment.name",
+		},
+		Metrics: map[string]metricMapping{
+			"http_requests_total":                  {Calculation: "COUNT"},
+			"http_request_duration_seconds_bucket": {Calculation: histogramCalculation, Column: "duration_ms", Unit: "ms"},
+		},
+	}
+}
+
+// labelColumn returns the Honeycomb column for a label of the given metric.
+func (c *mappingConfig) labelColumn(metricName, label string) string {
+	if column, ok := c.Metrics[metricName].Labels[label]; ok {
+		return column
+	}
+	if column, ok := c.Labels[label]; ok {
+		return column
+	}
+	return label
+}
+
+var percentileCalculationRE = regexp.MustCompile(`^P(001|01|05|10|20|25|50|75|80|90|95|99|999)$`)
+
+// calculationsWithoutColumn are the Honeycomb calculations that do not take a column.
+var calculationsWithoutColumn = map[string]bool{
+	"COUNT":       true,
+	"CONCURRENCY": true,
+}
+
+// calculationsWithColumn are the Honeycomb calculations that require a column.
+var calculationsWithColumn = map[string]bool{
+	"SUM":                true,
+	"AVG":                true,
+	"MIN":                true,
+	"MAX":                true,
+	"COUNT_DISTINCT":     true,
+	"RATE_AVG":           true,
+	"RATE_SUM":           true,
+	"RATE_MAX":           true,
+	histogramCalculation: true,
+}
+
+// honeycombFilterOps are the filter operators accepted by the Honeycomb Query API.
+var honeycombFilterOps = map[string]bool{
+	"=": true, "!=": true, ">": true, ">=": true, "<": true, "<=": true,
+	"starts-with": true, "does-not-start-with": true,
+	"ends-with": true, "does-not-end-with": true,
+	"exists": true, "does-not-exist": true,
+	"contains": true, "does-not-contain": true,
+	"in": true, "not-in": true,
+}
+
+func (c *mappingConfig) validate() error {
+	for service, dataset := range c.Datasets.Services {
+		if dataset == "" {
+			return fmt.Errorf("datasets: service %q: dataset is required", service)
+		}
+	}
+	for namespace, dataset := range c.Datasets.Namespaces {
+		if dataset == "" {
+			return fmt.Errorf("datasets: namespace %q: dataset is required", namespace)
+		}
+	}
+	for dataset, policy := range c.Datasets.Windows {
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("datasets: windows: %q: %w", dataset, err)
+		}
+	}
+	for name, m := range c.Metrics {
+		switch {
+		case m.Calculation == "":
+			return fmt.Errorf("metric %q: calculation is required", name)
+		case calculationsWithoutColumn[m.Calculation]:
+			if m.Column != "" {
+				return fmt.Errorf("metric %q: calculation %s does not take a column", name, m.Calculation)
+			}
+		case calculationsWithColumn[m.Calculation] || percentileCalculationRE.MatchString(m.Calculation):
+			if m.Column == "" {
+				return fmt.Errorf("metric %q: calculation %s requires a column", name, m.Calculation)
+			}
+		default:
+			return fmt.Errorf("metric %q: unknown calculation %q", name, m.Calculation)
+		}
+
+		if m.Unit != "" {
+			if _, ok := timeUnits[m.Unit]; !ok {
+				return fmt.Errorf("metric %q: unknown unit %q", name, m.Unit)
+			}
+		}
+
+		if m.Window != nil {
+			if err := m.Window.validate(); err != nil {
+				return fmt.Errorf("metric %q: window: %w", name, err)
+			}
+		}
+
+		for i, f := range m.Filters {
+			if f.Column == "" {
+				return fmt.Errorf("metric %q: filter %d: column is required", name, i)
+			}
+			if !honeycombFilterOps[f.Op] {
+				return fmt.Errorf("metric %q: filter %d: unknown filter op %q", name, i, f.Op)
+			}
+		}
+	}
+	return nil
+}
+
+// timeUnits are the supported time units, in seconds.
+var timeUnits = map[string]float64{
+	"ns": 1e-9,
+	"us": 1e-6,
+	"ms": 1e-3,
+	"s":  1,
+}
+
+// metricNameUnits are the Prometheus base-unit suffixes of metric names.
+var metricNameUnits = []struct {
+	suffix string
+	unit   string
+}{
+	{"_nanoseconds", "ns"},
+	{"_microseconds", "us"},
+	{"_milliseconds", "ms"},
+	{"_seconds", "s"},
+}
+
+// unitScale returns the factor converting values of the mapping's column into
+// the unit named by the Prometheus metric. It is 1 when either unit is unknown.
+func (m metricMapping) unitScale(metricName string) float64 {
+	columnUnit := m.Unit
+	if columnUnit == "" {
+		for unit := range timeUnits {
+			if strings.HasSuffix(m.Column, "_"+unit) {
+				columnUnit = unit
+			}
+		}
+	}
+
+	metricUnit := ""
+	for _, u := range metricNameUnits {
+		if strings.HasSuffix(metricName, u.suffix) || strings.Contains(metricName, u.suffix+"_") {
+			metricUnit = u.unit
+			break
+		}
+	}
+
+	if columnUnit == "" || metricUnit == "" {
+		return 1
+	}
+	return timeUnits[columnUnit] / timeUnits[metricUnit]
+}
+
+// parseMappingConfig parses a mapping file and merges it over the defaults:
+// label renames and metrics in the file replace the built-in entries of the
+// same name.
+func parseMappingConfig(data []byte) (*mappingConfig, error) {
+	var fileConfig mappingConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&fileConfig); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse metric mapping: %w", err)
+	}
+
+	config := defaultMappingConfig()
+	for label, column := range fileConfig.Labels {
+		config.Labels[label] = column
+	}
+	for name, m := range fileConfig.Metrics {
+		config.Metrics[name] = m
+	}
+	config.Datasets = fileConfig.Datasets
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid metric mapping: %w", err)
+	}
+	return config, nil
+}
+
+// builtinMappings is the mapping in effect until a mapping file is loaded.
+// Like a loaded mapping it is never modified.
+var builtinMappings = defaultMappingConfig()
+
+// metricConfig returns the mapping currently in effect.
+func (h *HoneycombAdapter) metricConfig() *mappingConfig {
+	if config := h.mappings.Load(); config != nil {
+		return config
+	}
+	return builtinMappings
+}
+
+// loadMetricMappings reads the mapping file and, if its contents changed since
+// the last load, swaps in the new mapping. It reports whether a new mapping
+// was applied.
+func (h *HoneycombAdapter) loadMetricMappings(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read metric mapping file: %w", err)
+	}
+
+	h.mappingsMu.Lock()
+	defer h.mappingsMu.Unlock()
+	if h.mappings.Load() != nil && bytes.Equal(data, h.mappingsData) {
+		return false, nil
+	}
+
+	config, err := parseMappingConfig(data)
+	if err != nil {
+		return false, err
+	}
+	h.mappings.Store(config)
+	h.mappingsData = data
+	return true, nil
+}
+
+// watchMetricMappings re-reads the mapping file every interval until ctx is
+// cancelled. Content is compared rather than modification times because
+// Kubernetes updates mounted ConfigMaps by swapping a symlink. A mapping that
+// fails to load is logged and the previous mapping stays in effect.
+func (h *HoneycombAdapter) watchMetricMappings(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := h.loadMetricMappings(path)
+			if err != nil {
+				log.Printf("❌ Failed to reload metric mappings from %s, keeping previous mapping: %v", path, err)
+				continue
+			}
+			if changed {
+				log.Printf("🔄 Reloaded metric mappings from %s (%d metrics)", path, len(h.metricConfig().Metrics))
+			}
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMappingConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{
+			name: "custom metric",
+			yaml: `
+labels:
+  code: http.response.status_code
+metrics:
+  http_server_duration_seconds_sum:
+    calculation: SUM
+    column: duration
+`,
+		},
+		{
+			name: "empty file keeps defaults",
+			yaml: ``,
+		},
+		{
+			name: "unknown calculation",
+			yaml: `
+metrics:
+  foo_total:
+    calculation: MEDIAN
+    column: duration
+`,
+			wantErr: `unknown calculation "MEDIAN"`,
+		},
+		{
+			name: "missing column",
+			yaml: `
+metrics:
+  foo_seconds:
+    calculation: P99
+`,
+			wantErr: `calculation P99 requires a column`,
+		},
+		{
+			name: "unknown filter op",
+			yaml: `
+metrics:
+  foo_total:
+    calculation: COUNT
+    filters:
+      - column: span.kind
+        op: matches
+        value: server
+`,
+			wantErr: `unknown filter op "matches"`,
+		},
+		{
+			name: "dataset lookup table",
+			yaml: `
+datasets:
+  services:
+    checkout: checkout-prod
+  namespaces:
+    payments: payments
+  default: shared-services
+`,
+		},
+		{
+			name: "empty dataset",
+			yaml: `
+datasets:
+  services:
+    checkout: ""
+`,
+			wantErr: `service "checkout": dataset is required`,
+		},
+		{
+			name: "window bounds",
+			yaml: `
+datasets:
+  windows:
+    checkout:
+      min: 5m
+      max: 1d
+metrics:
+  http_requests_total:
+    calculation: COUNT
+    window:
+      max: 1h30m
+`,
+		},
+		{
+			name: "minimum above maximum",
+			yaml: `
+datasets:
+  windows:
+    checkout:
+      min: 2h
+      max: 1h
+`,
+			wantErr: `minimum window 2h exceeds the maximum 1h`,
+		},
+		{
+			name: "invalid window duration",
+			yaml: `
+metrics:
+  foo_total:
+    calculation: COUNT
+    window:
+      min: 5 minutes
+`,
+			wantErr: `not a valid duration string`,
+		},
+		{
+			name: "unknown field",
+			yaml: `
+metric:
+  foo_total:
+    calculation: COUNT
+`,
+			wantErr: `field metric not found`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parseMappingConfig([]byte(tt.yaml))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, ok := config.Metrics["http_requests_total"]; !ok {
+				t.Error("expected built-in metrics to be kept")
+			}
+		})
+	}
+}
+
+func TestMetricConfigDefault(t *testing.T) {
+	adapter := &HoneycombAdapter{}
+	config := adapter.metricConfig()
+	if adapter.metricConfig() != config {
+		t.Error("expected the built-in mapping to be shared rather than rebuilt")
+	}
+	if column := config.labelColumn("http_requests_total", "namespace"); column != "k8s.namespace.name" {
+		t.Errorf("expected namespace to map onto k8s.namespace.name, got %s", column)
+	}
+}
+
+func TestTranslateWithMappingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mapping.yaml")
+	writeMapping := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeMapping(`
+metrics:
+  http_server_requests_total:
+    calculation: COUNT
+    filters:
+      - column: span.kind
+        op: "="
+        value: server
+    labels:
+      code: http.response.status_code
+`)
+
+	adapter := &HoneycombAdapter{
+		queryTimeWindow: 3 * time.Minute,
+	}
+	if changed, err := adapter.loadMetricMappings(path); err != nil || !changed {
+		t.Fatalf("expected mapping to load, got changed=%v err=%v", changed, err)
+	}
+
+	plan, err := adapter.translatePromQL(`sum(rate(http_server_requests_total{code=~"5.."}[5m])) by (code)`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	query := honeycombPlanLeaves(t, adapter, plan)[0].Query
+	if len(query.Filters) != 2 {
+		t.Fatalf("expected default and status filters, got %+v", query.Filters)
+	}
+	if query.Filters[0].Column != "span.kind" {
+		t.Errorf("expected default filter first, got %+v", query.Filters[0])
+	}
+	if query.Filters[1].Column != "http.response.status_code" || query.Filters[1].Op != ">=" {
+		t.Errorf("expected status filter on renamed column, got %+v", query.Filters[1])
+	}
+	if len(query.Breakdowns) != 1 || query.Breakdowns[0] != "http.response.status_code" {
+		t.Errorf("expected breakdown on renamed column, got %v", query.Breakdowns)
+	}
+
+	// Unchanged content is not reloaded.
+	if changed, err := adapter.loadMetricMappings(path); err != nil || changed {
+		t.Errorf("expected unchanged mapping to be skipped, got changed=%v err=%v", changed, err)
+	}
+
+	// An invalid file keeps the previous mapping.
+	writeMapping(`
+metrics:
+  http_server_requests_total:
+    calculation: BOGUS
+`)
+	if _, err := adapter.loadMetricMappings(path); err == nil {
+		t.Fatal("expected invalid mapping to be rejected")
+	}
+	if _, err := adapter.translatePromQL(`http_server_requests_total`); err != nil {
+		t.Errorf("expected previous mapping to stay in effect, got %v", err)
+	}
+
+	// A valid change is picked up.
+	writeMapping(`
+metrics:
+  http_server_duration_seconds_sum:
+    calculation: SUM
+    column: duration
+`)
+	if changed, err := adapter.loadMetricMappings(path); err != nil || !changed {
+		t.Fatalf("expected mapping to reload, got changed=%v err=%v", changed, err)
+	}
+	plan, err = adapter.translatePromQL(`http_server_duration_seconds_sum`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	query = honeycombPlanLeaves(t, adapter, plan)[0].Query
+	if query.Calculations[0].Op != "SUM" || query.Calculations[0].Column != "duration" {
+		t.Errorf("expected SUM(duration), got %+v", query.Calculations[0])
+	}
+	if _, err := adapter.translatePromQL(`http_server_requests_total`); err == nil {
+		t.Error("expected metric removed from the file to be unmapped")
+	}
+}
+
+func TestMappingReloadKeepsTranslatedQueries(t *testing.T) {
+	var sent []HoneycombQuery
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/1/queries/test":
+			var q HoneycombQuery
+			json.NewDecoder(r.Body).Decode(&q)
+			sent = append(sent, q)
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": "reload-query"})
+		case "/1/query_results/test":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"complete": true,
+				"data":     map[string]interface{}{"results": []interface{}{map[string]interface{}{"data": map[string]interface{}{"SUM(duration)": 42.0}}}},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mockServer.Close()
+
+	path := filepath.Join(t.TempDir(), "mapping.yaml")
+	writeMapping := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeMapping(`
+labels:
+  route: http.route
+metrics:
+  http_server_duration_seconds_sum:
+    calculation: SUM
+    column: duration
+`)
+	adapter := &HoneycombAdapter{
+		honeycombAPIKey:  "test-key",
+		honeycombBaseURL: mockServer.URL,
+		queryTimeWindow:  3 * time.Minute,
+	}
+	if _, err := adapter.loadMetricMappings(path); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := adapter.translatePromQL(`http_server_duration_seconds_sum{service="test",route="/api"}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The reload drops the metric and renames the route column; the plan
+	// still runs as it was translated.
+	writeMapping(`
+labels:
+  route: path
+metrics:
+  http_server_requests_total:
+    calculation: COUNT
+`)
+	if changed, err := adapter.loadMetricMappings(path); err != nil || !changed {
+		t.Fatalf("expected mapping to reload, got changed=%v err=%v", changed, err)
+	}
+
+	vectors, err := adapter.queryBackend().Instant(context.Background(), plan.queries(), time.Time{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(vectors) != 1 || len(vectors[0]) != 1 || vectors[0][0].Value != 42 {
+		t.Errorf("expected a single sample of 42, got %v", vectors)
+	}
+	if len(sent) != 1 {
+		t.Fatalf("expected 1 Honeycomb query, got %d", len(sent))
+	}
+	want := Filter{Column: "http.route", Op: "=", Value: "/api"}
+	if q := sent[0]; q.Calculations[0].Op != "SUM" || q.Calculations[0].Column != "duration" || !reflect.DeepEqual(q.Filters, []Filter{want}) {
+		t.Errorf("expected SUM(duration) filtered on %+v, got %+v", want, q)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+)
+
+// statusCodeLabel is the label holding the HTTP status code. Its column is
+// numeric in Honeycomb, so matchers on it become numeric filters.
+const statusCodeLabel = "code"
+
+// Status codes considered when translating regex matchers on statusCodeLabel.
+const (
+	minStatusCode = 100
+	maxStatusCode = 599
+)
+
+// maxInFilterValues is the largest value list emitted for an in/not-in filter.
+const maxInFilterValues = 100
+
+// matcherFilters translates a label matcher into Honeycomb filters on column.
+// All returned filters must hold (Honeycomb's default AND combination).
+func matcherFilters(m *LabelMatcher, column string) ([]Filter, error) {
+	if m.Name == statusCodeLabel {
+		return statusCodeFilters(m, column)
+	}
+
+	switch m.Type {
+	case MatchEqual:
+		// As in Prometheus, an empty value selects series without the label.
+		if m.Value == "" {
+			return []Filter{{Column: column, Op: "does-not-exist"}}, nil
+		}
+		return []Filter{{Column: column, Op: "=", Value: m.Value}}, nil
+	case MatchNotEqual:
+		if m.Value == "" {
+			return []Filter{{Column: column, Op: "exists"}}, nil
+		}
+		return []Filter{{Column: column, Op: "!=", Value: m.Value}}, nil
+	case MatchRegexp, MatchNotRegexp:
+		f, err := regexFilter(m.Value, m.Type == MatchNotRegexp, column)
+		if err != nil {
+			return nil, err
+		}
+		if f == nil {
+			return nil, nil
+		}
+		return []Filter{*f}, nil
+	}
+	return nil, fmt.Errorf("unknown matcher type %q", m.Type)
+}
+
+// regexFilter translates an anchored Prometheus regex into a single Honeycomb
+// filter. A nil filter means the regex matches every value.
+func regexFilter(expr string, negate bool, column string) (*Filter, error) {
+	re, err := syntax.Parse(expr, syntax.Perl|syntax.DotNL)
+	if err != nil {
+		return nil, err
+	}
+	re = stripCaptures(re.Simplify())
+
+	op := func(positive, negative string) string {
+		if negate {
+			return negative
+		}
+		return positive
+	}
+
+	switch {
+	case isAnyString(re):
+		if negate {
+			return nil, fmt.Errorf("regex %q matches every value, so the negated matcher selects nothing", expr)
+		}
+		return nil, nil
+	case isNonEmptyString(re):
+		return &Filter{Column: column, Op: op("exists", "does-not-exist")}, nil
+	}
+
+	if literals, ok := expandLiterals(re, maxInFilterValues); ok {
+		if len(literals) == 1 && literals[0] == "" {
+			return &Filter{Column: column, Op: op("does-not-exist", "exists")}, nil
+		}
+		for _, l := range literals {
+			if l == "" {
+				return nil, fmt.Errorf("regex %q also matches missing labels, which cannot be expressed as a Honeycomb filter", expr)
+			}
+		}
+		if len(literals) == 1 {
+			return &Filter{Column: column, Op: op("=", "!="), Value: literals[0]}, nil
+		}
+		return &Filter{Column: column, Op: op("in", "not-in"), Value: literals}, nil
+	}
+
+	if re.Op == syntax.OpConcat && len(re.Sub) >= 2 {
+		first, last := re.Sub[0], re.Sub[len(re.Sub)-1]
+		switch {
+		case len(re.Sub) == 3 && isAnyString(first) && isAnyString(last):
+			if s, ok := literalString(re.Sub[1]); ok {
+				return &Filter{Column: column, Op: op("contains", "does-not-contain"), Value: s}, nil
+			}
+		case isAnyString(last):
+			if s, ok := literalString(&syntax.Regexp{Op: syntax.OpConcat, Sub: re.Sub[:len(re.Sub)-1]}); ok {
+				return &Filter{Column: column, Op: op("starts-with", "does-not-start-with"), Value: s}, nil
+			}
+		case isAnyString(first):
+			if s, ok := literalString(&syntax.Regexp{Op: syntax.OpConcat, Sub: re.Sub[1:]}); ok {
+				return &Filter{Column: column, Op: op("ends-with", "does-not-end-with"), Value: s}, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("regex %q cannot be expressed as a Honeycomb filter; use an exact value, a list of alternatives, or a prefix, suffix or substring match", expr)
+}
+
+// stripCaptures removes capture groups, which do not affect what a regex matches.
+func stripCaptures(re *syntax.Regexp) *syntax.Regexp {
+	for re.Op == syntax.OpCapture {
+		re = re.Sub[0]
+	}
+	out := *re
+	out.Sub = make([]*syntax.Regexp, len(re.Sub))
+	for i, sub := range re.Sub {
+		out.Sub[i] = stripCaptures(sub)
+	}
+	return &out
+}
+
+func isAnyChar(re *syntax.Regexp) bool {
+	return re.Op == syntax.OpAnyChar || re.Op == syntax.OpAnyCharNotNL
+}
+
+// isAnyString reports whether re is ".*".
+func isAnyString(re *syntax.Regexp) bool {
+	return re.Op == syntax.OpStar && isAnyChar(re.Sub[0])
+}
+
+// isNonEmptyString reports whether re is ".+".
+func isNonEmptyString(re *syntax.Regexp) bool {
+	return re.Op == syntax.OpPlus && isAnyChar(re.Sub[0])
+}
+
+// literalString returns the string matched by a regex that matches exactly
+// one string.
+func literalString(re *syntax.Regexp) (string, bool) {
+	literals, ok := expandLiterals(re, 1)
+	if !ok || len(literals) != 1 || literals[0] == "" {
+		return "", false
+	}
+	return literals[0], true
+}
+
+// expandLiterals returns every string matched by a regex with a finite
+// language of at most limit strings, such as "GET|POST" or "v[12]".
+func expandLiterals(re *syntax.Regexp, limit int) ([]string, bool) {
+	if limit <= 0 {
+		return nil, false
+	}
+	switch re.Op {
+	case syntax.OpEmptyMatch:
+		return []string{""}, true
+
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil, false
+		}
+		return []string{string(re.Rune)}, true
+
+	case syntax.OpCharClass:
+		var out []string
+		for i := 0; i < len(re.Rune); i += 2 {
+			for r := re.Rune[i]; r <= re.Rune[i+1]; r++ {
+				if len(out) == limit {
+					return nil, false
+				}
+				out = append(out, string(r))
+			}
+		}
+		return out, true
+
+	case syntax.OpCapture:
+		return expandLiterals(re.Sub[0], limit)
+
+	case syntax.OpQuest:
+		sub, ok := expandLiterals(re.Sub[0], limit-1)
+		if !ok {
+			return nil, false
+		}
+		return append([]string{""}, sub...), true
+
+	case syntax.OpAlternate:
+		var out []string
+		for _, sub := range re.Sub {
+			alts, ok := expandLiterals(sub, limit-len(out))
+			if !ok {
+				return nil, false
+			}
+			out = append(out, alts...)
+		}
+		return dedupeStrings(out), true
+
+	case syntax.OpConcat:
+		out := []string{""}
+		for _, sub := range re.Sub {
+			parts, ok := expandLiterals(sub, limit)
+			if !ok || len(out)*len(parts) > limit {
+				return nil, false
+			}
+			next := make([]string, 0, len(out)*len(parts))
+			for _, prefix := range out {
+				for _, part := range parts {
+					next = append(next, prefix+part)
+				}
+			}
+			out = next
+		}
+		return dedupeStrings(out), true
+	}
+	return nil, false
+}
+
+func dedupeStrings(list []string) []string {
+	seen := make(map[string]bool, len(list))
+	out := list[:0]
+	for _, s := range list {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// statusCodeFilters translates a matcher on the status code label into
+// numeric filters. Regex matchers are evaluated against every status code
+// from 100 to 599 and the matching codes are expressed as a range, or as an
+// explicit list when they are not contiguous.
+func statusCodeFilters(m *LabelMatcher, column string) ([]Filter, error) {
+	switch m.Type {
+	case MatchEqual, MatchNotEqual:
+		// As for other labels, an empty value selects series without the
+		// label, or with it when negated.
+		if m.Value == "" {
+			if m.Type == MatchEqual {
+				return []Filter{{Column: column, Op: "does-not-exist"}}, nil
+			}
+			return []Filter{{Column: column, Op: "exists"}}, nil
+		}
+		code, err := strconv.Atoi(m.Value)
+		if err != nil {
+			return nil, fmt.Errorf("status code %q is not a number", m.Value)
+		}
+		return []Filter{{Column: column, Op: string(m.Type), Value: code}}, nil
+	}
+
+	re, err := regexp.Compile("^(?:" + m.Value + ")$")
+	if err != nil {
+		return nil, err
+	}
+	var codes []int
+	for code := minStatusCode; code <= maxStatusCode; code++ {
+		if re.MatchString(strconv.Itoa(code)) != (m.Type == MatchNotRegexp) {
+			codes = append(codes, code)
+		}
+	}
+
+	if len(codes) == 0 {
+		return nil, fmt.Errorf("status code matcher %s matches no status codes", strings.TrimPrefix(m.String(), m.Name))
+	}
+	lo, hi := codes[0], codes[len(codes)-1]
+	if hi-lo+1 == len(codes) {
+		var filters []Filter
+		if lo > minStatusCode {
+			filters = append(filters, Filter{Column: column, Op: ">=", Value: lo})
+		}
+		if hi < maxStatusCode {
+			filters = append(filters, Filter{Column: column, Op: "<", Value: hi + 1})
+		}
+		return filters, nil
+	}
+	if len(codes) <= maxInFilterValues {
+		return []Filter{{Column: column, Op: "in", Value: codes}}, nil
+	}
+
+	// A small set of excluded codes is cheaper to send as not-in.
+	var excluded []int
+	for code, i := minStatusCode, 0; code <= maxStatusCode; code++ {
+		if i < len(codes) && codes[i] == code {
+			i++
+			continue
+		}
+		excluded = append(excluded, code)
+	}
+	if len(excluded) <= maxInFilterValues {
+		return []Filter{{Column: column, Op: "not-in", Value: excluded}}, nil
+	}
+	return nil, fmt.Errorf("status code matcher %s cannot be expressed as a Honeycomb filter", strings.TrimPrefix(m.String(), m.Name))
+}
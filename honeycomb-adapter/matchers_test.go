@@ -0,0 +1,166 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatcherFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		matcher *LabelMatcher
+		want    []Filter
+		wantErr string
+	}{
+		{
+			name:    "equal",
+			matcher: &LabelMatcher{Name: "method", Type: MatchEqual, Value: "GET"},
+			want:    []Filter{{Column: "col", Op: "=", Value: "GET"}},
+		},
+		{
+			name:    "not equal",
+			matcher: &LabelMatcher{Name: "method", Type: MatchNotEqual, Value: "GET"},
+			want:    []Filter{{Column: "col", Op: "!=", Value: "GET"}},
+		},
+		{
+			name:    "equal empty",
+			matcher: &LabelMatcher{Name: "version", Type: MatchEqual, Value: ""},
+			want:    []Filter{{Column: "col", Op: "does-not-exist"}},
+		},
+		{
+			name:    "not equal empty",
+			matcher: &LabelMatcher{Name: "version", Type: MatchNotEqual, Value: ""},
+			want:    []Filter{{Column: "col", Op: "exists"}},
+		},
+		{
+			name:    "regex alternatives",
+			matcher: &LabelMatcher{Name: "method", Type: MatchRegexp, Value: "GET|POST|PUT"},
+			want:    []Filter{{Column: "col", Op: "in", Value: []string{"GET", "POST", "PUT"}}},
+		},
+		{
+			name:    "negated regex alternatives with common prefix",
+			matcher: &LabelMatcher{Name: "route", Type: MatchNotRegexp, Value: "/health|/healthz"},
+			want:    []Filter{{Column: "col", Op: "not-in", Value: []string{"/health", "/healthz"}}},
+		},
+		{
+			name:    "regex literal",
+			matcher: &LabelMatcher{Name: "method", Type: MatchRegexp, Value: "(GET)"},
+			want:    []Filter{{Column: "col", Op: "=", Value: "GET"}},
+		},
+		{
+			name:    "regex prefix",
+			matcher: &LabelMatcher{Name: "route", Type: MatchRegexp, Value: "/api/.*"},
+			want:    []Filter{{Column: "col", Op: "starts-with", Value: "/api/"}},
+		},
+		{
+			name:    "negated regex suffix",
+			matcher: &LabelMatcher{Name: "route", Type: MatchNotRegexp, Value: ".*\\.js"},
+			want:    []Filter{{Column: "col", Op: "does-not-end-with", Value: ".js"}},
+		},
+		{
+			name:    "regex substring",
+			matcher: &LabelMatcher{Name: "route", Type: MatchRegexp, Value: ".*users.*"},
+			want:    []Filter{{Column: "col", Op: "contains", Value: "users"}},
+		},
+		{
+			name:    "regex any non-empty",
+			matcher: &LabelMatcher{Name: "version", Type: MatchRegexp, Value: ".+"},
+			want:    []Filter{{Column: "col", Op: "exists"}},
+		},
+		{
+			name:    "regex anything",
+			matcher: &LabelMatcher{Name: "version", Type: MatchRegexp, Value: ".*"},
+			want:    nil,
+		},
+		{
+			name:    "regex with optional empty value",
+			matcher: &LabelMatcher{Name: "version", Type: MatchRegexp, Value: "v1|"},
+			wantErr: "also matches missing labels",
+		},
+		{
+			name:    "inexpressible regex",
+			matcher: &LabelMatcher{Name: "route", Type: MatchRegexp, Value: "/api/v[0-9]+/.*"},
+			wantErr: "cannot be expressed as a Honeycomb filter",
+		},
+		{
+			name:    "case-insensitive regex",
+			matcher: &LabelMatcher{Name: "method", Type: MatchRegexp, Value: "(?i)get"},
+			wantErr: "cannot be expressed as a Honeycomb filter",
+		},
+		{
+			name:    "status code equal",
+			matcher: &LabelMatcher{Name: "code", Type: MatchEqual, Value: "200"},
+			want:    []Filter{{Column: "col", Op: "=", Value: 200}},
+		},
+		{
+			name:    "status code not 5xx",
+			matcher: &LabelMatcher{Name: "code", Type: MatchNotRegexp, Value: "5.*"},
+			want:    []Filter{{Column: "col", Op: "<", Value: 500}},
+		},
+		{
+			name:    "status code 5xx",
+			matcher: &LabelMatcher{Name: "code", Type: MatchRegexp, Value: "5.."},
+			want:    []Filter{{Column: "col", Op: ">=", Value: 500}},
+		},
+		{
+			name:    "status code 4xx",
+			matcher: &LabelMatcher{Name: "code", Type: MatchRegexp, Value: "4.."},
+			want: []Filter{
+				{Column: "col", Op: ">=", Value: 400},
+				{Column: "col", Op: "<", Value: 500},
+			},
+		},
+		{
+			name:    "status code 2xx or 3xx",
+			matcher: &LabelMatcher{Name: "code", Type: MatchRegexp, Value: "2..|3.."},
+			want: []Filter{
+				{Column: "col", Op: ">=", Value: 200},
+				{Column: "col", Op: "<", Value: 400},
+			},
+		},
+		{
+			name:    "status code list",
+			matcher: &LabelMatcher{Name: "code", Type: MatchRegexp, Value: "500|503"},
+			want:    []Filter{{Column: "col", Op: "in", Value: []int{500, 503}}},
+		},
+		{
+			name:    "status code except 404",
+			matcher: &LabelMatcher{Name: "code", Type: MatchNotRegexp, Value: "404"},
+			want:    []Filter{{Column: "col", Op: "not-in", Value: []int{404}}},
+		},
+		{
+			name:    "status code absent",
+			matcher: &LabelMatcher{Name: "code", Type: MatchEqual, Value: ""},
+			want:    []Filter{{Column: "col", Op: "does-not-exist"}},
+		},
+		{
+			name:    "status code present",
+			matcher: &LabelMatcher{Name: "code", Type: MatchNotEqual, Value: ""},
+			want:    []Filter{{Column: "col", Op: "exists"}},
+		},
+		{
+			name:    "status code not a number",
+			matcher: &LabelMatcher{Name: "code", Type: MatchEqual, Value: "ok"},
+			wantErr: "is not a number",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := matcherFilters(tt.matcher, "col")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected filters %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
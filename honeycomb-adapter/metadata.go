@@ -0,0 +1,567 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+)
+
+// version is the adapter version reported by /api/v1/status/buildinfo, set
+// at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// labelNameRE matches valid Prometheus label names.
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// honeycombDataset is an entry of the Honeycomb Datasets API.
+type honeycombDataset struct {
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+}
+
+// honeycombColumn is an entry of the Honeycomb Columns API.
+type honeycombColumn struct {
+	KeyName     string `json:"key_name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+	Hidden      bool   `json:"hidden"`
+}
+
+// prometheusMetadata describes a metric in /api/v1/metadata.
+type prometheusMetadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// PrometheusDataResponse is the body of a successful Prometheus API request
+// whose data is not a query result.
+type PrometheusDataResponse struct {
+	Status   string      `json:"status"`
+	Data     interface{} `json:"data"`
+	Warnings []string    `json:"warnings,omitempty"`
+}
+
+// metadataCache caches Honeycomb dataset and column listings, which change
+// rarely but are fetched by every metadata request.
+type metadataCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]metadataEntry
+	group   singleflight.Group
+}
+
+type metadataEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+func newMetadataCache(ttl time.Duration) *metadataCache {
+	return &metadataCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[string]metadataEntry{},
+	}
+}
+
+// do returns the cached value for key, or runs fetch once for all concurrent
+// callers and caches its result. Errors are not cached. Like the query cache,
+// fetch is detached from the first caller's cancellation but keeps its
+// deadline, and each caller returns as soon as its own context is done.
+func (c *metadataCache) do(ctx context.Context, key string, fetch func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && c.now().Before(entry.expires) {
+		return entry.value, nil
+	}
+
+	ch := c.group.DoChan(key, func() (interface{}, error) {
+		fetchCtx := context.WithoutCancel(ctx)
+		if deadline, ok := ctx.Deadline(); ok {
+			var cancel context.CancelFunc
+			fetchCtx, cancel = context.WithDeadline(fetchCtx, deadline)
+			defer cancel()
+		}
+		v, err := fetch(fetchCtx)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		c.entries[key] = metadataEntry{value: v, expires: c.now().Add(c.ttl)}
+		c.mu.Unlock()
+		return v, nil
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		return res.Val, res.Err
+	}
+}
+
+// cachedMetadata runs fetch through the metadata cache, if there is one.
+func (h *HoneycombAdapter) cachedMetadata(ctx context.Context, key string, fetch func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if h.metadataCache == nil {
+		return fetch(ctx)
+	}
+	return h.metadataCache.do(ctx, key, fetch)
+}
+
+// getHoneycomb fetches a Honeycomb API path and decodes the JSON response.
+// Metadata calls do not draw from the query budget, so that label and
+// series lookups cannot starve canary analysis of queries.
+func (h *HoneycombAdapter) getHoneycomb(ctx context.Context, dataset, operation, path string, out interface{}) error {
+	return h.callHoneycombWith(ctx, nil, dataset, operation, func() error {
+		req, err := http.NewRequestWithContext(ctx, "GET", h.honeycombBaseURL+path, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create request: %v", err)
+		}
+		req.Header.Set("X-Honeycomb-Team", h.honeycombAPIKey)
+
+		client := &http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to execute request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			log.Printf("❌ Honeycomb API returned status %d for %s", resp.StatusCode, path)
+			return &HoneycombAPIError{StatusCode: resp.StatusCode, Resource: path, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+		}
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to decode response: %v", err)
+		}
+		return nil
+	})
+}
+
+// listDatasets returns the datasets of the Honeycomb environment.
+func (h *HoneycombAdapter) listDatasets(ctx context.Context) ([]honeycombDataset, error) {
+	v, err := h.cachedMetadata(ctx, "datasets", func(ctx context.Context) (interface{}, error) {
+		var datasets []honeycombDataset
+		if err := h.getHoneycomb(ctx, "", "list_datasets", "/1/datasets", &datasets); err != nil {
+			return nil, err
+		}
+		h.logDebug("Listed %d Honeycomb datasets", len(datasets))
+		return datasets, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]honeycombDataset), nil
+}
+
+// listColumns returns the columns of a Honeycomb dataset.
+func (h *HoneycombAdapter) listColumns(ctx context.Context, dataset string) ([]honeycombColumn, error) {
+	v, err := h.cachedMetadata(ctx, "columns/"+dataset, func(ctx context.Context) (interface{}, error) {
+		var columns []honeycombColumn
+		if err := h.getHoneycomb(ctx, dataset, "list_columns", "/1/columns/"+dataset, &columns); err != nil {
+			return nil, err
+		}
+		h.logDebug("Listed %d columns of dataset %s", len(columns), dataset)
+		return columns, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]honeycombColumn), nil
+}
+
+// metadataDatasets returns the datasets the metadata endpoints read columns
+// from: the datasets of the match[] selectors if any are given, otherwise
+// every dataset the configured strategy can query.
+func (h *HoneycombAdapter) metadataDatasets(ctx context.Context, matches []string) ([]string, error) {
+	var datasets []string
+	add := func(dataset string) {
+		if dataset != "" && dataset != allDatasets && !containsString(datasets, dataset) {
+			datasets = append(datasets, dataset)
+		}
+	}
+
+	if len(matches) > 0 {
+		for _, match := range matches {
+			plan, err := h.translatePromQL(match)
+			if err != nil {
+				return nil, err
+			}
+			leaves, err := h.honeycombLeaves(plan.queries())
+			if err != nil {
+				return nil, err
+			}
+			for _, leaf := range leaves {
+				dataset, _, err := h.leafDataset(leaf)
+				if err != nil {
+					return nil, err
+				}
+				add(dataset)
+			}
+		}
+		return datasets, nil
+	}
+
+	switch r := h.queryDatasetResolver().(type) {
+	case *fixedDatasetResolver:
+		add(r.dataset)
+		return datasets, nil
+	case *lookupDatasetResolver:
+		table := h.metricConfig().Datasets
+		for _, dataset := range sortedValues(table.Services) {
+			add(dataset)
+		}
+		for _, dataset := range sortedValues(table.Namespaces) {
+			add(dataset)
+		}
+		add(table.Default)
+		return datasets, nil
+	}
+
+	all, err := h.listDatasets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range all {
+		add(d.Slug)
+	}
+	return datasets, nil
+}
+
+// columnLabel returns the Prometheus label for a Honeycomb column: the label
+// mapped onto it, or the column name itself when that is a valid label name.
+func (c *mappingConfig) columnLabel(column string) (string, bool) {
+	var mapped []string
+	for label, col := range c.Labels {
+		if col == column {
+			mapped = append(mapped, label)
+		}
+	}
+	if len(mapped) > 0 {
+		sort.Strings(mapped)
+		return mapped[0], true
+	}
+	return column, labelNameRE.MatchString(column)
+}
+
+// metadataConcurrency bounds the column listings fetched at once for a
+// metadata request.
+const metadataConcurrency = 8
+
+// labelNames returns the label names known from the metric mapping and the
+// columns of the datasets. Datasets whose columns cannot be listed are
+// skipped, with a warning for each.
+func (h *HoneycombAdapter) labelNames(ctx context.Context, matches []string) ([]string, []string, error) {
+	config := h.metricConfig()
+	names := map[string]bool{"__name__": true, "service": true, "job": true, roleLabel: true, datasetLabel: true}
+	for label := range config.Labels {
+		names[label] = true
+	}
+	for _, mapping := range config.Metrics {
+		for label := range mapping.Labels {
+			names[label] = true
+		}
+	}
+
+	datasets, err := h.metadataDatasets(ctx, matches)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	columns := make([][]honeycombColumn, len(datasets))
+	errs := make([]error, len(datasets))
+	sem := make(chan struct{}, metadataConcurrency)
+	var wg sync.WaitGroup
+	for i, dataset := range datasets {
+		wg.Add(1)
+		go func(i int, dataset string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			columns[i], errs[i] = h.listColumns(ctx, dataset)
+		}(i, dataset)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var warnings []string
+	for i, dataset := range datasets {
+		if errs[i] != nil {
+			log.Printf("⚠️  Skipping the columns of dataset %s: %v", dataset, errs[i])
+			warnings = append(warnings, fmt.Sprintf("columns of dataset %q are not listed: %v", dataset, errs[i]))
+			continue
+		}
+		for _, column := range columns[i] {
+			if label, ok := config.columnLabel(column.KeyName); ok && !column.Hidden {
+				names[label] = true
+			}
+		}
+	}
+	return sortedKeys(names), warnings, nil
+}
+
+// labelValues returns the values of a label that can be listed without
+// querying event data, and a warning for labels whose values cannot.
+func (h *HoneycombAdapter) labelValues(ctx context.Context, name string) ([]string, string, error) {
+	switch name {
+	case "__name__":
+		names := map[string]bool{}
+		for metric := range h.metricConfig().Metrics {
+			names[metric] = true
+		}
+		return sortedKeys(names), "", nil
+
+	case roleLabel:
+		return []string{roleCanary, rolePrimary}, "", nil
+
+	case "service", "job":
+		if _, ok := h.queryDatasetResolver().(*serviceDatasetResolver); !ok {
+			break
+		}
+		// Each service has a dataset of its own
+		fallthrough
+	case datasetLabel:
+		datasets, err := h.listDatasets(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		values := make([]string, 0, len(datasets))
+		for _, d := range datasets {
+			values = append(values, d.Slug)
+		}
+		sort.Strings(values)
+		return values, "", nil
+	}
+	return []string{}, fmt.Sprintf("values of label %q are not listed, Honeycomb has no API for the values of a column", name), nil
+}
+
+// metricMetadata describes the mapped metrics in Prometheus terms.
+func (h *HoneycombAdapter) metricMetadata(metric string, limit int) map[string][]prometheusMetadata {
+	config := h.metricConfig()
+	names := make([]string, 0, len(config.Metrics))
+	for name := range config.Metrics {
+		if metric == "" || name == metric {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if limit > 0 && len(names) > limit {
+		names = names[:limit]
+	}
+
+	out := make(map[string][]prometheusMetadata, len(names))
+	for _, name := range names {
+		mapping := config.Metrics[name]
+		md := prometheusMetadata{Type: "gauge", Help: fmt.Sprintf("Honeycomb %s", Calculation{Op: mapping.Calculation, Column: mapping.Column}.Alias())}
+		switch mapping.Calculation {
+		case "COUNT":
+			md.Type = "counter"
+			md.Help = "Honeycomb COUNT of events"
+		case histogramCalculation:
+			md.Type = "histogram"
+			md.Help = fmt.Sprintf("Honeycomb percentiles of %s, queried with histogram_quantile()", mapping.Column)
+		}
+		out[name] = []prometheusMetadata{md}
+	}
+	return out
+}
+
+// seriesLabels returns the label set each match[] selector stands for: its
+// metric name and equality matchers. Honeycomb has no series, so this is the
+// shape of the data a query with the selector returns rather than a listing.
+func (h *HoneycombAdapter) seriesLabels(matches []string) ([]map[string]string, error) {
+	config := h.metricConfig()
+	seen := map[string]bool{}
+	out := []map[string]string{}
+	for _, match := range matches {
+		expr, err := ParsePromQL(match)
+		if err != nil {
+			return nil, err
+		}
+		vs, ok := unwrapParens(expr).(*VectorSelector)
+		if !ok {
+			return nil, fmt.Errorf("match[] %q is not a series selector", match)
+		}
+
+		var metrics []string
+		if vs.Name != "" {
+			if _, ok := config.Metrics[vs.Name]; ok {
+				metrics = []string{vs.Name}
+			}
+		} else {
+			for name := range config.Metrics {
+				metrics = append(metrics, name)
+			}
+			sort.Strings(metrics)
+		}
+
+		for _, name := range metrics {
+			labels := map[string]string{"__name__": name}
+			for _, m := range vs.Matchers {
+				if m.Type == MatchEqual && m.Name != "__name__" && m.Value != "" {
+					labels[m.Name] = m.Value
+				}
+			}
+			if sig := name + labelSignature(labels); !seen[sig] {
+				seen[sig] = true
+				out = append(out, labels)
+			}
+		}
+	}
+	return out, nil
+}
+
+func (h *HoneycombAdapter) handleLabels(w http.ResponseWriter, r *http.Request) {
+	ctx, span := h.startMetadataSpan(r, "handleLabels")
+	defer span.End()
+
+	params, err := requestParams(r)
+	if err != nil {
+		writePrometheusError(w, errorBadData, err)
+		return
+	}
+	names, warnings, err := h.labelNames(ctx, params["match[]"])
+	if err != nil {
+		h.writeMetadataError(w, "labels", err)
+		return
+	}
+	writePrometheusResponse(w, &PrometheusDataResponse{Status: "success", Data: names, Warnings: warnings})
+}
+
+func (h *HoneycombAdapter) handleLabelValues(w http.ResponseWriter, r *http.Request) {
+	ctx, span := h.startMetadataSpan(r, "handleLabelValues")
+	defer span.End()
+
+	name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/label/"), "/values")
+	if !ok || !labelNameRE.MatchString(name) {
+		writePrometheusError(w, errorBadData, fmt.Errorf("invalid label name: %q", name))
+		return
+	}
+	span.SetAttributes(attribute.String("label.name", name))
+
+	values, warning, err := h.labelValues(ctx, name)
+	if err != nil {
+		h.writeMetadataError(w, "label values", err)
+		return
+	}
+	response := &PrometheusDataResponse{Status: "success", Data: values}
+	if warning != "" {
+		response.Warnings = []string{warning}
+	}
+	writePrometheusResponse(w, response)
+}
+
+func (h *HoneycombAdapter) handleSeries(w http.ResponseWriter, r *http.Request) {
+	_, span := h.startMetadataSpan(r, "handleSeries")
+	defer span.End()
+
+	params, err := requestParams(r)
+	if err != nil {
+		writePrometheusError(w, errorBadData, err)
+		return
+	}
+	matches := params["match[]"]
+	if len(matches) == 0 {
+		writePrometheusError(w, errorBadData, errors.New("no match[] parameter provided"))
+		return
+	}
+	series, err := h.seriesLabels(matches)
+	if err != nil {
+		writePrometheusError(w, errorBadData, err)
+		return
+	}
+	writePrometheusResponse(w, &PrometheusDataResponse{Status: "success", Data: series})
+}
+
+func (h *HoneycombAdapter) handleMetadata(w http.ResponseWriter, r *http.Request) {
+	_, span := h.startMetadataSpan(r, "handleMetadata")
+	defer span.End()
+
+	params, err := requestParams(r)
+	if err != nil {
+		writePrometheusError(w, errorBadData, err)
+		return
+	}
+	limit := 0
+	if s := params.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil {
+			writePrometheusError(w, errorBadData, fmt.Errorf("invalid parameter \"limit\": %v", err))
+			return
+		}
+	}
+	writePrometheusResponse(w, &PrometheusDataResponse{Status: "success", Data: h.metricMetadata(params.Get("metric"), limit)})
+}
+
+func (h *HoneycombAdapter) handleBuildInfo(w http.ResponseWriter, r *http.Request) {
+	info := map[string]string{
+		"version":   version,
+		"revision":  "",
+		"branch":    "",
+		"buildUser": "",
+		"buildDate": "",
+		"goVersion": runtime.Version(),
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range build.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				info["revision"] = s.Value
+			case "vcs.time":
+				info["buildDate"] = s.Value
+			}
+		}
+	}
+	writePrometheusResponse(w, &PrometheusDataResponse{Status: "success", Data: info})
+}
+
+// startMetadataSpan starts the span of a metadata request.
+func (h *HoneycombAdapter) startMetadataSpan(r *http.Request, name string) (context.Context, trace.Span) {
+	h.ensureTelemetry()
+	log.Printf("🔍 Received metadata request: %s", r.URL.RequestURI())
+	ctx, span := h.tracer.Start(r.Context(), name)
+	span.SetAttributes(attribute.String("http.target", r.URL.RequestURI()))
+	return ctx, span
+}
+
+// writeMetadataError reports a failed metadata lookup.
+func (h *HoneycombAdapter) writeMetadataError(w http.ResponseWriter, what string, err error) {
+	log.Printf("❌ Failed to list %s: %v", what, err)
+	h.logError("Failed to list %s: %v", what, err)
+	writePrometheusError(w, classifyError(err), err)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedValues(m map[string]string) []string {
+	values := make([]string, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return values
+}
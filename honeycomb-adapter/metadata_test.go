@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newMetadataServer serves the Honeycomb Datasets and Columns APIs and counts
+// the requests it receives.
+func newMetadataServer(t *testing.T, requests *int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		switch r.URL.Path {
+		case "/1/datasets":
+			json.NewEncoder(w).Encode([]honeycombDataset{
+				{Name: "Checkout", Slug: "checkout"},
+				{Name: "Podinfo", Slug: "podinfo"},
+			})
+		case "/1/columns/checkout":
+			json.NewEncoder(w).Encode([]honeycombColumn{
+				{KeyName: "http.route"},
+				{KeyName: "cart_size"},
+				{KeyName: "trace.trace_id"},
+				{KeyName: "internal", Hidden: true},
+			})
+		case "/1/columns/podinfo":
+			json.NewEncoder(w).Encode([]honeycombColumn{{KeyName: "region"}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// getMetadata calls a metadata handler and decodes the response.
+func getMetadata(t *testing.T, handler http.HandlerFunc, target string) (int, PrometheusDataResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+
+	var response PrometheusDataResponse
+	if rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code, response
+}
+
+func TestHandleLabels(t *testing.T) {
+	var requests int32
+	server := newMetadataServer(t, &requests)
+	adapter := &HoneycombAdapter{
+		honeycombAPIKey:  "test-key",
+		honeycombBaseURL: server.URL,
+		queryTimeWindow:  3 * time.Minute,
+		metadataCache:    newMetadataCache(time.Minute),
+	}
+
+	code, response := getMetadata(t, adapter.handleLabels, "/api/v1/labels")
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	expected := []interface{}{"__name__", "cart_size", "code", "dataset", "deployment", "job", "method", "namespace", "region", "role", "route", "service"}
+	if !reflect.DeepEqual(response.Data, expected) {
+		t.Errorf("expected labels %v, got %v", expected, response.Data)
+	}
+
+	// Listings are cached
+	before := atomic.LoadInt32(&requests)
+	getMetadata(t, adapter.handleLabels, "/api/v1/labels")
+	if after := atomic.LoadInt32(&requests); after != before {
+		t.Errorf("expected cached listings, got %d more Honeycomb requests", after-before)
+	}
+
+	// match[] restricts the columns to the selector's dataset
+	query := url.Values{"match[]": {`http_requests_total{service="podinfo"}`}}
+	_, response = getMetadata(t, adapter.handleLabels, "/api/v1/labels?"+query.Encode())
+	labels := response.Data.([]interface{})
+	if containsLabel(labels, "cart_size") || !containsLabel(labels, "region") {
+		t.Errorf("expected the podinfo columns only, got %v", labels)
+	}
+}
+
+func TestHandleLabelsSkipsFailingDatasets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/1/datasets":
+			json.NewEncoder(w).Encode([]honeycombDataset{
+				{Name: "Checkout", Slug: "checkout"},
+				{Name: "Broken", Slug: "broken"},
+			})
+		case "/1/columns/checkout":
+			json.NewEncoder(w).Encode([]honeycombColumn{{KeyName: "cart_size"}})
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	adapter := &HoneycombAdapter{
+		honeycombAPIKey:  "test-key",
+		honeycombBaseURL: server.URL,
+		queryTimeWindow:  3 * time.Minute,
+		retry:            retryConfig{MaxAttempts: 1},
+	}
+	adapter.ensureTelemetry()
+
+	code, response := getMetadata(t, adapter.handleLabels, "/api/v1/labels")
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if !containsLabel(response.Data.([]interface{}), "cart_size") {
+		t.Errorf("expected the checkout columns, got %v", response.Data)
+	}
+	if len(response.Warnings) != 1 || !strings.Contains(response.Warnings[0], `"broken"`) {
+		t.Errorf("expected a warning about the broken dataset, got %v", response.Warnings)
+	}
+}
+
+func TestHandleLabelsOutsideQueryBudget(t *testing.T) {
+	var requests int32
+	server := newMetadataServer(t, &requests)
+	adapter := &HoneycombAdapter{
+		honeycombAPIKey:  "test-key",
+		honeycombBaseURL: server.URL,
+		queryTimeWindow:  3 * time.Minute,
+		rateLimiter:      newRateLimiter(rateLimitConfig{PerHour: 1, Burst: 1}),
+	}
+	adapter.ensureTelemetry()
+
+	if code, _ := getMetadata(t, adapter.handleLabels, "/api/v1/labels"); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if err := adapter.rateLimiter.wait(context.Background(), "podinfo"); err != nil {
+		t.Errorf("expected metadata calls to leave the query budget untouched, got %v", err)
+	}
+}
+
+func containsLabel(labels []interface{}, name string) bool {
+	for _, label := range labels {
+		if label == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHandleLabelValues(t *testing.T) {
+	var requests int32
+	server := newMetadataServer(t, &requests)
+	adapter := &HoneycombAdapter{
+		honeycombAPIKey:  "test-key",
+		honeycombBaseURL: server.URL,
+		queryTimeWindow:  3 * time.Minute,
+	}
+
+	tests := []struct {
+		path        string
+		wantCode    int
+		wantValues  []interface{}
+		wantWarning string
+	}{
+		{
+			path:       "/api/v1/label/__name__/values",
+			wantCode:   http.StatusOK,
+			wantValues: []interface{}{"http_request_duration_seconds_bucket", "http_requests_total"},
+		},
+		{
+			path:       "/api/v1/label/service/values",
+			wantCode:   http.StatusOK,
+			wantValues: []interface{}{"checkout", "podinfo"},
+		},
+		{
+			path:       "/api/v1/label/role/values",
+			wantCode:   http.StatusOK,
+			wantValues: []interface{}{"canary", "primary"},
+		},
+		{
+			path:        "/api/v1/label/route/values",
+			wantCode:    http.StatusOK,
+			wantValues:  []interface{}{},
+			wantWarning: `values of label "route" are not listed`,
+		},
+		{
+			path:     "/api/v1/label/http.route/values",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			code, response := getMetadata(t, adapter.handleLabelValues, tt.path)
+			if code != tt.wantCode {
+				t.Fatalf("expected status %d, got %d", tt.wantCode, code)
+			}
+			if code != http.StatusOK {
+				return
+			}
+			if !reflect.DeepEqual(response.Data, tt.wantValues) {
+				t.Errorf("expected values %v, got %v", tt.wantValues, response.Data)
+			}
+			warnings := strings.Join(response.Warnings, "\n")
+			if tt.wantWarning == "" && warnings != "" || !strings.Contains(warnings, tt.wantWarning) {
+				t.Errorf("expected warning %q, got %q", tt.wantWarning, warnings)
+			}
+		})
+	}
+}
+
+func TestHandleSeries(t *testing.T) {
+	adapter := &HoneycombAdapter{queryTimeWindow: 3 * time.Minute}
+
+	query := url.Values{"match[]": {
+		`http_requests_total{service="podinfo", code=~"5.."}`,
+		`http_requests_total{service="podinfo"}`,
+		`unknown_metric`,
+	}}
+	code, response := getMetadata(t, adapter.handleSeries, "/api/v1/series?"+query.Encode())
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	expected := []interface{}{map[string]interface{}{"__name__": "http_requests_total", "service": "podinfo"}}
+	if !reflect.DeepEqual(response.Data, expected) {
+		t.Errorf("expected series %v, got %v", expected, response.Data)
+	}
+
+	if code, _ := getMetadata(t, adapter.handleSeries, "/api/v1/series"); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 without match[], got %d", code)
+	}
+	query = url.Values{"match[]": {`sum(http_requests_total)`}}
+	if code, _ := getMetadata(t, adapter.handleSeries, "/api/v1/series?"+query.Encode()); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an expression, got %d", code)
+	}
+}
+
+func TestHandleMetadata(t *testing.T) {
+	adapter := &HoneycombAdapter{queryTimeWindow: 3 * time.Minute}
+
+	code, response := getMetadata(t, adapter.handleMetadata, "/api/v1/metadata")
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	metadata := response.Data.(map[string]interface{})
+	counter := metadata["http_requests_total"].([]interface{})[0].(map[string]interface{})
+	if counter["type"] != "counter" {
+		t.Errorf("expected http_requests_total to be a counter, got %v", counter)
+	}
+	histogram := metadata["http_request_duration_seconds_bucket"].([]interface{})[0].(map[string]interface{})
+	if histogram["type"] != "histogram" {
+		t.Errorf("expected the bucket metric to be a histogram, got %v", histogram)
+	}
+
+	_, response = getMetadata(t, adapter.handleMetadata, "/api/v1/metadata?limit=1")
+	if n := len(response.Data.(map[string]interface{})); n != 1 {
+		t.Errorf("expected 1 metric with limit=1, got %d", n)
+	}
+}
+
+func TestHandleBuildInfo(t *testing.T) {
+	adapter := &HoneycombAdapter{}
+	code, response := getMetadata(t, adapter.handleBuildInfo, "/api/v1/status/buildinfo")
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	info := response.Data.(map[string]interface{})
+	if info["version"] != version || !strings.HasPrefix(info["goVersion"].(string), "go") {
+		t.Errorf("unexpected build info %v", info)
+	}
+}
+
+func TestMetadataCacheCallerCancellation(t *testing.T) {
+	cache := newMetadataCache(time.Minute)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) (interface{}, error) {
+		close(started)
+		<-release
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return []honeycombDataset{{Slug: "checkout"}}, nil
+	}
+
+	// The first caller gives up while a second one waits on its fetch
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := cache.do(ctx, "datasets", fetch)
+		first <- err
+	}()
+	<-started
+	second := make(chan error, 1)
+	go func() {
+		v, err := cache.do(context.Background(), "datasets", fetch)
+		if err == nil && len(v.([]honeycombDataset)) != 1 {
+			err = fmt.Errorf("unexpected datasets %v", v)
+		}
+		second <- err
+	}()
+	// Let the second caller join the in-flight fetch
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	close(release)
+	if err := <-second; err != nil {
+		t.Errorf("expected the waiting caller to get the datasets, got %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// requestParams returns the parameters of a Prometheus API request. Like the
+// Prometheus HTTP API, POST requests may send them form-encoded in the body,
+// which clients use for queries too long for a URL; body values take
+// precedence over the URL's.
+func requestParams(r *http.Request) (url.Values, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, fmt.Errorf("error parsing form values: %v", err)
+	}
+	return r.Form, nil
+}
+
+// withTimeoutParam bounds ctx by the request's timeout parameter, given as
+// float seconds or a Prometheus duration. Without the parameter ctx is
+// returned unchanged.
+func withTimeoutParam(ctx context.Context, s string) (context.Context, context.CancelFunc, error) {
+	if s == "" {
+		return ctx, func() {}, nil
+	}
+	timeout, err := parseDurationParam(s)
+	if err != nil {
+		return ctx, func() {}, fmt.Errorf("invalid parameter \"timeout\": %v", err)
+	}
+	if timeout <= 0 {
+		return ctx, func() {}, fmt.Errorf("invalid parameter \"timeout\": timeout must be positive")
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, cancel, nil
+}
+
+// parseDurationParam parses a duration given as float seconds or a Prometheus
+// duration.
+func parseDurationParam(s string) (time.Duration, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+		}
+		if math.Abs(f) > float64(math.MaxInt64)/float64(time.Second) {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration. It overflows int64", s)
+		}
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	if d, err := parseDuration(s); err == nil {
+		return d, nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
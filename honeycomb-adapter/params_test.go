@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// deadlineBackend records the deadline of the context it is queried with and
+// blocks until that context is done.
+type deadlineBackend struct {
+	deadline    time.Time
+	hasDeadline bool
+}
+
+func (b *deadlineBackend) Instant(ctx context.Context, queries []*LeafQuery, at time.Time) ([]Vector, error) {
+	b.deadline, b.hasDeadline = ctx.Deadline()
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (b *deadlineBackend) Range(ctx context.Context, queries []*LeafQuery, rng RangeParams) ([]Matrix, error) {
+	b.deadline, b.hasDeadline = ctx.Deadline()
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestPostFormQueries(t *testing.T) {
+	adapter := &HoneycombAdapter{
+		queryTimeWindow: 3 * time.Minute,
+		backend: &staticBackend{values: map[string]Vector{
+			"http_requests_total": {{Metric: map[string]string{}, Value: 42}},
+		}},
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		path    string
+		params  url.Values
+	}{
+		{
+			name:    "instant query",
+			handler: adapter.handleQuery,
+			path:    "/api/v1/query",
+			params:  url.Values{"query": {`sum(increase(http_requests_total{service="test"}[5m]))`}, "time": {"1700000000"}},
+		},
+		{
+			name:    "range query",
+			handler: adapter.handleQueryRange,
+			path:    "/api/v1/query_range",
+			params: url.Values{
+				"query": {`sum(rate(http_requests_total{service="test"}[5m]))`},
+				"start": {"1700000000"},
+				"end":   {"1700000060"},
+				"step":  {"60"},
+			},
+		},
+		{
+			name:    "series",
+			handler: adapter.handleSeries,
+			path:    "/api/v1/series",
+			params:  url.Values{"match[]": {`http_requests_total{service="test"}`}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			get := httptest.NewRecorder()
+			tt.handler(get, httptest.NewRequest(http.MethodGet, tt.path+"?"+tt.params.Encode(), nil))
+
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.params.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			post := httptest.NewRecorder()
+			tt.handler(post, req)
+
+			if get.Code != http.StatusOK || post.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got GET %d and POST %d: %s", get.Code, post.Code, post.Body.String())
+			}
+			if get.Body.String() != post.Body.String() {
+				t.Errorf("expected identical responses, got GET %s and POST %s", get.Body.String(), post.Body.String())
+			}
+		})
+	}
+}
+
+func TestTimeoutParam(t *testing.T) {
+	query := `sum(rate(http_requests_total{service="test"}[5m]))`
+
+	tests := []struct {
+		name         string
+		timeout      string
+		wantStatus   int
+		wantDeadline time.Duration
+	}{
+		{name: "seconds", timeout: "0.05", wantStatus: http.StatusServiceUnavailable, wantDeadline: 50 * time.Millisecond},
+		{name: "duration", timeout: "50ms", wantStatus: http.StatusServiceUnavailable, wantDeadline: 50 * time.Millisecond},
+		{name: "invalid", timeout: "soon", wantStatus: http.StatusBadRequest},
+		{name: "zero", timeout: "0", wantStatus: http.StatusBadRequest},
+		{name: "infinite", timeout: "Inf", wantStatus: http.StatusBadRequest},
+		{name: "not a number", timeout: "NaN", wantStatus: http.StatusBadRequest},
+		{name: "overflow", timeout: "1e300", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &deadlineBackend{}
+			adapter := &HoneycombAdapter{queryTimeWindow: 3 * time.Minute, backend: backend}
+
+			params := url.Values{"query": {query}, "timeout": {tt.timeout}}
+			rec := httptest.NewRecorder()
+			start := time.Now()
+			adapter.handleQuery(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?"+params.Encode(), nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+			if tt.wantDeadline == 0 {
+				return
+			}
+			if d := backend.deadline.Sub(start); !backend.hasDeadline || d < tt.wantDeadline || d > tt.wantDeadline+time.Second {
+				t.Errorf("expected a deadline %v after the request, got %v", tt.wantDeadline, d)
+			}
+			if !strings.Contains(rec.Body.String(), errorTimeout) {
+				t.Errorf("expected a %s error, got %s", errorTimeout, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+)
+
+// pollConfig controls how the adapter polls Honeycomb for query results that
+// are still running.
+type pollConfig struct {
+	// InitialDelay is the wait before the second poll.
+	InitialDelay time.Duration
+	// BackoffFactor multiplies the delay after every poll.
+	BackoffFactor float64
+	// MaxDelay caps the delay between polls.
+	MaxDelay time.Duration
+	// MaxAttempts is the largest number of polls for one query result.
+	MaxAttempts int
+	// Deadline bounds the total time spent polling one query result.
+	Deadline time.Duration
+}
+
+// defaultPollConfig keeps the total polling time close to the previous
+// 10 attempts 3 seconds apart, but returns fast queries sooner.
+var defaultPollConfig = pollConfig{
+	InitialDelay:  500 * time.Millisecond,
+	BackoffFactor: 1.5,
+	MaxDelay:      5 * time.Second,
+	MaxAttempts:   10,
+	Deadline:      30 * time.Second,
+}
+
+// loadPollConfig reads the poll settings from the environment, falling back
+// to the defaults for missing or invalid values.
+func loadPollConfig() pollConfig {
+	cfg := defaultPollConfig
+	cfg.InitialDelay = envDuration("HONEYCOMB_POLL_INITIAL_DELAY", cfg.InitialDelay)
+	cfg.MaxDelay = envDuration("HONEYCOMB_POLL_MAX_DELAY", cfg.MaxDelay)
+	cfg.Deadline = envDuration("HONEYCOMB_POLL_DEADLINE", cfg.Deadline)
+
+	if s := getEnv("HONEYCOMB_POLL_BACKOFF_FACTOR", ""); s != "" {
+		if f, err := strconv.ParseFloat(s, 64); err == nil && f >= 1 {
+			cfg.BackoffFactor = f
+		} else {
+			log.Printf("❌ Invalid HONEYCOMB_POLL_BACKOFF_FACTOR value '%s', using default %v", s, cfg.BackoffFactor)
+		}
+	}
+	if s := getEnv("HONEYCOMB_POLL_MAX_ATTEMPTS", ""); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			cfg.MaxAttempts = n
+		} else {
+			log.Printf("❌ Invalid HONEYCOMB_POLL_MAX_ATTEMPTS value '%s', using default %d", s, cfg.MaxAttempts)
+		}
+	}
+	return cfg
+}
+
+// envDuration reads a positive duration from the environment.
+func envDuration(key string, defaultValue time.Duration) time.Duration {
+	s := getEnv(key, "")
+	if s == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		log.Printf("❌ Invalid %s value '%s', using default %s", key, s, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
+// delay returns the wait after the given poll attempt (1-based).
+func (c pollConfig) delay(attempt int) time.Duration {
+	d := float64(c.InitialDelay)
+	for i := 1; i < attempt; i++ {
+		d *= c.BackoffFactor
+		if d >= float64(c.MaxDelay) {
+			return c.MaxDelay
+		}
+	}
+	return time.Duration(d)
+}
+
+// sleepContext waits for d or until ctx is done, whichever comes first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// pollSettings returns the adapter's poll configuration, defaulting unset
+// fields.
+func (h *HoneycombAdapter) pollSettings() pollConfig {
+	cfg := h.poll
+	if cfg.InitialDelay <= 0 {
+		cfg.InitialDelay = defaultPollConfig.InitialDelay
+	}
+	if cfg.BackoffFactor < 1 {
+		cfg.BackoffFactor = defaultPollConfig.BackoffFactor
+	}
+	if cfg.MaxDelay <= 0 {
+		cfg.MaxDelay = defaultPollConfig.MaxDelay
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultPollConfig.MaxAttempts
+	}
+	if cfg.Deadline <= 0 {
+		cfg.Deadline = defaultPollConfig.Deadline
+	}
+	return cfg
+}
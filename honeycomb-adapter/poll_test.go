@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPollConfigDelay(t *testing.T) {
+	cfg := pollConfig{InitialDelay: time.Second, BackoffFactor: 2, MaxDelay: 5 * time.Second}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, want := range expected {
+		if got := cfg.delay(i + 1); got != want {
+			t.Errorf("attempt %d: expected delay %s, got %s", i+1, want, got)
+		}
+	}
+}
+
+func TestLoadPollConfig(t *testing.T) {
+	t.Setenv("HONEYCOMB_POLL_INITIAL_DELAY", "250ms")
+	t.Setenv("HONEYCOMB_POLL_BACKOFF_FACTOR", "3")
+	t.Setenv("HONEYCOMB_POLL_MAX_ATTEMPTS", "not-a-number")
+	t.Setenv("HONEYCOMB_POLL_DEADLINE", "1m")
+
+	cfg := loadPollConfig()
+	if cfg.InitialDelay != 250*time.Millisecond || cfg.BackoffFactor != 3 || cfg.Deadline != time.Minute {
+		t.Errorf("unexpected poll config %+v", cfg)
+	}
+	if cfg.MaxAttempts != defaultPollConfig.MaxAttempts {
+		t.Errorf("expected invalid max attempts to fall back to %d, got %d", defaultPollConfig.MaxAttempts, cfg.MaxAttempts)
+	}
+}
+
+// runningQueryServer is a Honeycomb API whose query results never complete.
+func runningQueryServer(polls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		atomic.AddInt32(polls, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": "result-1", "complete": false})
+	}))
+}
+
+func TestGetQueryResultsByLocationStops(t *testing.T) {
+	tests := []struct {
+		name     string
+		poll     pollConfig
+		timeout  time.Duration
+		wantErr  string
+		maxPolls int32
+	}{
+		{
+			name:     "request cancelled",
+			poll:     pollConfig{InitialDelay: time.Hour, Deadline: time.Hour},
+			timeout:  100 * time.Millisecond,
+			wantErr:  "context deadline exceeded",
+			maxPolls: 1,
+		},
+		{
+			name:     "overall deadline",
+			poll:     pollConfig{InitialDelay: time.Hour, Deadline: 100 * time.Millisecond},
+			timeout:  time.Hour,
+			wantErr:  "context deadline exceeded",
+			maxPolls: 1,
+		},
+		{
+			name:     "max attempts",
+			poll:     pollConfig{InitialDelay: time.Millisecond, MaxAttempts: 3, Deadline: time.Hour},
+			timeout:  time.Hour,
+			wantErr:  "did not complete after 3 attempts",
+			maxPolls: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var polls int32
+			mockServer := runningQueryServer(&polls)
+			defer mockServer.Close()
+
+			adapter := &HoneycombAdapter{
+				honeycombAPIKey:  "test-key",
+				honeycombBaseURL: mockServer.URL,
+				poll:             tt.poll,
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+
+			start := time.Now()
+			_, err := adapter.getQueryResultsByLocation(ctx, "test", "/1/query_results/test/result-1")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("expected polling to stop promptly, took %s", elapsed)
+			}
+			if polls > tt.maxPolls {
+				t.Errorf("expected at most %d polls, got %d", tt.maxPolls, polls)
+			}
+			if tt.wantErr == "context deadline exceeded" && !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("expected error to wrap context.DeadlineExceeded, got %v", err)
+			}
+		})
+	}
+}
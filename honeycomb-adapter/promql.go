@@ -0,0 +1,1406 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// This file contains a self-contained PromQL lexer and recursive-descent parser.
+// It produces an AST that the translator walks to build Honeycomb queries, and
+// reports syntax errors with the line/column they occurred at so they can be
+// surfaced to Flagger verbatim.
+
+// ValueType is the type an expression evaluates to.
+type ValueType string
+
+const (
+	ValueTypeNone   ValueType = "none"
+	ValueTypeScalar ValueType = "scalar"
+	ValueTypeVector ValueType = "instant vector"
+	ValueTypeMatrix ValueType = "range vector"
+	ValueTypeString ValueType = "string"
+)
+
+// PositionRange is a half-open byte range within the original query string.
+type PositionRange struct {
+	Start int
+	End   int
+}
+
+// lineCol returns the 1-based line and column of the start of the range.
+func (p PositionRange) lineCol(query string) (int, int) {
+	line, col := 1, 1
+	for i, r := range query {
+		if i >= p.Start {
+			break
+		}
+		if r == '\n' {
+			line++
+			col = 1
+			continue
+		}
+		col++
+	}
+	return line, col
+}
+
+// describe formats the position as "line:col" for error messages.
+func (p PositionRange) describe(query string) string {
+	line, col := p.lineCol(query)
+	return fmt.Sprintf("%d:%d", line, col)
+}
+
+// ParseError is returned when a PromQL expression is not syntactically valid.
+type ParseError struct {
+	Pos   PositionRange
+	Query string
+	Err   string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s: parse error: %s", e.Pos.describe(e.Query), e.Err)
+}
+
+// Expr is a node of the PromQL abstract syntax tree.
+type Expr interface {
+	Type() ValueType
+	PositionRange() PositionRange
+	String() string
+}
+
+// NumberLiteral is a scalar constant such as 0.95 or 100.
+type NumberLiteral struct {
+	Val float64
+	Pos PositionRange
+}
+
+// StringLiteral is a quoted string constant.
+type StringLiteral struct {
+	Val string
+	Pos PositionRange
+}
+
+// MatchType is the operator of a label matcher.
+type MatchType string
+
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+// LabelMatcher is a single `label op "value"` clause inside a selector.
+type LabelMatcher struct {
+	Name  string
+	Type  MatchType
+	Value string
+	Pos   PositionRange
+}
+
+func (m *LabelMatcher) String() string {
+	return fmt.Sprintf("%s%s%q", m.Name, m.Type, m.Value)
+}
+
+// AtModifier is the value of an `@` modifier: a fixed timestamp or one of the
+// start()/end() preprocessors.
+type AtModifier struct {
+	Timestamp float64
+	Start     bool
+	End       bool
+}
+
+func (a *AtModifier) String() string {
+	switch {
+	case a.Start:
+		return "@ start()"
+	case a.End:
+		return "@ end()"
+	default:
+		return fmt.Sprintf("@ %.3f", a.Timestamp)
+	}
+}
+
+// VectorSelector selects an instant vector, e.g. http_requests_total{code="200"}.
+type VectorSelector struct {
+	Name     string
+	Matchers []*LabelMatcher
+	Offset   time.Duration
+	At       *AtModifier
+	Pos      PositionRange
+}
+
+// MatrixSelector selects a range vector, e.g. http_requests_total[5m].
+type MatrixSelector struct {
+	VectorSelector *VectorSelector
+	Range          time.Duration
+	Pos            PositionRange
+}
+
+// SubqueryExpr evaluates an instant expression over a range, e.g. expr[5m:30s].
+type SubqueryExpr struct {
+	Expr   Expr
+	Range  time.Duration
+	Step   time.Duration
+	Offset time.Duration
+	At     *AtModifier
+	Pos    PositionRange
+}
+
+// AggregateExpr is an aggregation such as sum by (service) (expr).
+type AggregateExpr struct {
+	Op       string
+	Expr     Expr
+	Param    Expr
+	Grouping []string
+	Without  bool
+	Pos      PositionRange
+}
+
+// VectorMatching describes on()/ignoring() and group_left/group_right modifiers.
+type VectorMatching struct {
+	On         bool
+	Labels     []string
+	GroupLeft  bool
+	GroupRight bool
+	Include    []string
+}
+
+// BinaryExpr is a binary operation between two expressions.
+type BinaryExpr struct {
+	Op             string
+	LHS            Expr
+	RHS            Expr
+	ReturnBool     bool
+	VectorMatching *VectorMatching
+	Pos            PositionRange
+}
+
+// UnaryExpr is a unary plus or minus.
+type UnaryExpr struct {
+	Op   string
+	Expr Expr
+	Pos  PositionRange
+}
+
+// ParenExpr is a parenthesised expression.
+type ParenExpr struct {
+	Expr Expr
+	Pos  PositionRange
+}
+
+// Call is a function call such as rate(x[5m]).
+type Call struct {
+	Func *Function
+	Args []Expr
+	Pos  PositionRange
+}
+
+func (e *NumberLiteral) Type() ValueType  { return ValueTypeScalar }
+func (e *StringLiteral) Type() ValueType  { return ValueTypeString }
+func (e *VectorSelector) Type() ValueType { return ValueTypeVector }
+func (e *MatrixSelector) Type() ValueType { return ValueTypeMatrix }
+func (e *SubqueryExpr) Type() ValueType   { return ValueTypeMatrix }
+func (e *AggregateExpr) Type() ValueType  { return ValueTypeVector }
+func (e *UnaryExpr) Type() ValueType      { return e.Expr.Type() }
+func (e *ParenExpr) Type() ValueType      { return e.Expr.Type() }
+func (e *Call) Type() ValueType           { return e.Func.ReturnType }
+
+func (e *BinaryExpr) Type() ValueType {
+	if e.LHS.Type() == ValueTypeScalar && e.RHS.Type() == ValueTypeScalar {
+		return ValueTypeScalar
+	}
+	return ValueTypeVector
+}
+
+func (e *NumberLiteral) PositionRange() PositionRange  { return e.Pos }
+func (e *StringLiteral) PositionRange() PositionRange  { return e.Pos }
+func (e *VectorSelector) PositionRange() PositionRange { return e.Pos }
+func (e *MatrixSelector) PositionRange() PositionRange { return e.Pos }
+func (e *SubqueryExpr) PositionRange() PositionRange   { return e.Pos }
+func (e *AggregateExpr) PositionRange() PositionRange  { return e.Pos }
+func (e *BinaryExpr) PositionRange() PositionRange     { return e.Pos }
+func (e *UnaryExpr) PositionRange() PositionRange      { return e.Pos }
+func (e *ParenExpr) PositionRange() PositionRange      { return e.Pos }
+func (e *Call) PositionRange() PositionRange           { return e.Pos }
+
+func (e *NumberLiteral) String() string {
+	switch {
+	case math.IsInf(e.Val, 1):
+		return "+Inf"
+	case math.IsInf(e.Val, -1):
+		return "-Inf"
+	case math.IsNaN(e.Val):
+		return "NaN"
+	}
+	return strconv.FormatFloat(e.Val, 'f', -1, 64)
+}
+
+func (e *StringLiteral) String() string { return strconv.Quote(e.Val) }
+
+func (e *VectorSelector) String() string {
+	var b strings.Builder
+	b.WriteString(e.Name)
+	if len(e.Matchers) > 0 {
+		parts := make([]string, 0, len(e.Matchers))
+		for _, m := range e.Matchers {
+			parts = append(parts, m.String())
+		}
+		b.WriteString("{" + strings.Join(parts, ", ") + "}")
+	} else if e.Name == "" {
+		b.WriteString("{}")
+	}
+	b.WriteString(modifierString(e.Offset, e.At))
+	return b.String()
+}
+
+func (e *MatrixSelector) String() string {
+	vs := *e.VectorSelector
+	vs.Offset, vs.At = 0, nil
+	return fmt.Sprintf("%s[%s]%s", vs.String(), formatDuration(e.Range), modifierString(e.VectorSelector.Offset, e.VectorSelector.At))
+}
+
+func (e *SubqueryExpr) String() string {
+	step := ""
+	if e.Step > 0 {
+		step = formatDuration(e.Step)
+	}
+	return fmt.Sprintf("%s[%s:%s]%s", e.Expr, formatDuration(e.Range), step, modifierString(e.Offset, e.At))
+}
+
+func (e *AggregateExpr) String() string {
+	var b strings.Builder
+	b.WriteString(e.Op)
+	if len(e.Grouping) > 0 || e.Without {
+		if e.Without {
+			b.WriteString(" without ")
+		} else {
+			b.WriteString(" by ")
+		}
+		b.WriteString("(" + strings.Join(e.Grouping, ", ") + ") ")
+	}
+	b.WriteString("(")
+	if e.Param != nil {
+		b.WriteString(e.Param.String() + ", ")
+	}
+	b.WriteString(e.Expr.String() + ")")
+	return b.String()
+}
+
+func (e *BinaryExpr) String() string {
+	op := e.Op
+	if e.ReturnBool {
+		op += " bool"
+	}
+	if vm := e.VectorMatching; vm != nil {
+		if vm.On || len(vm.Labels) > 0 {
+			kw := "ignoring"
+			if vm.On {
+				kw = "on"
+			}
+			op += fmt.Sprintf(" %s(%s)", kw, strings.Join(vm.Labels, ", "))
+		}
+		if vm.GroupLeft {
+			op += fmt.Sprintf(" group_left(%s)", strings.Join(vm.Include, ", "))
+		} else if vm.GroupRight {
+			op += fmt.Sprintf(" group_right(%s)", strings.Join(vm.Include, ", "))
+		}
+	}
+	return fmt.Sprintf("%s %s %s", e.LHS, op, e.RHS)
+}
+
+func (e *UnaryExpr) String() string { return e.Op + e.Expr.String() }
+func (e *ParenExpr) String() string { return "(" + e.Expr.String() + ")" }
+
+func (e *Call) String() string {
+	args := make([]string, 0, len(e.Args))
+	for _, a := range e.Args {
+		args = append(args, a.String())
+	}
+	return fmt.Sprintf("%s(%s)", e.Func.Name, strings.Join(args, ", "))
+}
+
+func modifierString(offset time.Duration, at *AtModifier) string {
+	s := ""
+	if offset > 0 {
+		s += " offset " + formatDuration(offset)
+	} else if offset < 0 {
+		s += " offset -" + formatDuration(-offset)
+	}
+	if at != nil {
+		s += " " + at.String()
+	}
+	return s
+}
+
+// Function describes the signature of a PromQL function.
+type Function struct {
+	Name       string
+	ArgTypes   []ValueType
+	Variadic   int // number of trailing optional arguments, -1 for unlimited
+	ReturnType ValueType
+}
+
+var promQLFunctions = map[string]*Function{}
+
+func init() {
+	v, m, s, str := ValueTypeVector, ValueTypeMatrix, ValueTypeScalar, ValueTypeString
+	define := func(name string, ret ValueType, variadic int, args ...ValueType) {
+		promQLFunctions[name] = &Function{Name: name, ArgTypes: args, Variadic: variadic, ReturnType: ret}
+	}
+
+	for _, name := range []string{"abs", "ceil", "exp", "floor", "ln", "log2", "log10", "sgn", "sqrt",
+		"sin", "cos", "tan", "asin", "acos", "atan", "sinh", "cosh", "tanh", "asinh", "acosh", "atanh",
+		"deg", "rad", "sort", "sort_desc", "absent", "timestamp"} {
+		define(name, v, 0, v)
+	}
+	for _, name := range []string{"rate", "irate", "increase", "delta", "idelta", "deriv", "changes", "resets",
+		"sum_over_time", "avg_over_time", "min_over_time", "max_over_time", "count_over_time",
+		"stddev_over_time", "stdvar_over_time", "last_over_time", "present_over_time", "absent_over_time"} {
+		define(name, v, 0, m)
+	}
+	for _, name := range []string{"day_of_month", "day_of_week", "day_of_year", "days_in_month",
+		"hour", "minute", "month", "year"} {
+		define(name, v, 1, v)
+	}
+
+	define("clamp", v, 0, v, s, s)
+	define("clamp_max", v, 0, v, s)
+	define("clamp_min", v, 0, v, s)
+	define("round", v, 1, v, s)
+	define("histogram_quantile", v, 0, s, v)
+	define("quantile_over_time", v, 0, s, m)
+	define("predict_linear", v, 0, m, s)
+	define("holt_winters", v, 0, m, s, s)
+	define("label_replace", v, 0, v, str, str, str, str)
+	define("label_join", v, -1, v, str, str, str)
+	define("scalar", s, 0, v)
+	define("vector", v, 0, s)
+	define("time", s, 0)
+	define("pi", s, 0)
+
+	// Adapter extensions, see canary.go
+	define(canaryDeltaFunc, v, 0, v)
+	define(canaryRatioFunc, v, 0, v)
+}
+
+// aggregators lists the PromQL aggregation operators and whether they take a
+// leading parameter.
+var aggregators = map[string]ValueType{
+	"sum":          ValueTypeNone,
+	"avg":          ValueTypeNone,
+	"min":          ValueTypeNone,
+	"max":          ValueTypeNone,
+	"count":        ValueTypeNone,
+	"group":        ValueTypeNone,
+	"stddev":       ValueTypeNone,
+	"stdvar":       ValueTypeNone,
+	"topk":         ValueTypeScalar,
+	"bottomk":      ValueTypeScalar,
+	"quantile":     ValueTypeScalar,
+	"count_values": ValueTypeString,
+}
+
+// Binary operator precedences, lowest first.
+var binaryPrecedence = map[string]int{
+	"or":     1,
+	"and":    2,
+	"unless": 2,
+	"==":     3,
+	"!=":     3,
+	"<":      3,
+	"<=":     3,
+	">":      3,
+	">=":     3,
+	"+":      4,
+	"-":      4,
+	"*":      5,
+	"/":      5,
+	"%":      5,
+	"atan2":  5,
+	"^":      6,
+}
+
+func isComparisonOperator(op string) bool {
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+func isSetOperator(op string) bool {
+	return op == "and" || op == "or" || op == "unless"
+}
+
+// ---------------------------------------------------------------------------
+// Lexer
+
+type tokenType int
+
+const (
+	tokEOF tokenType = iota
+	tokError
+	tokIdentifier
+	tokNumber
+	tokDuration
+	tokString
+	tokOperator
+	tokLeftParen
+	tokRightParen
+	tokLeftBrace
+	tokRightBrace
+	tokLeftBracket
+	tokRightBracket
+	tokComma
+	tokColon
+	tokAt
+)
+
+var tokenNames = map[tokenType]string{
+	tokEOF:          "end of input",
+	tokIdentifier:   "identifier",
+	tokNumber:       "number",
+	tokDuration:     "duration",
+	tokString:       "string",
+	tokOperator:     "operator",
+	tokLeftParen:    `"("`,
+	tokRightParen:   `")"`,
+	tokLeftBrace:    `"{"`,
+	tokRightBrace:   `"}"`,
+	tokLeftBracket:  `"["`,
+	tokRightBracket: `"]"`,
+	tokComma:        `","`,
+	tokColon:        `":"`,
+	tokAt:           `"@"`,
+}
+
+type token struct {
+	typ tokenType
+	val string
+	pos PositionRange
+}
+
+func (t token) describe() string {
+	switch t.typ {
+	case tokEOF:
+		return "end of input"
+	case tokIdentifier, tokNumber, tokDuration, tokOperator:
+		return fmt.Sprintf("%s %q", tokenNames[t.typ], t.val)
+	case tokString:
+		return fmt.Sprintf("string %s", t.val)
+	}
+	return tokenNames[t.typ]
+}
+
+func lexPromQL(input string) []token {
+	var tokens []token
+	i := 0
+	emit := func(typ tokenType, start int) {
+		tokens = append(tokens, token{typ: typ, val: input[start:i], pos: PositionRange{start, i}})
+	}
+	fail := func(start int, format string, args ...interface{}) []token {
+		return append(tokens, token{typ: tokError, val: fmt.Sprintf(format, args...), pos: PositionRange{start, i}})
+	}
+
+	for i < len(input) {
+		r, width := utf8.DecodeRuneInString(input[i:])
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i += width
+		case r == '#':
+			for i < len(input) && input[i] != '\n' {
+				i++
+			}
+		case r == '(':
+			i++
+			emit(tokLeftParen, start)
+		case r == ')':
+			i++
+			emit(tokRightParen, start)
+		case r == '{':
+			i++
+			emit(tokLeftBrace, start)
+		case r == '}':
+			i++
+			emit(tokRightBrace, start)
+		case r == '[':
+			i++
+			emit(tokLeftBracket, start)
+		case r == ']':
+			i++
+			emit(tokRightBracket, start)
+		case r == ',':
+			i++
+			emit(tokComma, start)
+		case r == ':' && (i+1 >= len(input) || !isIdentifierStart(rune(input[i+1]))):
+			i++
+			emit(tokColon, start)
+		case r == '@':
+			i++
+			emit(tokAt, start)
+		case strings.ContainsRune("+-*/%^", r):
+			i++
+			emit(tokOperator, start)
+		case r == '=':
+			i++
+			if i < len(input) && (input[i] == '=' || input[i] == '~') {
+				i++
+			}
+			emit(tokOperator, start)
+		case r == '!':
+			i++
+			if i >= len(input) || (input[i] != '=' && input[i] != '~') {
+				return fail(start, "unexpected character after '!'")
+			}
+			i++
+			emit(tokOperator, start)
+		case r == '<' || r == '>':
+			i++
+			if i < len(input) && input[i] == '=' {
+				i++
+			}
+			emit(tokOperator, start)
+		case r == '"' || r == '\'' || r == '`':
+			i++
+			for {
+				if i >= len(input) {
+					return fail(start, "unterminated quoted string")
+				}
+				c := input[i]
+				if c == '\\' && r != '`' {
+					i += 2
+					continue
+				}
+				if c == '\n' && r != '`' {
+					return fail(start, "unterminated quoted string")
+				}
+				i++
+				if rune(c) == r {
+					break
+				}
+			}
+			emit(tokString, start)
+		case r >= '0' && r <= '9' || r == '.' && i+1 < len(input) && input[i+1] >= '0' && input[i+1] <= '9':
+			typ, end, err := scanNumberOrDuration(input, i)
+			i = end
+			if err != "" {
+				return fail(start, "%s", err)
+			}
+			emit(typ, start)
+		case isIdentifierStart(r) || r == ':':
+			for i < len(input) {
+				c, w := utf8.DecodeRuneInString(input[i:])
+				if !isIdentifierChar(c) && c != ':' {
+					break
+				}
+				i += w
+			}
+			emit(tokIdentifier, start)
+		default:
+			i += width
+			return fail(start, "unexpected character %q", r)
+		}
+	}
+	return append(tokens, token{typ: tokEOF, pos: PositionRange{len(input), len(input)}})
+}
+
+func isIdentifierStart(r rune) bool {
+	return r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+}
+
+func isIdentifierChar(r rune) bool {
+	return isIdentifierStart(r) || r >= '0' && r <= '9'
+}
+
+// scanNumberOrDuration scans a numeric literal starting at i. Integers that are
+// immediately followed by a duration unit are scanned as a whole duration
+// (e.g. "1h30m").
+func scanNumberOrDuration(input string, i int) (tokenType, int, string) {
+	start := i
+	if strings.HasPrefix(input[i:], "0x") || strings.HasPrefix(input[i:], "0X") {
+		i += 2
+		for i < len(input) && strings.ContainsRune("0123456789abcdefABCDEF", rune(input[i])) {
+			i++
+		}
+		return tokNumber, i, ""
+	}
+
+	integer := true
+	for i < len(input) && input[i] >= '0' && input[i] <= '9' {
+		i++
+	}
+	if i < len(input) && input[i] == '.' {
+		integer = false
+		i++
+		for i < len(input) && input[i] >= '0' && input[i] <= '9' {
+			i++
+		}
+	}
+	if i < len(input) && (input[i] == 'e' || input[i] == 'E') {
+		j := i + 1
+		if j < len(input) && (input[j] == '+' || input[j] == '-') {
+			j++
+		}
+		if j < len(input) && input[j] >= '0' && input[j] <= '9' {
+			integer = false
+			i = j
+			for i < len(input) && input[i] >= '0' && input[i] <= '9' {
+				i++
+			}
+		}
+	}
+
+	if i < len(input) && strings.ContainsRune("smhdwy", rune(input[i])) {
+		if !integer {
+			return tokError, i, fmt.Sprintf("bad duration syntax %q", input[start:i+1])
+		}
+		for i < len(input) && (input[i] >= '0' && input[i] <= '9' || strings.ContainsRune("smhdwy", rune(input[i]))) {
+			i++
+		}
+		if _, err := parseDuration(input[start:i]); err != nil {
+			return tokError, i, err.Error()
+		}
+		return tokDuration, i, ""
+	}
+	if i < len(input) && isIdentifierStart(rune(input[i])) {
+		return tokError, i + 1, fmt.Sprintf("bad number or duration syntax %q", input[start:i+1])
+	}
+	return tokNumber, i, ""
+}
+
+var durationUnits = []struct {
+	unit string
+	dur  time.Duration
+}{
+	{"y", 365 * 24 * time.Hour},
+	{"w", 7 * 24 * time.Hour},
+	{"d", 24 * time.Hour},
+	{"h", time.Hour},
+	{"m", time.Minute},
+	{"s", time.Second},
+	{"ms", time.Millisecond},
+}
+
+var durationRE = regexp.MustCompile(`^(([0-9]+)y)?(([0-9]+)w)?(([0-9]+)d)?(([0-9]+)h)?(([0-9]+)m)?(([0-9]+)s)?(([0-9]+)ms)?$`)
+
+// parseDuration parses a Prometheus duration string such as "1h30m" or "2w".
+// Units must appear in descending order and at most once each.
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" || s == "0" {
+		return 0, fmt.Errorf("empty duration string")
+	}
+	matches := durationRE.FindStringSubmatch(s)
+	if matches == nil {
+		return 0, fmt.Errorf("not a valid duration string: %q", s)
+	}
+	var total time.Duration
+	for i, u := range durationUnits {
+		group := matches[2*i+2]
+		if group == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(group, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("not a valid duration string: %q", s)
+		}
+		total += time.Duration(n) * u.dur
+	}
+	return total, nil
+}
+
+// formatDuration renders a duration in Prometheus syntax, e.g. 90s -> "1m30s".
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return "0s"
+	}
+	var b strings.Builder
+	for _, u := range durationUnits {
+		if n := d / u.dur; n > 0 {
+			fmt.Fprintf(&b, "%d%s", n, u.unit)
+			d -= n * u.dur
+		}
+	}
+	return b.String()
+}
+
+// ---------------------------------------------------------------------------
+// Parser
+
+type promQLParser struct {
+	input  string
+	tokens []token
+	pos    int
+}
+
+// parsePanic is used internally to unwind the recursive descent on error.
+type parsePanic struct{ err *ParseError }
+
+// ParsePromQL parses a PromQL expression into an AST.
+func ParsePromQL(input string) (expr Expr, err error) {
+	p := &promQLParser{input: input, tokens: lexPromQL(input)}
+	defer func() {
+		if r := recover(); r != nil {
+			pp, ok := r.(parsePanic)
+			if !ok {
+				panic(r)
+			}
+			expr, err = nil, pp.err
+		}
+	}()
+
+	if p.peek().typ == tokEOF {
+		p.errorf(p.peek().pos, "no expression found in input")
+	}
+	expr = p.parseExpr(0)
+	if t := p.peek(); t.typ != tokEOF {
+		p.errorf(t.pos, "unexpected %s", t.describe())
+	}
+	return expr, nil
+}
+
+func (p *promQLParser) errorf(pos PositionRange, format string, args ...interface{}) {
+	panic(parsePanic{&ParseError{Pos: pos, Query: p.input, Err: fmt.Sprintf(format, args...)}})
+}
+
+func (p *promQLParser) peek() token {
+	t := p.tokens[p.pos]
+	if t.typ == tokError {
+		p.errorf(t.pos, "%s", t.val)
+	}
+	return t
+}
+
+func (p *promQLParser) next() token {
+	t := p.peek()
+	if t.typ != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *promQLParser) expect(typ tokenType, context string) token {
+	t := p.next()
+	if t.typ != typ {
+		p.errorf(t.pos, "unexpected %s in %s, expected %s", t.describe(), context, tokenNames[typ])
+	}
+	return t
+}
+
+func (p *promQLParser) lastEnd() int {
+	if p.pos == 0 {
+		return 0
+	}
+	return p.tokens[p.pos-1].pos.End
+}
+
+// peekBinaryOperator reports whether the next token is a binary operator.
+func (p *promQLParser) peekBinaryOperator() (string, bool) {
+	t := p.peek()
+	switch t.typ {
+	case tokOperator:
+		if _, ok := binaryPrecedence[t.val]; ok {
+			return t.val, true
+		}
+	case tokIdentifier:
+		op := strings.ToLower(t.val)
+		if isSetOperator(op) || op == "atan2" {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *promQLParser) parseExpr(minPrecedence int) Expr {
+	lhs := p.parseUnary()
+	for {
+		op, ok := p.peekBinaryOperator()
+		if !ok || binaryPrecedence[op] < minPrecedence {
+			return lhs
+		}
+		opTok := p.next()
+
+		bin := &BinaryExpr{Op: op, LHS: lhs}
+		if t := p.peek(); t.typ == tokIdentifier && strings.ToLower(t.val) == "bool" {
+			p.next()
+			if !isComparisonOperator(op) {
+				p.errorf(t.pos, "bool modifier can only be used on comparison operators")
+			}
+			bin.ReturnBool = true
+		}
+		bin.VectorMatching = p.parseVectorMatching(op)
+
+		nextPrecedence := binaryPrecedence[op] + 1
+		if op == "^" {
+			nextPrecedence = binaryPrecedence[op]
+		}
+		bin.RHS = p.parseExpr(nextPrecedence)
+		bin.Pos = PositionRange{lhs.PositionRange().Start, bin.RHS.PositionRange().End}
+		p.checkBinary(bin, opTok)
+		lhs = bin
+	}
+}
+
+func (p *promQLParser) parseVectorMatching(op string) *VectorMatching {
+	t := p.peek()
+	if t.typ != tokIdentifier {
+		return nil
+	}
+	var vm *VectorMatching
+	switch strings.ToLower(t.val) {
+	case "on", "ignoring":
+		p.next()
+		vm = &VectorMatching{On: strings.ToLower(t.val) == "on", Labels: p.parseLabelList()}
+	default:
+		return nil
+	}
+
+	if t := p.peek(); t.typ == tokIdentifier {
+		switch strings.ToLower(t.val) {
+		case "group_left", "group_right":
+			p.next()
+			if isSetOperator(op) {
+				p.errorf(t.pos, "no grouping allowed for %q operation", op)
+			}
+			vm.GroupLeft = strings.ToLower(t.val) == "group_left"
+			vm.GroupRight = !vm.GroupLeft
+			if p.peek().typ == tokLeftParen {
+				vm.Include = p.parseLabelList()
+			}
+		}
+	}
+	return vm
+}
+
+func (p *promQLParser) checkBinary(bin *BinaryExpr, opTok token) {
+	lt, rt := bin.LHS.Type(), bin.RHS.Type()
+	for _, side := range []Expr{bin.LHS, bin.RHS} {
+		if t := side.Type(); t != ValueTypeScalar && t != ValueTypeVector {
+			p.errorf(side.PositionRange(), "binary expression must contain only scalar and instant vector types, got %s", t)
+		}
+	}
+	if isComparisonOperator(bin.Op) && !bin.ReturnBool && lt == ValueTypeScalar && rt == ValueTypeScalar {
+		p.errorf(opTok.pos, "comparisons between scalars must use BOOL modifier")
+	}
+	if isSetOperator(bin.Op) && (lt != ValueTypeVector || rt != ValueTypeVector) {
+		p.errorf(opTok.pos, "set operator %q not allowed in binary scalar expression", bin.Op)
+	}
+	if bin.VectorMatching != nil && (lt != ValueTypeVector || rt != ValueTypeVector) {
+		p.errorf(opTok.pos, "vector matching only allowed between instant vectors")
+	}
+}
+
+func (p *promQLParser) parseUnary() Expr {
+	t := p.peek()
+	if t.typ == tokOperator && (t.val == "-" || t.val == "+") {
+		p.next()
+		operand := p.parseExpr(binaryPrecedence["^"])
+		if ot := operand.Type(); ot != ValueTypeScalar && ot != ValueTypeVector {
+			p.errorf(operand.PositionRange(), "unary expression only allowed on expressions of type scalar or instant vector, got %s", ot)
+		}
+		pos := PositionRange{t.pos.Start, operand.PositionRange().End}
+		if num, ok := operand.(*NumberLiteral); ok {
+			if t.val == "-" {
+				num.Val = -num.Val
+			}
+			num.Pos = pos
+			return num
+		}
+		return &UnaryExpr{Op: t.val, Expr: operand, Pos: pos}
+	}
+	return p.parsePostfix(p.parsePrimary())
+}
+
+// parsePostfix handles range selectors, subqueries and offset/@ modifiers.
+func (p *promQLParser) parsePostfix(expr Expr) Expr {
+	for {
+		t := p.peek()
+		switch {
+		case t.typ == tokLeftBracket:
+			expr = p.parseRange(expr)
+		case t.typ == tokIdentifier && strings.ToLower(t.val) == "offset":
+			p.next()
+			p.applyOffset(expr, p.parseSignedDuration("offset"), t.pos)
+		case t.typ == tokAt:
+			p.next()
+			p.applyAt(expr, p.parseAtModifier(), t.pos)
+		default:
+			return expr
+		}
+	}
+}
+
+func (p *promQLParser) parseRange(expr Expr) Expr {
+	open := p.next()
+	rng := p.parseDurationToken("range")
+
+	if p.peek().typ == tokColon {
+		p.next()
+		sub := &SubqueryExpr{Expr: expr, Range: rng}
+		if p.peek().typ != tokRightBracket {
+			sub.Step = p.parseDurationToken("subquery step")
+		}
+		end := p.expect(tokRightBracket, "subquery selector")
+		if t := expr.Type(); t != ValueTypeVector {
+			p.errorf(expr.PositionRange(), "subquery is only allowed on instant vector, got %s", t)
+		}
+		sub.Pos = PositionRange{expr.PositionRange().Start, end.pos.End}
+		return sub
+	}
+
+	end := p.expect(tokRightBracket, "range selector")
+	vs, ok := expr.(*VectorSelector)
+	if !ok {
+		p.errorf(PositionRange{open.pos.Start, end.pos.End},
+			"ranges only allowed for vector selectors, use a subquery ([%s:]) for other expressions", formatDuration(rng))
+	}
+	if vs.Offset != 0 || vs.At != nil {
+		p.errorf(open.pos, "range must be specified before offset and @ modifiers")
+	}
+	return &MatrixSelector{VectorSelector: vs, Range: rng, Pos: PositionRange{vs.Pos.Start, end.pos.End}}
+}
+
+func (p *promQLParser) parseDurationToken(context string) time.Duration {
+	t := p.next()
+	switch t.typ {
+	case tokDuration:
+		d, err := parseDuration(t.val)
+		if err != nil {
+			p.errorf(t.pos, "%v", err)
+		}
+		return d
+	case tokNumber:
+		// Plain numbers inside ranges are interpreted as seconds.
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil || f <= 0 {
+			p.errorf(t.pos, "invalid %s %q", context, t.val)
+		}
+		return time.Duration(f * float64(time.Second))
+	}
+	p.errorf(t.pos, "unexpected %s in %s, expected duration", t.describe(), context)
+	return 0
+}
+
+func (p *promQLParser) parseSignedDuration(context string) time.Duration {
+	sign := time.Duration(1)
+	if t := p.peek(); t.typ == tokOperator && (t.val == "-" || t.val == "+") {
+		p.next()
+		if t.val == "-" {
+			sign = -1
+		}
+	}
+	return sign * p.parseDurationToken(context)
+}
+
+func (p *promQLParser) parseAtModifier() *AtModifier {
+	t := p.next()
+	switch t.typ {
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			p.errorf(t.pos, "invalid timestamp %q for @ modifier", t.val)
+		}
+		return &AtModifier{Timestamp: f}
+	case tokOperator:
+		if t.val == "-" || t.val == "+" {
+			n := p.expect(tokNumber, "@ modifier")
+			f, err := strconv.ParseFloat(n.val, 64)
+			if err != nil {
+				p.errorf(n.pos, "invalid timestamp %q for @ modifier", n.val)
+			}
+			if t.val == "-" {
+				f = -f
+			}
+			return &AtModifier{Timestamp: f}
+		}
+	case tokIdentifier:
+		name := strings.ToLower(t.val)
+		if name == "start" || name == "end" {
+			p.expect(tokLeftParen, "@ modifier")
+			p.expect(tokRightParen, "@ modifier")
+			return &AtModifier{Start: name == "start", End: name == "end"}
+		}
+	}
+	p.errorf(t.pos, "unexpected %s in @ modifier, expected timestamp, start() or end()", t.describe())
+	return nil
+}
+
+func (p *promQLParser) applyOffset(expr Expr, offset time.Duration, pos PositionRange) {
+	switch e := expr.(type) {
+	case *VectorSelector:
+		if e.Offset != 0 {
+			p.errorf(pos, "offset may not be set multiple times")
+		}
+		e.Offset = offset
+		e.Pos.End = p.lastEnd()
+	case *MatrixSelector:
+		if e.VectorSelector.Offset != 0 {
+			p.errorf(pos, "offset may not be set multiple times")
+		}
+		e.VectorSelector.Offset = offset
+		e.Pos.End = p.lastEnd()
+	case *SubqueryExpr:
+		if e.Offset != 0 {
+			p.errorf(pos, "offset may not be set multiple times")
+		}
+		e.Offset = offset
+		e.Pos.End = p.lastEnd()
+	default:
+		p.errorf(pos, "offset modifier must be preceded by an instant vector selector or range vector selector or a subquery")
+	}
+}
+
+func (p *promQLParser) applyAt(expr Expr, at *AtModifier, pos PositionRange) {
+	switch e := expr.(type) {
+	case *VectorSelector:
+		if e.At != nil {
+			p.errorf(pos, "@ <timestamp> may not be set multiple times")
+		}
+		e.At = at
+		e.Pos.End = p.lastEnd()
+	case *MatrixSelector:
+		if e.VectorSelector.At != nil {
+			p.errorf(pos, "@ <timestamp> may not be set multiple times")
+		}
+		e.VectorSelector.At = at
+		e.Pos.End = p.lastEnd()
+	case *SubqueryExpr:
+		if e.At != nil {
+			p.errorf(pos, "@ <timestamp> may not be set multiple times")
+		}
+		e.At = at
+		e.Pos.End = p.lastEnd()
+	default:
+		p.errorf(pos, "@ modifier must be preceded by an instant vector selector or range vector selector or a subquery")
+	}
+}
+
+func (p *promQLParser) parsePrimary() Expr {
+	t := p.peek()
+	switch t.typ {
+	case tokNumber:
+		p.next()
+		return &NumberLiteral{Val: p.parseNumber(t), Pos: t.pos}
+	case tokString:
+		p.next()
+		return &StringLiteral{Val: p.unquote(t), Pos: t.pos}
+	case tokLeftParen:
+		p.next()
+		inner := p.parseExpr(0)
+		end := p.expect(tokRightParen, "parenthesized expression")
+		return &ParenExpr{Expr: inner, Pos: PositionRange{t.pos.Start, end.pos.End}}
+	case tokLeftBrace:
+		return p.parseVectorSelector("", t.pos)
+	case tokIdentifier:
+		p.next()
+		lower := strings.ToLower(t.val)
+		if _, ok := aggregators[lower]; ok && p.isAggregationStart() {
+			return p.parseAggregation(lower, t)
+		}
+		if p.peek().typ == tokLeftParen {
+			fn, ok := promQLFunctions[t.val]
+			if !ok {
+				p.errorf(t.pos, "unknown function with name %q", t.val)
+			}
+			return p.parseCall(fn, t)
+		}
+		if lower == "inf" || lower == "nan" {
+			return &NumberLiteral{Val: p.parseNumber(t), Pos: t.pos}
+		}
+		return p.parseVectorSelector(t.val, t.pos)
+	case tokDuration:
+		p.errorf(t.pos, "unexpected duration %q, durations are only allowed in ranges and offsets", t.val)
+	}
+	p.errorf(t.pos, "unexpected %s", t.describe())
+	return nil
+}
+
+func (p *promQLParser) parseNumber(t token) float64 {
+	var (
+		f   float64
+		err error
+	)
+	if strings.HasPrefix(strings.ToLower(t.val), "0x") {
+		var n int64
+		n, err = strconv.ParseInt(t.val[2:], 16, 64)
+		f = float64(n)
+	} else {
+		f, err = strconv.ParseFloat(t.val, 64)
+	}
+	if err != nil {
+		p.errorf(t.pos, "invalid number %q", t.val)
+	}
+	return f
+}
+
+func (p *promQLParser) unquote(t token) string {
+	raw := t.val
+	var (
+		s   string
+		err error
+	)
+	switch raw[0] {
+	case '`':
+		s = raw[1 : len(raw)-1]
+	case '\'':
+		// Rewrite as a double-quoted Go string literal so strconv can unescape it.
+		var b strings.Builder
+		b.WriteByte('"')
+		inner := raw[1 : len(raw)-1]
+		for i := 0; i < len(inner); i++ {
+			switch {
+			case inner[i] == '\\' && i+1 < len(inner) && inner[i+1] == '\'':
+				b.WriteByte('\'')
+				i++
+			case inner[i] == '\\' && i+1 < len(inner):
+				b.WriteByte('\\')
+				b.WriteByte(inner[i+1])
+				i++
+			case inner[i] == '"':
+				b.WriteString(`\"`)
+			default:
+				b.WriteByte(inner[i])
+			}
+		}
+		b.WriteByte('"')
+		s, err = strconv.Unquote(b.String())
+	default:
+		s, err = strconv.Unquote(raw)
+	}
+	if err != nil {
+		p.errorf(t.pos, "invalid string literal %s: %v", raw, err)
+	}
+	return s
+}
+
+func (p *promQLParser) parseVectorSelector(name string, start PositionRange) Expr {
+	vs := &VectorSelector{Name: name, Pos: start}
+	if p.peek().typ == tokLeftBrace {
+		vs.Matchers = p.parseLabelMatchers()
+		vs.Pos.End = p.lastEnd()
+	}
+
+	if name == "" {
+		nonEmpty := false
+		for _, m := range vs.Matchers {
+			if m.Name == "__name__" && m.Type == MatchEqual {
+				vs.Name = m.Value
+			}
+			if !matchesEmpty(m) {
+				nonEmpty = true
+			}
+		}
+		if !nonEmpty {
+			p.errorf(vs.Pos, "vector selector must contain at least one non-empty matcher")
+		}
+	}
+	return vs
+}
+
+// matchesEmpty reports whether the matcher would match the empty string.
+func matchesEmpty(m *LabelMatcher) bool {
+	switch m.Type {
+	case MatchEqual:
+		return m.Value == ""
+	case MatchNotEqual:
+		return m.Value != ""
+	case MatchRegexp:
+		return regexp.MustCompile("^(?:" + m.Value + ")$").MatchString("")
+	case MatchNotRegexp:
+		return !regexp.MustCompile("^(?:" + m.Value + ")$").MatchString("")
+	}
+	return false
+}
+
+func (p *promQLParser) parseLabelMatchers() []*LabelMatcher {
+	p.expect(tokLeftBrace, "label matching")
+	var matchers []*LabelMatcher
+	for {
+		t := p.peek()
+		if t.typ == tokRightBrace {
+			p.next()
+			return matchers
+		}
+
+		var name string
+		switch t.typ {
+		case tokIdentifier:
+			name = t.val
+		case tokString:
+			name = p.unquote(t)
+		default:
+			p.errorf(t.pos, "unexpected %s in label matching, expected label name", t.describe())
+		}
+		p.next()
+
+		opTok := p.next()
+		var op MatchType
+		switch opTok.val {
+		case "=", "!=", "=~", "!~":
+			op = MatchType(opTok.val)
+		default:
+			p.errorf(opTok.pos, "unexpected %s in label matching, expected one of \"=\", \"!=\", \"=~\" or \"!~\"", opTok.describe())
+		}
+		if opTok.typ != tokOperator {
+			p.errorf(opTok.pos, "unexpected %s in label matching, expected label matching operator", opTok.describe())
+		}
+
+		valTok := p.next()
+		if valTok.typ != tokString {
+			p.errorf(valTok.pos, "unexpected %s in label matching, expected string", valTok.describe())
+		}
+		m := &LabelMatcher{Name: name, Type: op, Value: p.unquote(valTok), Pos: PositionRange{t.pos.Start, valTok.pos.End}}
+		if op == MatchRegexp || op == MatchNotRegexp {
+			if _, err := regexp.Compile(m.Value); err != nil {
+				p.errorf(valTok.pos, "invalid regular expression in label matcher: %v", err)
+			}
+		}
+		matchers = append(matchers, m)
+
+		switch t := p.peek(); t.typ {
+		case tokComma:
+			p.next()
+		case tokRightBrace:
+		default:
+			p.errorf(t.pos, "unexpected %s in label matching, expected \",\" or \"}\"", t.describe())
+		}
+	}
+}
+
+// parseLabelList parses a parenthesised, comma-separated list of label names.
+func (p *promQLParser) parseLabelList() []string {
+	p.expect(tokLeftParen, "grouping")
+	labels := []string{}
+	for {
+		t := p.next()
+		switch t.typ {
+		case tokRightParen:
+			return labels
+		case tokIdentifier:
+			labels = append(labels, t.val)
+		default:
+			p.errorf(t.pos, "unexpected %s in grouping, expected label name", t.describe())
+		}
+		switch t := p.peek(); t.typ {
+		case tokComma:
+			p.next()
+		case tokRightParen:
+		default:
+			p.errorf(t.pos, "unexpected %s in grouping, expected \",\" or \")\"", t.describe())
+		}
+	}
+}
+
+// isAggregationStart reports whether an aggregator keyword is being used as
+// an aggregation rather than as a metric name.
+func (p *promQLParser) isAggregationStart() bool {
+	t := p.peek()
+	if t.typ == tokLeftParen {
+		return true
+	}
+	if t.typ == tokIdentifier {
+		kw := strings.ToLower(t.val)
+		return kw == "by" || kw == "without"
+	}
+	return false
+}
+
+func (p *promQLParser) parseAggregation(op string, opTok token) Expr {
+	agg := &AggregateExpr{Op: op}
+	parseGrouping := func() bool {
+		t := p.peek()
+		if t.typ != tokIdentifier {
+			return false
+		}
+		switch strings.ToLower(t.val) {
+		case "by", "without":
+			p.next()
+			agg.Without = strings.ToLower(t.val) == "without"
+			agg.Grouping = p.parseLabelList()
+			return true
+		}
+		return false
+	}
+
+	grouped := parseGrouping()
+	p.expect(tokLeftParen, "aggregation")
+
+	paramType := aggregators[op]
+	if paramType != ValueTypeNone {
+		agg.Param = p.parseExpr(0)
+		if t := agg.Param.Type(); t != paramType {
+			p.errorf(agg.Param.PositionRange(), "expected type %s in aggregation parameter, got %s", paramType, t)
+		}
+		p.expect(tokComma, "aggregation")
+	}
+
+	agg.Expr = p.parseExpr(0)
+	if t := agg.Expr.Type(); t != ValueTypeVector {
+		p.errorf(agg.Expr.PositionRange(), "expected type %s in aggregation expression, got %s", ValueTypeVector, t)
+	}
+	if t := p.peek(); t.typ == tokComma {
+		p.errorf(t.pos, "unexpected %s in aggregation, too many arguments", t.describe())
+	}
+	end := p.expect(tokRightParen, "aggregation")
+	agg.Pos = PositionRange{opTok.pos.Start, end.pos.End}
+
+	if !grouped && parseGrouping() {
+		agg.Pos.End = p.lastEnd()
+	}
+	return agg
+}
+
+func (p *promQLParser) parseCall(fn *Function, nameTok token) Expr {
+	p.expect(tokLeftParen, "function call")
+	call := &Call{Func: fn}
+	if p.peek().typ != tokRightParen {
+		for {
+			call.Args = append(call.Args, p.parseExpr(0))
+			if p.peek().typ != tokComma {
+				break
+			}
+			p.next()
+		}
+	}
+	end := p.expect(tokRightParen, "function call")
+	call.Pos = PositionRange{nameTok.pos.Start, end.pos.End}
+
+	required := len(fn.ArgTypes) - fn.Variadic
+	if fn.Variadic < 0 {
+		required = len(fn.ArgTypes)
+	}
+	switch {
+	case len(call.Args) < required:
+		p.errorf(call.Pos, "expected at least %d argument(s) in call to %q, got %d", required, fn.Name, len(call.Args))
+	case fn.Variadic >= 0 && len(call.Args) > len(fn.ArgTypes):
+		p.errorf(call.Pos, "expected at most %d argument(s) in call to %q, got %d", len(fn.ArgTypes), fn.Name, len(call.Args))
+	}
+	for i, arg := range call.Args {
+		want := fn.ArgTypes[len(fn.ArgTypes)-1]
+		if i < len(fn.ArgTypes) {
+			want = fn.ArgTypes[i]
+		}
+		if got := arg.Type(); got != want {
+			p.errorf(arg.PositionRange(), "expected type %s in call to function %q, got %s", want, fn.Name, got)
+		}
+	}
+	return call
+}
+
+// unwrapParens strips any number of enclosing parentheses.
+func unwrapParens(expr Expr) Expr {
+	for {
+		paren, ok := expr.(*ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = paren.Expr
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePromQL(t *testing.T) {
+	tests := []struct {
+		name     string
+		promQL   string
+		expected string
+	}{
+		{
+			name:     "vector selector with matchers",
+			promQL:   `http_requests_total{code!~"5.*", service='my-app'}`,
+			expected: `http_requests_total{code!~"5.*", service="my-app"}`,
+		},
+		{
+			name:     "aggregation with leading grouping",
+			promQL:   `sum by (service) (rate(http_requests_total[5m]))`,
+			expected: `sum by (service) (rate(http_requests_total[5m]))`,
+		},
+		{
+			name:     "aggregation with trailing grouping",
+			promQL:   `histogram_quantile(0.95, sum(rate(http_request_duration_seconds_bucket[5m])) by (le))`,
+			expected: `histogram_quantile(0.95, sum by (le) (rate(http_request_duration_seconds_bucket[5m])))`,
+		},
+		{
+			name:     "operator precedence",
+			promQL:   `a / b * 100`,
+			expected: `a / b * 100`,
+		},
+		{
+			name:     "right associative power",
+			promQL:   `2 ^ 3 ^ 2`,
+			expected: `2 ^ 3 ^ 2`,
+		},
+		{
+			name:     "comparison with bool",
+			promQL:   `up > bool 0`,
+			expected: `up > bool 0`,
+		},
+		{
+			name:     "subquery and offset",
+			promQL:   `max_over_time(rate(x[1m])[5m:30s] offset 1h30m)`,
+			expected: `max_over_time(rate(x[1m])[5m:30s] offset 1h30m)`,
+		},
+		{
+			name:     "topk parameter",
+			promQL:   `topk(3, sum by (route) (http_requests_total))`,
+			expected: `topk(3, sum by (route) (http_requests_total))`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := ParsePromQL(tt.promQL)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if expr.String() != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, expr.String())
+			}
+		})
+	}
+}
+
+func TestParsePromQLPrecedence(t *testing.T) {
+	expr, err := ParsePromQL(`a - b / c`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, ok := expr.(*BinaryExpr)
+	if !ok || bin.Op != "-" {
+		t.Fatalf("expected top-level subtraction, got %s", expr)
+	}
+	if rhs, ok := bin.RHS.(*BinaryExpr); !ok || rhs.Op != "/" {
+		t.Errorf("expected division on the right-hand side, got %s", bin.RHS)
+	}
+
+	expr, err = ParsePromQL(`-2 ^ 2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := expr.(*UnaryExpr); !ok {
+		t.Errorf("expected unary minus to bind looser than ^, got %T", expr)
+	}
+}
+
+func TestParsePromQLErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		promQL  string
+		wantErr string
+	}{
+		{
+			name:    "unknown function",
+			promQL:  `foo(http_requests_total)`,
+			wantErr: `1:1: parse error: unknown function with name "foo"`,
+		},
+		{
+			name:    "unclosed brace",
+			promQL:  `http_requests_total{code="200"`,
+			wantErr: `1:31: parse error: unexpected end of input in label matching`,
+		},
+		{
+			name:    "range on non-selector",
+			promQL:  `sum(x)[5m]`,
+			wantErr: `1:7: parse error: ranges only allowed for vector selectors`,
+		},
+		{
+			name:    "wrong argument type",
+			promQL:  `rate(http_requests_total)`,
+			wantErr: `1:6: parse error: expected type range vector in call to function "rate"`,
+		},
+		{
+			name:    "error on second line",
+			promQL:  "sum(\n  rate(x[5m]) +)",
+			wantErr: `2:16: parse error: unexpected ")"`,
+		},
+		{
+			name:    "scalar comparison without bool",
+			promQL:  `1 > 2`,
+			wantErr: `1:3: parse error: comparisons between scalars must use BOOL modifier`,
+		},
+		{
+			name:    "invalid regex",
+			promQL:  `x{code=~"5("}`,
+			wantErr: `1:9: parse error: invalid regular expression`,
+		},
+		{
+			name:    "empty selector",
+			promQL:  `{code=""}`,
+			wantErr: `1:1: parse error: vector selector must contain at least one non-empty matcher`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParsePromQL(tt.promQL)
+			if err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			if !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("expected error starting with %q, got %q", tt.wantErr, err.Error())
+			}
+		})
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected time.Duration
+		wantErr  bool
+	}{
+		{input: "5m", expected: 5 * time.Minute},
+		{input: "1m30s", expected: 90 * time.Second},
+		{input: "2w", expected: 14 * 24 * time.Hour},
+		{input: "1y", expected: 365 * 24 * time.Hour},
+		{input: "250ms", expected: 250 * time.Millisecond},
+		{input: "1h1ms", expected: time.Hour + time.Millisecond},
+		{input: "30s1m", wantErr: true},
+		{input: "5x", wantErr: true},
+		{input: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			d, err := parseDuration(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got %v", d)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if d != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, d)
+			}
+			if formatDuration(d) != tt.input {
+				t.Errorf("expected %s to round-trip, got %s", tt.input, formatDuration(d))
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// maxQueryIDs bounds the number of query IDs a store remembers. The least
+// recently used IDs are dropped first; a dropped ID is simply recreated.
+const maxQueryIDs = 10000
+
+// queryIDFlushInterval is how often new query IDs are written to the store's
+// file. Writes happen off the query path, so a crash loses at most the IDs
+// of one interval, which are recreated on demand.
+const queryIDFlushInterval = 10 * time.Second
+
+// queryIDStore remembers the Honeycomb query ID created for each query
+// definition, so that identical queries are only created once. Honeycomb
+// query definitions are immutable, which makes the canonical JSON of a
+// HoneycombQuery a stable key. Only definitions with a relative time range
+// are worth remembering: an absolute range is never queried again.
+type queryIDStore struct {
+	// path is the file the IDs are persisted to; empty keeps them in memory.
+	path string
+	// capacity is the largest number of IDs remembered.
+	capacity int
+
+	mu sync.Mutex
+	// ids holds the *queryIDEntry of each key, most recently used first.
+	ids   map[string]*list.Element
+	order *list.List
+	// dirty reports changes since the last flush.
+	dirty bool
+
+	// flushMu serialises writes to the file.
+	flushMu sync.Mutex
+}
+
+type queryIDEntry struct {
+	key string
+	id  string
+}
+
+// newQueryIDStore returns a store persisted to path, loading any IDs saved
+// there by a previous run. An unreadable file is logged and ignored, since
+// every ID can be recreated.
+func newQueryIDStore(path string) *queryIDStore {
+	s := &queryIDStore{path: path, capacity: maxQueryIDs, ids: map[string]*list.Element{}, order: list.New()}
+	if path == "" {
+		return s
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("⚠️  Failed to read query ID file %s, starting empty: %v", path, err)
+		}
+		return s
+	}
+	var ids map[string]string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		log.Printf("⚠️  Failed to parse query ID file %s, starting empty: %v", path, err)
+		return s
+	}
+	for key, id := range ids {
+		s.setLocked(key, id)
+	}
+	return s
+}
+
+// reusableQuery reports whether a query's ID is worth remembering: its time
+// range is relative to now rather than absolute.
+func reusableQuery(query *HoneycombQuery) bool {
+	return query.StartTime == 0 && query.EndTime == 0
+}
+
+// queryDefinitionKey returns the key for a query definition in a dataset: the
+// SHA-256 of the dataset and the query's canonical JSON.
+func queryDefinitionKey(dataset string, query *HoneycombQuery) (string, error) {
+	definition, err := json.Marshal(query)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal query: %v", err)
+	}
+	sum := sha256.Sum256(append([]byte(dataset+"\n"), definition...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (s *queryIDStore) lookup(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.ids[key]
+	if !ok {
+		return "", false
+	}
+	s.order.MoveToFront(e)
+	return e.Value.(*queryIDEntry).id, true
+}
+
+func (s *queryIDStore) store(key, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setLocked(key, id)
+	s.dirty = true
+}
+
+// forget drops a query ID that Honeycomb no longer knows about.
+func (s *queryIDStore) forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.ids[key]; ok {
+		s.order.Remove(e)
+		delete(s.ids, key)
+		s.dirty = true
+	}
+}
+
+// len returns the number of IDs remembered.
+func (s *queryIDStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.ids)
+}
+
+// setLocked remembers an ID as the most recently used, dropping the least
+// recently used ID if the store is full.
+func (s *queryIDStore) setLocked(key, id string) {
+	if e, ok := s.ids[key]; ok {
+		e.Value.(*queryIDEntry).id = id
+		s.order.MoveToFront(e)
+		return
+	}
+	s.ids[key] = s.order.PushFront(&queryIDEntry{key: key, id: id})
+	for len(s.ids) > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.ids, oldest.Value.(*queryIDEntry).key)
+	}
+}
+
+// persist flushes the IDs to the store's file every interval until ctx is
+// cancelled.
+func (s *queryIDStore) persist(ctx context.Context, interval time.Duration) {
+	if s.path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.flush()
+		}
+	}
+}
+
+// flush writes the IDs to the store's file if they changed since the last
+// flush. The file is replaced atomically so a crash never leaves it half
+// written. Failures are logged only: the in-memory IDs remain valid, and the
+// next flush tries again.
+func (s *queryIDStore) flush() {
+	if s.path == "" {
+		return
+	}
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return
+	}
+	ids := make(map[string]string, len(s.ids))
+	for key, e := range s.ids {
+		ids[key] = e.Value.(*queryIDEntry).id
+	}
+	s.dirty = false
+	s.mu.Unlock()
+
+	if err := s.write(ids); err != nil {
+		log.Printf("⚠️  Failed to persist query IDs to %s: %v", s.path, err)
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+	}
+}
+
+func (s *queryIDStore) write(ids map[string]string) error {
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return fmt.Errorf("failed to encode query IDs: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".query-ids-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockQueryIDServer is a Honeycomb API that counts created queries and only
+// knows the query IDs it has not been told to forget.
+type mockQueryIDServer struct {
+	mu      sync.Mutex
+	created int
+	known   map[string]bool
+}
+
+func (m *mockQueryIDServer) handler(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/1/queries/test":
+		m.created++
+		id := fmt.Sprintf("query-%d", m.created)
+		m.known[id] = true
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": id})
+	case "/1/query_results/test":
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if !m.known[body["query_id"].(string)] {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"complete": true,
+			"data": map[string]interface{}{
+				"results": []interface{}{
+					map[string]interface{}{"data": map[string]interface{}{"COUNT": 1.0}},
+				},
+			},
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestQueryIDReuse(t *testing.T) {
+	mock := &mockQueryIDServer{known: map[string]bool{}}
+	mockServer := httptest.NewServer(http.HandlerFunc(mock.handler))
+	defer mockServer.Close()
+
+	path := filepath.Join(t.TempDir(), "query-ids.json")
+	adapter := &HoneycombAdapter{
+		honeycombAPIKey:  "test-key",
+		honeycombBaseURL: mockServer.URL,
+		queryTimeWindow:  3 * time.Minute,
+		queryIDs:         newQueryIDStore(path),
+	}
+	adapter.ensureTelemetry()
+
+	countQuery := &HoneycombQuery{TimeRange: 300, Calculations: []Calculation{{Op: "COUNT"}}}
+	filteredQuery := &HoneycombQuery{
+		TimeRange:    300,
+		Calculations: []Calculation{{Op: "COUNT"}},
+		Filters:      []Filter{{Column: "http.status_code", Op: "<", Value: 500}},
+	}
+
+	steps := []struct {
+		name        string
+		query       *HoneycombQuery
+		forget      string
+		wantCreated int
+	}{
+		{name: "first query is created", query: countQuery, wantCreated: 1},
+		{name: "identical query reuses its ID", query: countQuery, wantCreated: 1},
+		{name: "different query is created", query: filteredQuery, wantCreated: 2},
+		{name: "deleted query is recreated", query: countQuery, forget: "query-1", wantCreated: 3},
+		{name: "recreated ID is reused", query: countQuery, wantCreated: 3},
+	}
+	for _, step := range steps {
+		mock.mu.Lock()
+		delete(mock.known, step.forget)
+		mock.mu.Unlock()
+
+		if _, err := adapter.executeHoneycombQuery(context.Background(), step.query, "test"); err != nil {
+			t.Fatalf("%s: unexpected error: %v", step.name, err)
+		}
+		if mock.created != step.wantCreated {
+			t.Errorf("%s: expected %d created queries, got %d", step.name, step.wantCreated, mock.created)
+		}
+	}
+
+	// A restarted adapter picks up the IDs persisted by the last flush.
+	adapter.queryIDs.flush()
+	restarted := newQueryIDStore(path)
+	for _, query := range []*HoneycombQuery{countQuery, filteredQuery} {
+		key, _ := queryDefinitionKey("test", query)
+		if _, ok := restarted.lookup(key); !ok {
+			t.Errorf("expected query ID for %+v to be persisted", query)
+		}
+	}
+}
+
+func TestQueryIDsOfAbsoluteRangesAreNotKept(t *testing.T) {
+	mock := &mockQueryIDServer{known: map[string]bool{}}
+	mockServer := httptest.NewServer(http.HandlerFunc(mock.handler))
+	defer mockServer.Close()
+
+	adapter := &HoneycombAdapter{
+		honeycombAPIKey:  "test-key",
+		honeycombBaseURL: mockServer.URL,
+		queryTimeWindow:  3 * time.Minute,
+		queryIDs:         newQueryIDStore(""),
+	}
+	adapter.ensureTelemetry()
+
+	for i := 0; i < 3; i++ {
+		query := &HoneycombQuery{StartTime: 1700000000 + int64(i), EndTime: 1700000300 + int64(i), Calculations: []Calculation{{Op: "COUNT"}}}
+		if _, err := adapter.executeHoneycombQuery(context.Background(), query, "test"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if n := adapter.queryIDs.len(); n != 0 {
+		t.Errorf("expected no query IDs for absolute ranges, got %d", n)
+	}
+}
+
+func TestQueryIDStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query-ids.json")
+	s := newQueryIDStore(path)
+	s.capacity = 2
+
+	s.store("a", "query-a")
+	s.store("b", "query-b")
+	s.lookup("a")
+	s.store("c", "query-c")
+
+	if _, ok := s.lookup("b"); ok {
+		t.Error("expected the least recently used ID to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := s.lookup(key); !ok {
+			t.Errorf("expected ID %q to be kept", key)
+		}
+	}
+
+	// Nothing is written until the store is flushed
+	if restarted := newQueryIDStore(path); restarted.len() != 0 {
+		t.Errorf("expected no IDs on disk before a flush, got %d", restarted.len())
+	}
+	s.flush()
+	if restarted := newQueryIDStore(path); restarted.len() != 2 {
+		t.Errorf("expected 2 IDs on disk after a flush, got %d", restarted.len())
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/sync/errgroup"
+)
+
+// maxRangePoints is the largest number of steps a range query may return.
+// Honeycomb rejects queries whose granularity is finer than 1/1000 of the
+// queried time range.
+const maxRangePoints = 1000
+
+// Point is a single timestamped value of a range-vector series.
+type Point struct {
+	T time.Time
+	V float64
+}
+
+// Series is a labelled sequence of points.
+type Series struct {
+	Metric map[string]string
+	Points []Point
+}
+
+// Matrix is a range vector, the result of a range query and what a Backend
+// returns for a leaf query evaluated over a range.
+type Matrix []Series
+
+// RangeParams are the parsed start/end/step parameters of a range query.
+type RangeParams struct {
+	Start time.Time
+	End   time.Time
+	Step  time.Duration
+}
+
+// steps returns the evaluation timestamps from start to end inclusive.
+func (p RangeParams) steps() []time.Time {
+	var ts []time.Time
+	for t := p.Start; !t.After(p.End); t = t.Add(p.Step) {
+		ts = append(ts, t)
+	}
+	return ts
+}
+
+func (h *HoneycombAdapter) handleQueryRange(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	ctx := r.Context()
+	h.ensureTelemetry()
+
+	ctx, span := h.tracer.Start(ctx, "handleQueryRange")
+	defer span.End()
+
+	params, err := requestParams(r)
+	if err != nil {
+		writePrometheusError(w, errorBadData, err)
+		return
+	}
+	query := params.Get("query")
+	span.SetAttributes(
+		attribute.String("query.promql", query),
+		attribute.String("query.start", params.Get("start")),
+		attribute.String("query.end", params.Get("end")),
+		attribute.String("query.step", params.Get("step")),
+		attribute.String("query.timeout", params.Get("timeout")),
+	)
+
+	log.Printf("🔍 Received PromQL range query: %s", query)
+
+	h.queryCounter.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("query_type", "promql_range"),
+	))
+	defer func() {
+		h.queryDuration.Record(ctx, time.Since(startTime).Seconds(), metric.WithAttributes(
+			attribute.String("query_type", "promql_range"),
+		))
+	}()
+
+	if query == "" {
+		span.SetAttributes(attribute.String("error", "missing query parameter"))
+		writePrometheusError(w, errorBadData, errors.New("query parameter is required"))
+		return
+	}
+
+	rng, err := parseRangeParams(params.Get("start"), params.Get("end"), params.Get("step"))
+	if err != nil {
+		log.Printf("❌ Invalid range parameters: %v", err)
+		span.SetAttributes(attribute.String("error", "invalid_range"))
+		writePrometheusError(w, errorBadData, err)
+		return
+	}
+
+	ctx, cancel, err := withTimeoutParam(ctx, params.Get("timeout"))
+	if err != nil {
+		span.SetAttributes(attribute.String("error", "invalid_timeout"))
+		writePrometheusError(w, errorBadData, err)
+		return
+	}
+	defer cancel()
+
+	plan, err := h.queryTranslator().Translate(query)
+	if err != nil {
+		log.Printf("❌ Query translation error: %v", err)
+		h.logError("Query translation error: %v", err)
+		span.SetAttributes(
+			attribute.String("error", "translation_failed"),
+			attribute.String("error.message", err.Error()),
+		)
+		writePrometheusError(w, errorBadData, err)
+		return
+	}
+
+	serviceName := h.extractServiceName(query)
+	span.SetAttributes(attribute.String("query.service", serviceName))
+
+	matrix, warnings, err := h.evaluatePlanRange(ctx, plan, rng)
+	if err != nil {
+		log.Printf("❌ Honeycomb query error: %v", err)
+		h.logError("Honeycomb query error: %v", err)
+		span.SetAttributes(
+			attribute.String("error", "honeycomb_query_failed"),
+			attribute.String("error.message", err.Error()),
+		)
+		h.honeycombErrors.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("service", serviceName),
+		))
+		writePrometheusError(w, classifyError(err), err)
+		return
+	}
+
+	promResponse := buildPrometheusMatrixResponse(matrix)
+	promResponse.Warnings = warnings
+	log.Printf("📊 Returning Prometheus matrix with %d series", len(matrix))
+
+	writePrometheusResponse(w, promResponse)
+}
+
+// parseRangeParams validates the start, end and step parameters of a range query.
+func parseRangeParams(start, end, step string) (RangeParams, error) {
+	var p RangeParams
+	var err error
+
+	if p.Start, err = parseTimeParam(start); err != nil {
+		return p, fmt.Errorf("invalid parameter \"start\": %v", err)
+	}
+	if p.End, err = parseTimeParam(end); err != nil {
+		return p, fmt.Errorf("invalid parameter \"end\": %v", err)
+	}
+	if p.End.Before(p.Start) {
+		return p, fmt.Errorf("invalid parameter \"end\": end timestamp must not be before start time")
+	}
+	if p.Step, err = parseStepParam(step); err != nil {
+		return p, fmt.Errorf("invalid parameter \"step\": %v", err)
+	}
+	if p.Step <= 0 {
+		return p, fmt.Errorf("invalid parameter \"step\": zero or negative query resolution step widths are not accepted. Try a positive integer")
+	}
+	// Honeycomb granularity is expressed in whole seconds.
+	if p.Step < time.Second {
+		p.Step = time.Second
+	}
+	p.Step = p.Step.Truncate(time.Second)
+	if p.End.Sub(p.Start)/p.Step >= maxRangePoints {
+		return p, fmt.Errorf("exceeded maximum resolution of %d points per timeseries. Try decreasing the query resolution (?step=XX)", maxRangePoints)
+	}
+	return p, nil
+}
+
+// parseTimeParam parses a Prometheus API timestamp: RFC3339 or Unix seconds.
+func parseTimeParam(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, fmt.Errorf("missing timestamp")
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// parseStepParam parses a step given as float seconds or a Prometheus duration.
+func parseStepParam(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, fmt.Errorf("missing step")
+	}
+	return parseDurationParam(s)
+}
+
+// evaluatePlanRange runs the plan's leaf queries as time series over the
+// requested range and evaluates the expression once per step. It returns the
+// warnings that apply to the range query.
+//
+// The backend returns one bucket per step, ending at the step timestamp.
+// Counted values, as in rate() and increase(), add up the buckets of their
+// window when it is a whole number of steps; other leaves are evaluated over
+// the single bucket, so the step replaces their window.
+func (h *HoneycombAdapter) evaluatePlanRange(ctx context.Context, plan *queryPlan, rng RangeParams) (Matrix, []string, error) {
+	ctx, span := h.tracer.Start(ctx, "evaluatePlanRange")
+	defer span.End()
+
+	leaves := plan.leaves()
+	windows := rangeWindows(leaves, rng)
+	results, err := h.rangeResults(ctx, leaves, windows, rng)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, leaf := range leaves {
+		if n := int(windows[leaf] / rng.Step); n > 1 {
+			results[i] = results[i].rollUp(rng, n)
+		}
+	}
+
+	ev := &evaluator{windows: windows}
+	out := map[string]*Series{}
+	for _, ts := range rng.steps() {
+		ev.results = make(map[*leafNode]Vector, len(leaves))
+		for i, leaf := range leaves {
+			ev.results[leaf] = results[i].at(ts)
+		}
+
+		v, err := ev.eval(plan.Root)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var samples Vector
+		switch v := v.(type) {
+		case scalarValue:
+			samples = Vector{{Metric: map[string]string{}, Value: float64(v)}}
+		case Vector:
+			samples = v
+		}
+		for _, s := range samples {
+			sig := labelSignature(s.Metric)
+			if out[sig] == nil {
+				out[sig] = &Series{Metric: s.Metric}
+			}
+			out[sig].Points = append(out[sig].Points, Point{T: ts, V: s.Value})
+		}
+	}
+
+	matrix := make(Matrix, 0, len(out))
+	for _, s := range out {
+		matrix = append(matrix, *s)
+	}
+	sort.Slice(matrix, func(i, j int) bool {
+		return labelSignature(matrix[i].Metric) < labelSignature(matrix[j].Metric)
+	})
+	return matrix, rangeWarnings(plan, leaves, windows, rng), nil
+}
+
+// rangeWindows returns the window each leaf's values cover in a range query
+// over rng: the leaf's own window if its buckets can be added up over it, or
+// else one step.
+func rangeWindows(leaves []*leafNode, rng RangeParams) map[*leafNode]time.Duration {
+	points := rng.End.Sub(rng.Start) / rng.Step
+	windows := make(map[*leafNode]time.Duration, len(leaves))
+	for _, leaf := range leaves {
+		window := rng.Step
+		// Only counted values add up, an @ selector is a single bucket, and
+		// the buckets before the first step count towards Honeycomb's limit.
+		if leaf.Per > 0 && leaf.At == nil && leaf.Window > rng.Step && leaf.Window%rng.Step == 0 &&
+			points+leaf.Window/rng.Step-1 < maxRangePoints {
+			window = leaf.Window
+		}
+		windows[leaf] = window
+	}
+	return windows
+}
+
+// rangeResults runs the leaf queries over rng. Leaves whose window spans
+// several steps are queried from that much earlier, so that the buckets of
+// the first step's window are there to add up; the other leaves keep rng, so
+// that the start of their @ start() does not move.
+func (h *HoneycombAdapter) rangeResults(ctx context.Context, leaves []*leafNode, windows map[*leafNode]time.Duration, rng RangeParams) ([]Matrix, error) {
+	var single, rolled []int
+	var lookback time.Duration
+	for i, leaf := range leaves {
+		if windows[leaf] > rng.Step {
+			rolled = append(rolled, i)
+			lookback = max(lookback, windows[leaf]-rng.Step)
+		} else {
+			single = append(single, i)
+		}
+	}
+
+	results := make([]Matrix, len(leaves))
+	g, ctx := errgroup.WithContext(ctx)
+	run := func(indexes []int, rng RangeParams) {
+		if len(indexes) == 0 {
+			return
+		}
+		g.Go(func() error {
+			queries := make([]*LeafQuery, len(indexes))
+			for j, i := range indexes {
+				queries[j] = &leaves[i].LeafQuery
+			}
+			matrices, err := h.queryBackend().Range(ctx, queries, rng)
+			if err != nil {
+				return err
+			}
+			for j, i := range indexes {
+				results[i] = matrices[j]
+			}
+			return nil
+		})
+	}
+	run(single, rng)
+	run(rolled, RangeParams{Start: rng.Start.Add(-lookback), End: rng.End, Step: rng.Step})
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// rangeWarnings returns the warnings of the plan for a range query. A leaf
+// whose window the step replaced gets a warning saying so instead of the
+// warning about its window bounds.
+func rangeWarnings(plan *queryPlan, leaves []*leafNode, windows map[*leafNode]time.Duration, rng RangeParams) []string {
+	replaced, kept := map[string]bool{}, map[string]bool{}
+	var stepWarnings []string
+	for _, leaf := range leaves {
+		if windows[leaf] == leaf.Window {
+			kept[leaf.WindowWarning] = true
+			continue
+		}
+		replaced[leaf.WindowWarning] = true
+		warning := fmt.Sprintf("range of %s replaced by the step of %s", leaf.Expr, formatDuration(rng.Step))
+		if !containsString(stepWarnings, warning) {
+			stepWarnings = append(stepWarnings, warning)
+		}
+	}
+
+	var out []string
+	for _, warning := range plan.Warnings {
+		if !replaced[warning] || kept[warning] {
+			out = append(out, warning)
+		}
+	}
+	return append(out, stepWarnings...)
+}
+
+// rangeQuery returns a copy of q that covers an absolute time range as a time
+// series with one bucket per step.
+func rangeQuery(q *HoneycombQuery, tr TimeRange, step time.Duration) *HoneycombQuery {
+	out := *q
+	out.TimeRange = 0
+	out.StartTime = tr.StartTime
+	out.EndTime = tr.EndTime
+	out.Granularity = int(step.Seconds())
+	return &out
+}
+
+// scale returns the matrix with every value multiplied by factor. A factor of
+// 0 or 1 leaves the matrix unchanged.
+func (m Matrix) scale(factor float64) Matrix {
+	if factor == 0 || factor == 1 {
+		return m
+	}
+	out := make(Matrix, len(m))
+	for i, s := range m {
+		points := make([]Point, len(s.Points))
+		for j, p := range s.Points {
+			points[j] = Point{T: p.T, V: p.V * factor}
+		}
+		out[i] = Series{Metric: s.Metric, Points: points}
+	}
+	return out
+}
+
+// rollUp returns the matrix with the value at each step of rng replaced by
+// the sum of the n steps ending at it. A series is left out of the steps
+// whose n steps have no points.
+func (m Matrix) rollUp(rng RangeParams, n int) Matrix {
+	out := make(Matrix, 0, len(m))
+	for _, s := range m {
+		values := make(map[int64]float64, len(s.Points))
+		for _, p := range s.Points {
+			values[p.T.UnixNano()] = p.V
+		}
+		var points []Point
+		for _, ts := range rng.steps() {
+			sum, found := 0.0, false
+			for i := 0; i < n; i++ {
+				if v, ok := values[ts.Add(-time.Duration(i)*rng.Step).UnixNano()]; ok {
+					sum, found = sum+v, true
+				}
+			}
+			if found {
+				points = append(points, Point{T: ts, V: sum})
+			}
+		}
+		if len(points) > 0 {
+			out = append(out, Series{Metric: s.Metric, Points: points})
+		}
+	}
+	return out
+}
+
+// at returns the samples of all series that have a point at ts.
+func (m Matrix) at(ts time.Time) Vector {
+	out := Vector{}
+	for _, s := range m {
+		for _, p := range s.Points {
+			if p.T.Equal(ts) {
+				out = append(out, Sample{Metric: s.Metric, Value: p.V})
+				break
+			}
+		}
+	}
+	return out
+}
+
+// honeycombResultToMatrix converts the time series of a Honeycomb query
+// result into a range vector aligned to the requested steps, with one series
+// per breakdown group. A bucket starting at b is reported at the step b+step,
+// i.e. the step at which it ends. As in the instant path, a COUNT or SUM is 0
+// at the steps whose bucket has no events.
+func (h *HoneycombAdapter) honeycombResultToMatrix(result *HoneycombQueryResult, calculation Calculation, breakdowns []breakdown, rng RangeParams) Matrix {
+	alias := calculation.Alias()
+	bySignature := map[string]*Series{}
+	for _, bucket := range result.Data.Series {
+		n := math.Round(float64(bucket.Time.Add(rng.Step).Sub(rng.Start)) / float64(rng.Step))
+		ts := rng.Start.Add(time.Duration(n) * rng.Step)
+		if ts.Before(rng.Start) || ts.After(rng.End) {
+			continue
+		}
+
+		labels, values := splitBreakdowns(bucket.Data, breakdowns)
+		sig := labelSignature(labels)
+		if bySignature[sig] == nil {
+			bySignature[sig] = &Series{Metric: labels}
+		}
+		if v, ok := h.extractValueFromDataPoint(values, alias); ok {
+			bySignature[sig].Points = append(bySignature[sig].Points, Point{T: ts, V: v})
+		}
+	}
+
+	if emptyIsZero(calculation) {
+		// Without a breakdown the single series exists even if Honeycomb
+		// returned no buckets at all
+		if len(breakdowns) == 0 && len(bySignature) == 0 {
+			bySignature[""] = &Series{Metric: map[string]string{}}
+		}
+		for _, s := range bySignature {
+			s.Points = fillSteps(s.Points, rng)
+		}
+	}
+
+	matrix := Matrix{}
+	for _, s := range bySignature {
+		if len(s.Points) == 0 {
+			continue
+		}
+		sort.Slice(s.Points, func(i, j int) bool { return s.Points[i].T.Before(s.Points[j].T) })
+		matrix = append(matrix, *s)
+	}
+	return matrix
+}
+
+// fillSteps adds a zero point at every step of rng that has no point yet.
+func fillSteps(points []Point, rng RangeParams) []Point {
+	have := make(map[int64]bool, len(points))
+	for _, p := range points {
+		have[p.T.UnixNano()] = true
+	}
+	for _, ts := range rng.steps() {
+		if !have[ts.UnixNano()] {
+			points = append(points, Point{T: ts})
+		}
+	}
+	return points
+}
+
+// buildPrometheusMatrixResponse renders a range vector as a Prometheus
+// range query response.
+func buildPrometheusMatrixResponse(matrix Matrix) *PrometheusResponse {
+	response := &PrometheusResponse{
+		Status: "success",
+		Data: PrometheusData{
+			ResultType: "matrix",
+			Result:     []PrometheusResult{},
+		},
+	}
+	for _, s := range matrix {
+		values := make([][]interface{}, 0, len(s.Points))
+		for _, p := range s.Points {
+			values = append(values, []interface{}{
+				float64(p.T.UnixMilli()) / 1000,
+				strconv.FormatFloat(p.V, 'f', -1, 64),
+			})
+		}
+		response.Data.Result = append(response.Data.Result, PrometheusResult{
+			Metric: s.Metric,
+			Values: values,
+		})
+	}
+	return response
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRangeParams(t *testing.T) {
+	tests := []struct {
+		name     string
+		start    string
+		end      string
+		step     string
+		wantStep time.Duration
+		wantErr  bool
+	}{
+		{
+			name:     "unix seconds and float step",
+			start:    "1700000000",
+			end:      "1700000600",
+			step:     "60",
+			wantStep: time.Minute,
+		},
+		{
+			name:     "rfc3339 and duration step",
+			start:    "2023-11-14T22:13:20Z",
+			end:      "2023-11-14T23:13:20Z",
+			step:     "1m30s",
+			wantStep: 90 * time.Second,
+		},
+		{
+			name:    "end before start",
+			start:   "1700000600",
+			end:     "1700000000",
+			step:    "60",
+			wantErr: true,
+		},
+		{
+			name:    "too many points",
+			start:   "1700000000",
+			end:     "1700086400",
+			step:    "15",
+			wantErr: true,
+		},
+		{
+			name:    "missing step",
+			start:   "1700000000",
+			end:     "1700000600",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := parseRangeParams(tt.start, tt.end, tt.step)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if p.Step != tt.wantStep {
+				t.Errorf("expected step %v, got %v", tt.wantStep, p.Step)
+			}
+		})
+	}
+}
+
+func TestQueryRangeIntegration(t *testing.T) {
+	start := time.Unix(1700000000, 0).UTC()
+
+	var sentQuery HoneycombQuery
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/1/queries/test":
+			json.NewDecoder(r.Body).Decode(&sentQuery)
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": "range-query"})
+		case "/1/query_results/test":
+			// Buckets start one step before each evaluation timestamp.
+			var buckets []interface{}
+			for i := 0; i < 3; i++ {
+				buckets = append(buckets, map[string]interface{}{
+					"time": start.Add(time.Duration(i-1) * time.Minute).Format(time.RFC3339),
+					"data": map[string]interface{}{"COUNT": float64(10 * (i + 1))},
+				})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{"series": buckets},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mockServer.Close()
+
+	adapter := &HoneycombAdapter{
+		honeycombAPIKey:  "test-key",
+		honeycombBaseURL: mockServer.URL,
+		queryTimeWindow:  3 * time.Minute,
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(adapter.handleQueryRange))
+	defer testServer.Close()
+
+	params := url.Values{}
+	params.Set("query", `sum(rate(http_requests_total{service="test"}[5m]))`)
+	params.Set("start", "1700000000")
+	params.Set("end", "1700000120")
+	params.Set("step", "60")
+
+	resp, err := http.Get(testServer.URL + "/api/v1/query_range?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	// The five buckets of the first step's window start four steps early.
+	if sentQuery.StartTime != 1700000000-300 || sentQuery.EndTime != 1700000120 || sentQuery.Granularity != 60 {
+		t.Errorf("unexpected Honeycomb time range: start=%d end=%d granularity=%d",
+			sentQuery.StartTime, sentQuery.EndTime, sentQuery.Granularity)
+	}
+	if sentQuery.TimeRange != 0 {
+		t.Errorf("expected relative time range to be cleared, got %d", sentQuery.TimeRange)
+	}
+
+	var result PrometheusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Data.ResultType != "matrix" {
+		t.Errorf("expected result type 'matrix', got %s", result.Data.ResultType)
+	}
+	if len(result.Data.Result) != 1 {
+		t.Fatalf("expected 1 series, got %d", len(result.Data.Result))
+	}
+	values := result.Data.Result[0].Values
+	if len(values) != 3 {
+		t.Fatalf("expected 3 samples, got %d", len(values))
+	}
+	for i, v := range values {
+		if ts := v[0].(float64); ts != float64(1700000000+60*i) {
+			t.Errorf("sample %d: expected timestamp %d, got %v", i, 1700000000+60*i, ts)
+		}
+	}
+	// 60 requests in the 5m window ending at the last step
+	if values[2][1] != "0.2" {
+		t.Errorf("expected last value 0.2, got %v", values[2][1])
+	}
+	if len(result.Warnings) != 0 {
+		t.Errorf("expected no warnings, got %q", result.Warnings)
+	}
+}
+
+func TestQueryRangeWarnings(t *testing.T) {
+	adapter := &HoneycombAdapter{
+		queryTimeWindow: 3 * time.Minute,
+		backend: &staticBackend{values: map[string]Vector{
+			"http_requests_total":                  {{Metric: map[string]string{}, Value: 42}},
+			"http_request_duration_seconds_bucket": {{Metric: map[string]string{}, Value: 0.25}},
+		}},
+	}
+	adapter.ensureTelemetry()
+
+	tests := []struct {
+		name         string
+		query        string
+		step         string
+		wantWarnings []string
+	}{
+		{
+			name:  "window of whole steps",
+			query: `sum(rate(http_requests_total{service="test"}[5m]))`,
+			step:  "60",
+		},
+		{
+			name:         "raised window of whole steps",
+			query:        `sum(rate(http_requests_total{service="test"}[30s]))`,
+			step:         "60",
+			wantWarnings: []string{`range of http_requests_total{service="test"} raised from 30s to the minimum query window of 3m`},
+		},
+		{
+			name:         "raised window replaced by the step",
+			query:        `sum(rate(http_requests_total{service="test"}[30s]))`,
+			step:         "100",
+			wantWarnings: []string{`range of http_requests_total{service="test"} replaced by the step of 1m40s`},
+		},
+		{
+			name:         "percentile window replaced by the step",
+			query:        `histogram_quantile(0.99, sum(rate(http_request_duration_seconds_bucket{service="test"}[5m])) by (le))`,
+			step:         "60",
+			wantWarnings: []string{`range of http_request_duration_seconds_bucket{service="test"} replaced by the step of 1m`},
+		},
+		{
+			name:         "@ window replaced by the step",
+			query:        `sum(increase(http_requests_total{service="test"}[5m] @ 1700000000))`,
+			step:         "60",
+			wantWarnings: []string{`range of http_requests_total{service="test"} @ 1700000000.000 replaced by the step of 1m`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := url.Values{"query": {tt.query}, "start": {"1700000000"}, "end": {"1700000600"}, "step": {tt.step}}
+			rec := httptest.NewRecorder()
+			adapter.handleQueryRange(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query_range?"+params.Encode(), nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+
+			var response PrometheusResponse
+			if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(response.Warnings, "\n") != strings.Join(tt.wantWarnings, "\n") {
+				t.Errorf("expected warnings %q, got %q", tt.wantWarnings, response.Warnings)
+			}
+		})
+	}
+}
+
+func TestHoneycombResultToMatrixEmptyBuckets(t *testing.T) {
+	start := time.Unix(1700000000, 0).UTC()
+	rng := RangeParams{Start: start, End: start.Add(2 * time.Minute), Step: time.Minute}
+	// bucket returns the Honeycomb bucket that ends at step i
+	bucket := func(i int, data map[string]interface{}) HoneycombSeriesBucket {
+		return HoneycombSeriesBucket{Time: start.Add(time.Duration(i-1) * time.Minute), Data: data}
+	}
+
+	tests := []struct {
+		name        string
+		calculation Calculation
+		breakdowns  []breakdown
+		buckets     []HoneycombSeriesBucket
+		// want maps each series' route label to its values at the three steps
+		want map[string][]float64
+	}{
+		{
+			name:        "count with a bucket without events",
+			calculation: Calculation{Op: "COUNT"},
+			buckets: []HoneycombSeriesBucket{
+				bucket(0, map[string]interface{}{"COUNT": 10.0}),
+				bucket(2, map[string]interface{}{"COUNT": 30.0}),
+			},
+			want: map[string][]float64{"": {10, 0, 30}},
+		},
+		{
+			name:        "count without any buckets",
+			calculation: Calculation{Op: "COUNT"},
+			want:        map[string][]float64{"": {0, 0, 0}},
+		},
+		{
+			name:        "sum of a bucket without a value",
+			calculation: Calculation{Op: "SUM", Column: "cart_size"},
+			buckets: []HoneycombSeriesBucket{
+				bucket(0, map[string]interface{}{"SUM(cart_size)": 5.0}),
+				bucket(1, map[string]interface{}{"SUM(cart_size)": nil}),
+				bucket(2, map[string]interface{}{"SUM(cart_size)": 7.0}),
+			},
+			want: map[string][]float64{"": {5, 0, 7}},
+		},
+		{
+			name:        "broken-down count",
+			calculation: Calculation{Op: "COUNT"},
+			breakdowns:  []breakdown{{Label: "route", Column: "http.route"}},
+			buckets: []HoneycombSeriesBucket{
+				bucket(0, map[string]interface{}{"http.route": "/", "COUNT": 1.0}),
+				bucket(1, map[string]interface{}{"http.route": "/api", "COUNT": 2.0}),
+				bucket(2, map[string]interface{}{"http.route": "/", "COUNT": 3.0}),
+			},
+			want: map[string][]float64{"/": {1, 0, 3}, "/api": {0, 2, 0}},
+		},
+		{
+			name:        "average stays undefined without events",
+			calculation: Calculation{Op: "AVG", Column: "duration_ms"},
+			buckets: []HoneycombSeriesBucket{
+				bucket(0, map[string]interface{}{"AVG(duration_ms)": 12.0}),
+				bucket(2, map[string]interface{}{"AVG(duration_ms)": 14.0}),
+			},
+			want: map[string][]float64{"": {12, 14}},
+		},
+	}
+
+	adapter := &HoneycombAdapter{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := &HoneycombQueryResult{Data: HoneycombResultData{Series: tt.buckets}}
+			matrix := adapter.honeycombResultToMatrix(result, tt.calculation, tt.breakdowns, rng)
+
+			got := map[string][]float64{}
+			for _, s := range matrix {
+				for _, p := range s.Points {
+					got[s.Metric["route"]] = append(got[s.Metric["route"]], p.V)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// errRateLimited is returned when the Honeycomb query budget did not allow a
+// call before the request's deadline.
+var errRateLimited = errors.New("honeycomb query budget exhausted, try again later")
+
+// rateLimitConfig controls the client-side budget for Honeycomb API calls.
+type rateLimitConfig struct {
+	// PerHour is the number of calls allowed per hour; 0 disables the limit.
+	PerHour int
+	// Burst is the number of calls that may be made at once after a quiet
+	// period.
+	Burst int
+	// Queue makes calls wait for budget instead of failing immediately.
+	Queue bool
+	// MaxWait bounds the wait for requests without an earlier deadline.
+	MaxWait time.Duration
+}
+
+// loadRateLimitConfig reads the rate limit settings from the environment.
+func loadRateLimitConfig() rateLimitConfig {
+	cfg := rateLimitConfig{Queue: true}
+	cfg.MaxWait = envDuration("HONEYCOMB_RATE_LIMIT_MAX_WAIT", 30*time.Second)
+
+	if s := getEnv("HONEYCOMB_RATE_LIMIT_PER_HOUR", ""); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+			cfg.PerHour = n
+		} else {
+			log.Printf("❌ Invalid HONEYCOMB_RATE_LIMIT_PER_HOUR value '%s', rate limit disabled", s)
+		}
+	}
+
+	// Default to a minute's worth of budget
+	cfg.Burst = cfg.PerHour / 60
+	if cfg.Burst < 1 {
+		cfg.Burst = 1
+	}
+	if s := getEnv("HONEYCOMB_RATE_LIMIT_BURST", ""); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			cfg.Burst = n
+		} else {
+			log.Printf("❌ Invalid HONEYCOMB_RATE_LIMIT_BURST value '%s', using default %d", s, cfg.Burst)
+		}
+	}
+
+	switch mode := getEnv("HONEYCOMB_RATE_LIMIT_MODE", "queue"); mode {
+	case "queue":
+	case "reject":
+		cfg.Queue = false
+	default:
+		log.Printf("❌ Invalid HONEYCOMB_RATE_LIMIT_MODE value '%s', using queue", mode)
+	}
+	return cfg
+}
+
+// rateLimiter is a token bucket shared by all outgoing Honeycomb calls.
+// Calls that find the bucket empty queue per dataset, and freed budget is
+// handed to the datasets in turn, so one busy dataset cannot starve the
+// canaries of the others.
+type rateLimiter struct {
+	limiter *rate.Limiter
+	queue   bool
+	maxWait time.Duration
+
+	mu sync.Mutex
+	// waiting holds the queued calls of each dataset, oldest first.
+	waiting map[string][]chan struct{}
+	// datasets lists the datasets with queued calls in round-robin order;
+	// next is the one served next.
+	datasets []string
+	next     int
+	// stop is non-nil while a dispatcher runs, and is closed to stop it
+	// when every queued call has given up.
+	stop chan struct{}
+}
+
+// newRateLimiter returns a limiter for cfg, or nil if the limit is disabled.
+func newRateLimiter(cfg rateLimitConfig) *rateLimiter {
+	if cfg.PerHour <= 0 {
+		return nil
+	}
+	burst := cfg.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		limiter: rate.NewLimiter(rate.Limit(float64(cfg.PerHour)/time.Hour.Seconds()), burst),
+		queue:   cfg.Queue,
+		maxWait: cfg.MaxWait,
+		waiting: map[string][]chan struct{}{},
+	}
+}
+
+// wait blocks until a call to dataset fits the budget. It returns
+// errRateLimited if the budget does not allow the call before ctx's deadline
+// or the maximum wait, or straight away when queueing is disabled.
+func (l *rateLimiter) wait(ctx context.Context, dataset string) error {
+	l.mu.Lock()
+	// Calls only skip the queue when nobody is waiting
+	if len(l.datasets) == 0 && l.limiter.Allow() {
+		l.mu.Unlock()
+		return nil
+	}
+	if !l.queue {
+		l.mu.Unlock()
+		return errRateLimited
+	}
+
+	ready := make(chan struct{})
+	if _, ok := l.waiting[dataset]; !ok {
+		l.datasets = append(l.datasets, dataset)
+	}
+	l.waiting[dataset] = append(l.waiting[dataset], ready)
+	if l.stop == nil {
+		l.stop = make(chan struct{})
+		go l.dispatch(l.stop)
+	}
+	l.mu.Unlock()
+
+	waitCtx := ctx
+	if l.maxWait > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, l.maxWait)
+		defer cancel()
+	}
+
+	select {
+	case <-ready:
+		return nil
+	case <-waitCtx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-ready:
+		// Budget was handed over while we were giving up
+		return nil
+	default:
+	}
+	l.removeLocked(dataset, ready)
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return ctx.Err()
+	}
+	return errRateLimited
+}
+
+// dispatch hands out budget to the queued calls as it becomes available,
+// until the queue is empty or stop is closed.
+func (l *rateLimiter) dispatch(stop chan struct{}) {
+	for {
+		reservation := l.limiter.Reserve()
+		timer := time.NewTimer(reservation.Delay())
+		select {
+		case <-timer.C:
+		case <-stop:
+			// Nobody is left to use the token
+			timer.Stop()
+			reservation.Cancel()
+			return
+		}
+
+		l.mu.Lock()
+		select {
+		case <-stop:
+			// The queue emptied as the timer fired; a newer dispatcher
+			// serves any calls queued since
+			l.mu.Unlock()
+			return
+		default:
+		}
+		if ready, ok := l.popLocked(); ok {
+			close(ready)
+		}
+		if len(l.datasets) == 0 {
+			l.stop = nil
+			l.mu.Unlock()
+			return
+		}
+		l.mu.Unlock()
+	}
+}
+
+// popLocked removes the oldest queued call of the next dataset in turn.
+func (l *rateLimiter) popLocked() (chan struct{}, bool) {
+	if len(l.datasets) == 0 {
+		return nil, false
+	}
+	l.next %= len(l.datasets)
+	dataset := l.datasets[l.next]
+	queue := l.waiting[dataset]
+	ready := queue[0]
+	if len(queue) == 1 {
+		delete(l.waiting, dataset)
+		l.datasets = append(l.datasets[:l.next], l.datasets[l.next+1:]...)
+	} else {
+		l.waiting[dataset] = queue[1:]
+		l.next++
+	}
+	return ready, true
+}
+
+// removeLocked drops a queued call that gave up.
+func (l *rateLimiter) removeLocked(dataset string, ready chan struct{}) {
+	queue := l.waiting[dataset]
+	for i, c := range queue {
+		if c == ready {
+			queue = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) > 0 {
+		l.waiting[dataset] = queue
+		return
+	}
+
+	delete(l.waiting, dataset)
+	for i, d := range l.datasets {
+		if d == dataset {
+			l.datasets = append(l.datasets[:i], l.datasets[i+1:]...)
+			if i < l.next {
+				l.next--
+			}
+			break
+		}
+	}
+	if len(l.datasets) == 0 && l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+}
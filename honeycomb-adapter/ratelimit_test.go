@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReject(t *testing.T) {
+	limiter := newRateLimiter(rateLimitConfig{PerHour: 1, Burst: 2})
+
+	for i, want := range []error{nil, nil, errRateLimited} {
+		if err := limiter.wait(context.Background(), "test"); !errors.Is(err, want) {
+			t.Errorf("call %d: expected %v, got %v", i+1, want, err)
+		}
+	}
+}
+
+func TestRateLimiterQueueGivesUp(t *testing.T) {
+	limiter := newRateLimiter(rateLimitConfig{PerHour: 1, Burst: 1, Queue: true, MaxWait: time.Minute})
+	if err := limiter.wait(context.Background(), "test"); err != nil {
+		t.Fatalf("expected first call to pass, got %v", err)
+	}
+
+	deadline, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := limiter.wait(deadline, "test"); !errors.Is(err, errRateLimited) {
+		t.Errorf("expected errRateLimited at the request deadline, got %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limiter.wait(cancelled, "test"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled for a cancelled request, got %v", err)
+	}
+
+	limiter.mu.Lock()
+	if len(limiter.datasets) != 0 || len(limiter.waiting) != 0 || limiter.stop != nil {
+		t.Errorf("expected calls that gave up to leave the queue, got %v", limiter.waiting)
+	}
+	limiter.mu.Unlock()
+
+	// The dispatcher hands back the token it reserved for them
+	for start := time.Now(); limiter.limiter.Tokens() < -0.5; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("expected the reserved token to be returned, have %v tokens", limiter.limiter.Tokens())
+		}
+	}
+}
+
+func TestRateLimiterDatasetFairness(t *testing.T) {
+	// One token every 20ms
+	limiter := newRateLimiter(rateLimitConfig{PerHour: 180000, Burst: 1, Queue: true, MaxWait: time.Minute})
+	if err := limiter.wait(context.Background(), "busy"); err != nil {
+		t.Fatalf("expected first call to pass, got %v", err)
+	}
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	for _, dataset := range []string{"busy", "busy", "busy", "quiet"} {
+		wg.Add(1)
+		go func(dataset string) {
+			defer wg.Done()
+			if err := limiter.wait(context.Background(), dataset); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, dataset)
+			mu.Unlock()
+		}(dataset)
+		// Queue the calls in order
+		time.Sleep(2 * time.Millisecond)
+	}
+	wg.Wait()
+
+	expected := "busy,quiet,busy,busy"
+	if got := strings.Join(order, ","); got != expected {
+		t.Errorf("expected calls to be served as %s, got %s", expected, got)
+	}
+}
+
+func TestHandleQueryRateLimited(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": "query-1"})
+	}))
+	defer mockServer.Close()
+
+	adapter := &HoneycombAdapter{
+		honeycombAPIKey:  "test-key",
+		honeycombBaseURL: mockServer.URL,
+		queryTimeWindow:  3 * time.Minute,
+		// Enough budget to create the query but not to run it
+		rateLimiter: newRateLimiter(rateLimitConfig{PerHour: 1, Burst: 1}),
+	}
+	adapter.ensureTelemetry()
+
+	query := "/api/v1/query?query=" + strings.ReplaceAll(`sum(rate(http_requests_total{service="test"}[5m]))`, `"`, "%22")
+	w := httptest.NewRecorder()
+	adapter.handleQuery(w, httptest.NewRequest("GET", query, nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %d: %s", w.Code, w.Body.String())
+	}
+	var response PrometheusErrorResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode error response: %v", err)
+	}
+	if response.Status != "error" || response.ErrorType != "unavailable" || response.Error == "" {
+		t.Errorf("expected a Prometheus unavailable error, got %+v", response)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// errCircuitOpen is returned without calling Honeycomb while the circuit
+// breaker is open.
+var errCircuitOpen = errors.New("honeycomb circuit breaker is open, failing fast")
+
+// retryConfig controls retries of failed Honeycomb API calls.
+type retryConfig struct {
+	// MaxAttempts is the number of tries per call, including the first.
+	MaxAttempts int
+	// BaseDelay is the backoff before the first retry; it doubles per retry.
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff. A Retry-After longer than this is not
+	// waited for and the error is returned instead.
+	MaxDelay time.Duration
+}
+
+var defaultRetryConfig = retryConfig{
+	MaxAttempts: 3,
+	BaseDelay:   200 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+}
+
+// loadRetryConfig reads the retry settings from the environment.
+func loadRetryConfig() retryConfig {
+	cfg := defaultRetryConfig
+	cfg.BaseDelay = envDuration("HONEYCOMB_RETRY_BASE_DELAY", cfg.BaseDelay)
+	cfg.MaxDelay = envDuration("HONEYCOMB_RETRY_MAX_DELAY", cfg.MaxDelay)
+	if s := getEnv("HONEYCOMB_RETRY_MAX_ATTEMPTS", ""); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			cfg.MaxAttempts = n
+		} else {
+			log.Printf("❌ Invalid HONEYCOMB_RETRY_MAX_ATTEMPTS value '%s', using default %d", s, cfg.MaxAttempts)
+		}
+	}
+	return cfg
+}
+
+// backoff returns the jittered wait before the given retry (1-based): a
+// random duration up to BaseDelay*2^(retry-1), capped at MaxDelay.
+func (c retryConfig) backoff(retry int) time.Duration {
+	d := c.BaseDelay
+	for i := 1; i < retry && d < c.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > c.MaxDelay {
+		d = c.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
+
+// isRetryable reports whether a failed Honeycomb call may succeed if retried:
+// rate limiting, server errors and network failures. Cancellation is final.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr *HoneycombAPIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= 500
+	}
+	var netErr interface{ Timeout() bool }
+	return errors.As(err, &netErr)
+}
+
+// isThrottled reports whether Honeycomb refused a call with 429 Too Many
+// Requests.
+func isThrottled(err error) bool {
+	var apiErr *HoneycombAPIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusTooManyRequests
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// breakerState is the state of a circuitBreaker.
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half_open"
+)
+
+// circuitBreaker stops calls to Honeycomb after consecutive failures. Once
+// the cooldown has passed a single trial call is let through: its success
+// closes the breaker, its failure opens it again.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	// onTransition is called, with the lock held, on every state change.
+	onTransition func(from, to breakerState)
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		state:     breakerClosed,
+	}
+}
+
+// allow reports whether a call may proceed.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.transition(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// success records that Honeycomb answered an allowed call.
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	b.failures = 0
+	if b.state != breakerClosed {
+		b.transition(breakerClosed)
+	}
+}
+
+// failure records that an allowed call failed because Honeycomb was
+// unavailable.
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = b.now()
+		if b.state != breakerOpen {
+			b.transition(breakerOpen)
+		}
+	}
+}
+
+// release records an allowed call that ended without telling anything about
+// Honeycomb's health, such as a cancelled request.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *circuitBreaker) transition(to breakerState) {
+	from := b.state
+	b.state = to
+	if b.onTransition != nil {
+		b.onTransition(from, to)
+	}
+}
+
+// loadCircuitBreaker creates the breaker configured in the environment, or
+// nil if it is disabled with a threshold of 0.
+func (h *HoneycombAdapter) loadCircuitBreaker() *circuitBreaker {
+	threshold := 5
+	if s := getEnv("HONEYCOMB_BREAKER_THRESHOLD", ""); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+			threshold = n
+		} else {
+			log.Printf("❌ Invalid HONEYCOMB_BREAKER_THRESHOLD value '%s', using default %d", s, threshold)
+		}
+	}
+	if threshold == 0 {
+		return nil
+	}
+
+	b := newCircuitBreaker(threshold, envDuration("HONEYCOMB_BREAKER_COOLDOWN", 30*time.Second))
+	b.onTransition = func(from, to breakerState) {
+		log.Printf("🔌 Honeycomb circuit breaker %s -> %s", from, to)
+		h.breakerTransitions.Add(context.Background(), 1, metric.WithAttributes(
+			attribute.String("from", string(from)),
+			attribute.String("to", string(to)),
+		))
+	}
+	return b
+}
+
+// callHoneycomb runs a Honeycomb API call on dataset through the circuit
+// breaker and the rate limiter, retrying retryable failures with jittered
+// exponential backoff. A Retry-After sent with a 429 or 503 is honoured
+// instead of the backoff.
+func (h *HoneycombAdapter) callHoneycomb(ctx context.Context, dataset, operation string, call func() error) error {
+	return h.callHoneycombWith(ctx, h.rateLimiter, dataset, operation, call)
+}
+
+// callHoneycombWith is callHoneycomb drawing budget from limiter, which may
+// be nil for calls outside the query budget.
+func (h *HoneycombAdapter) callHoneycombWith(ctx context.Context, limiter *rateLimiter, dataset, operation string, call func() error) error {
+	if h.breaker != nil && !h.breaker.allow() {
+		log.Printf("🔌 Circuit breaker open, not calling Honeycomb (%s)", operation)
+		return errCircuitOpen
+	}
+
+	cfg := h.retrySettings()
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = h.waitForBudget(ctx, limiter, dataset, operation); err != nil {
+			break
+		}
+		err = call()
+		if err == nil || !isRetryable(err) || attempt >= cfg.MaxAttempts {
+			break
+		}
+
+		wait := cfg.backoff(attempt)
+		var apiErr *HoneycombAPIError
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+			if apiErr.RetryAfter > cfg.MaxDelay {
+				log.Printf("⚠️  Honeycomb asked to retry %s after %s, longer than the %s limit", operation, apiErr.RetryAfter, cfg.MaxDelay)
+				break
+			}
+			wait = apiErr.RetryAfter + wait/10
+		}
+
+		log.Printf("🔁 Retrying %s in %s (attempt %d/%d): %v", operation, wait, attempt+1, cfg.MaxAttempts, err)
+		h.honeycombRetries.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("operation", operation),
+		))
+		if sleepErr := sleepContext(ctx, wait); sleepErr != nil {
+			err = fmt.Errorf("%w (retry cancelled: %v)", err, sleepErr)
+			break
+		}
+	}
+
+	// Only failures that point at Honeycomb being unhealthy trip the
+	// breaker; a 404 or 400 is still an answer from a healthy API, and a 429
+	// only asks to back off, which the retries already do.
+	if h.breaker != nil {
+		switch {
+		case err == nil:
+			h.breaker.success()
+		case isThrottled(err), errors.Is(err, errRateLimited), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+			h.breaker.release()
+		case isRetryable(err):
+			h.breaker.failure()
+		default:
+			h.breaker.success()
+		}
+	}
+	return err
+}
+
+// waitForBudget waits until limiter allows a call on dataset.
+func (h *HoneycombAdapter) waitForBudget(ctx context.Context, limiter *rateLimiter, dataset, operation string) error {
+	if limiter == nil {
+		return nil
+	}
+	err := limiter.wait(ctx, dataset)
+	if errors.Is(err, errRateLimited) {
+		log.Printf("🚦 Honeycomb query budget exhausted, not calling %s for dataset %s", operation, dataset)
+		h.rateLimited.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("dataset", dataset),
+			attribute.String("operation", operation),
+		))
+	}
+	return err
+}
+
+// retrySettings returns the adapter's retry configuration, defaulting unset
+// fields.
+func (h *HoneycombAdapter) retrySettings() retryConfig {
+	cfg := h.retry
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultRetryConfig.MaxAttempts
+	}
+	if cfg.BaseDelay <= 0 {
+		cfg.BaseDelay = defaultRetryConfig.BaseDelay
+	}
+	if cfg.MaxDelay <= 0 {
+		cfg.MaxDelay = defaultRetryConfig.MaxDelay
+	}
+	return cfg
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		header   string
+		expected time.Duration
+	}{
+		{name: "missing", header: "", expected: 0},
+		{name: "seconds", header: "3", expected: 3 * time.Second},
+		{name: "HTTP date", header: "Mon, 01 Jan 2024 12:00:05 GMT", expected: 5 * time.Second},
+		{name: "date in the past", header: "Mon, 01 Jan 2024 11:59:00 GMT", expected: 0},
+		{name: "garbage", header: "soon", expected: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.header, now); got != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestCallHoneycombRetries(t *testing.T) {
+	unavailable := &HoneycombAPIError{StatusCode: http.StatusServiceUnavailable}
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "success", errs: []error{nil}, wantCalls: 1},
+		{name: "server error then success", errs: []error{unavailable, nil}, wantCalls: 2},
+		{name: "rate limited then success", errs: []error{&HoneycombAPIError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Millisecond}, nil}, wantCalls: 2},
+		{name: "gives up after max attempts", errs: []error{unavailable, unavailable, unavailable, nil}, wantCalls: 3, wantErr: true},
+		{name: "not found is not retried", errs: []error{&HoneycombAPIError{StatusCode: http.StatusNotFound}, nil}, wantCalls: 1, wantErr: true},
+		{name: "long Retry-After is not waited for", errs: []error{&HoneycombAPIError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Minute}, nil}, wantCalls: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &HoneycombAdapter{
+				retry: retryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond},
+			}
+			adapter.ensureTelemetry()
+
+			calls := 0
+			err := adapter.callHoneycomb(context.Background(), "test", "test", func() error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error=%v, got %v", tt.wantErr, err)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("expected %d calls, got %d", tt.wantCalls, calls)
+			}
+		})
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	breaker := newCircuitBreaker(2, 30*time.Second)
+	breaker.now = func() time.Time { return now }
+	var transitions []string
+	breaker.onTransition = func(from, to breakerState) {
+		transitions = append(transitions, string(from)+"->"+string(to))
+	}
+
+	adapter := &HoneycombAdapter{
+		retry:   retryConfig{MaxAttempts: 1},
+		breaker: breaker,
+	}
+	adapter.ensureTelemetry()
+
+	unavailable := func() error { return &HoneycombAPIError{StatusCode: http.StatusBadGateway} }
+	notFound := func() error { return &HoneycombAPIError{StatusCode: http.StatusNotFound} }
+	throttled := func() error { return &HoneycombAPIError{StatusCode: http.StatusTooManyRequests} }
+	ok := func() error { return nil }
+
+	steps := []struct {
+		name      string
+		advance   time.Duration
+		call      func() error
+		wantState breakerState
+		wantOpen  bool
+	}{
+		{name: "first failure", call: unavailable, wantState: breakerClosed},
+		{name: "not found does not count", call: notFound, wantState: breakerClosed},
+		{name: "throttling does not count", call: throttled, wantState: breakerClosed},
+		{name: "throttling again does not count", call: throttled, wantState: breakerClosed},
+		{name: "second failure", call: unavailable, wantState: breakerClosed},
+		{name: "threshold reached", call: unavailable, wantState: breakerOpen},
+		{name: "fails fast while open", advance: 10 * time.Second, call: ok, wantState: breakerOpen, wantOpen: true},
+		{name: "failed trial reopens", advance: 30 * time.Second, call: unavailable, wantState: breakerOpen},
+		{name: "cooldown restarts", advance: 10 * time.Second, call: ok, wantState: breakerOpen, wantOpen: true},
+		{name: "successful trial closes", advance: 30 * time.Second, call: ok, wantState: breakerClosed},
+	}
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		err := adapter.callHoneycomb(context.Background(), "test", "test", step.call)
+		if got := errors.Is(err, errCircuitOpen); got != step.wantOpen {
+			t.Errorf("%s: expected circuit open error=%v, got %v", step.name, step.wantOpen, err)
+		}
+		if breaker.state != step.wantState {
+			t.Errorf("%s: expected state %s, got %s", step.name, step.wantState, breaker.state)
+		}
+	}
+
+	expected := "closed->open,open->half_open,half_open->open,open->half_open,half_open->closed"
+	if got := strings.Join(transitions, ","); got != expected {
+		t.Errorf("expected transitions %s, got %s", expected, got)
+	}
+}
+
+func TestHandleQueryCircuitOpen(t *testing.T) {
+	var requests int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer mockServer.Close()
+
+	adapter := &HoneycombAdapter{
+		honeycombAPIKey:  "test-key",
+		honeycombBaseURL: mockServer.URL,
+		queryTimeWindow:  3 * time.Minute,
+		retry:            retryConfig{MaxAttempts: 2, BaseDelay: time.Millisecond},
+		breaker:          newCircuitBreaker(1, time.Minute),
+	}
+	adapter.ensureTelemetry()
+
+	query := "/api/v1/query?query=" + strings.ReplaceAll(`sum(rate(http_requests_total{service="test"}[5m]))`, `"`, "%22")
+	for i, wantError := range []string{"status 503", "circuit breaker is open"} {
+		w := httptest.NewRecorder()
+		adapter.handleQuery(w, httptest.NewRequest("GET", query, nil))
+		if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), wantError) {
+			t.Errorf("request %d: expected status 503 with %q, got %d: %s", i+1, wantError, w.Code, w.Body.String())
+		}
+	}
+	if requests != 2 {
+		t.Errorf("expected 2 Honeycomb requests before the breaker opened, got %d", requests)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// serverConfig holds the HTTP server timeouts and the shutdown schedule.
+type serverConfig struct {
+	// ReadHeaderTimeout bounds reading a request's headers.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout bounds reading a whole request, including a POSTed query.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds handling a request; it must leave room for
+	// Honeycomb polling, retries and rate limit waits.
+	WriteTimeout time.Duration
+	// IdleTimeout bounds how long a keep-alive connection waits for the
+	// next request.
+	IdleTimeout time.Duration
+	// DrainDelay is how long the readiness check fails before the server
+	// stops accepting connections, so the pod leaves the Service endpoints
+	// first.
+	DrainDelay time.Duration
+	// GracePeriod bounds the wait for in-flight requests after that. Requests
+	// still running are then cancelled, which stops their Honeycomb polls.
+	GracePeriod time.Duration
+}
+
+// defaultServerConfig fits within the default Kubernetes termination grace
+// period of 30s: the drain delay, grace period, cancelledRequestsWait and
+// telemetryFlushTimeout add up to 28s.
+var defaultServerConfig = serverConfig{
+	ReadHeaderTimeout: 10 * time.Second,
+	ReadTimeout:       30 * time.Second,
+	WriteTimeout:      2 * time.Minute,
+	IdleTimeout:       2 * time.Minute,
+	DrainDelay:        5 * time.Second,
+	GracePeriod:       15 * time.Second,
+}
+
+// cancelledRequestsWait bounds the wait for requests to return after their
+// contexts are cancelled at the end of the grace period.
+const cancelledRequestsWait = 3 * time.Second
+
+// telemetryFlushTimeout bounds flushing pending spans and metrics on exit.
+const telemetryFlushTimeout = 5 * time.Second
+
+// loadServerConfig reads the server settings from the environment, falling
+// back to the defaults for missing or invalid values.
+func loadServerConfig() serverConfig {
+	cfg := defaultServerConfig
+	cfg.ReadHeaderTimeout = envDuration("HTTP_READ_HEADER_TIMEOUT", cfg.ReadHeaderTimeout)
+	cfg.ReadTimeout = envDuration("HTTP_READ_TIMEOUT", cfg.ReadTimeout)
+	cfg.WriteTimeout = envDuration("HTTP_WRITE_TIMEOUT", cfg.WriteTimeout)
+	cfg.IdleTimeout = envDuration("HTTP_IDLE_TIMEOUT", cfg.IdleTimeout)
+	cfg.DrainDelay = envDuration("SHUTDOWN_DRAIN_DELAY", cfg.DrainDelay)
+	cfg.GracePeriod = envDuration("SHUTDOWN_GRACE_PERIOD", cfg.GracePeriod)
+	return cfg
+}
+
+// newServer returns the adapter's HTTP server for handler.
+func (h *HoneycombAdapter) newServer(addr string, handler http.Handler, cfg serverConfig) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h.trackInFlight(handler),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+// trackInFlight counts the requests being handled.
+func (h *HoneycombAdapter) trackInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.inFlight.Add(1)
+		defer h.inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serve runs server on ln until ctx is cancelled, then drains it: the
+// readiness check fails for cfg.DrainDelay, in-flight requests get
+// cfg.GracePeriod to finish, and requests still running after that are
+// cancelled.
+func (h *HoneycombAdapter) serve(ctx context.Context, server *http.Server, ln net.Listener, cfg serverConfig) error {
+	// Requests run in a context of their own, so that they keep running
+	// while ctx is done, until the grace period runs out
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	server.BaseContext = func(net.Listener) context.Context { return requestsCtx }
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(ln)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("🛑 Shutdown requested, failing readiness for %s before draining", cfg.DrainDelay)
+	h.draining.Store(true)
+	time.Sleep(cfg.DrainDelay)
+
+	log.Printf("🛑 Draining %d in-flight requests (grace period %s)", h.inFlight.Load(), cfg.GracePeriod)
+	graceCtx, cancel := context.WithTimeout(context.Background(), cfg.GracePeriod)
+	defer cancel()
+	err := server.Shutdown(graceCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("⏰ Grace period over, cancelling %d in-flight requests", h.inFlight.Load())
+		cancelRequests()
+		waitCtx, cancel := context.WithTimeout(context.Background(), cancelledRequestsWait)
+		defer cancel()
+		if err = server.Shutdown(waitCtx); err != nil {
+			log.Printf("⚠️  Closing %d requests that ignored cancellation", h.inFlight.Load())
+			err = server.Close()
+		}
+	} else if err == nil {
+		log.Printf("✅ All in-flight requests completed")
+	}
+	if err != nil {
+		return err
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// startServer serves handler through serve and returns its URL, a function
+// that starts the shutdown, and the channel serve's result is sent on.
+func startServer(t *testing.T, adapter *HoneycombAdapter, handler http.Handler, cfg serverConfig) (string, context.CancelFunc, chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, shutdown := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- adapter.serve(ctx, adapter.newServer(ln.Addr().String(), handler, cfg), ln, cfg)
+	}()
+	t.Cleanup(shutdown)
+	return "http://" + ln.Addr().String(), shutdown, done
+}
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	adapter := &HoneycombAdapter{}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+	url, shutdown, done := startServer(t, adapter, handler, serverConfig{DrainDelay: 50 * time.Millisecond, GracePeriod: 5 * time.Second})
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	<-started
+	shutdown()
+
+	// Readiness fails as soon as the drain begins
+	deadline := time.Now().Add(time.Second)
+	for !adapter.draining.Load() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	rec := httptest.NewRecorder()
+	adapter.handleReady(rec, httptest.NewRequest(http.MethodGet, "/-/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected readiness to fail while draining, got %d", rec.Code)
+	}
+
+	close(release)
+	if code := <-status; code != http.StatusOK {
+		t.Errorf("expected the in-flight request to complete, got status %d", code)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("unexpected serve error: %v", err)
+	}
+}
+
+func TestServeCancelsRequestsAfterGracePeriod(t *testing.T) {
+	adapter := &HoneycombAdapter{}
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		// Stands in for a Honeycomb poll, which stops when its context does
+		<-r.Context().Done()
+		close(cancelled)
+	})
+	url, shutdown, done := startServer(t, adapter, handler, serverConfig{GracePeriod: 50 * time.Millisecond})
+
+	go func() {
+		if resp, err := http.Get(url); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+	shutdown()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected serve error: %v", err)
+		}
+	case <-time.After(cancelledRequestsWait):
+		t.Fatal("serve did not return after the grace period")
+	}
+	select {
+	case <-cancelled:
+	default:
+		t.Error("expected the in-flight request to be cancelled")
+	}
+	if n := adapter.inFlight.Load(); n != 0 {
+		t.Errorf("expected no requests in flight, got %d", n)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// metricTemplate is the part of a Flagger MetricTemplate the adapter serves.
+type metricTemplate struct {
+	Kind     string `yaml:"kind"`
+	Metadata struct {
+		Name string `yaml:"name"`
+	} `yaml:"metadata"`
+	Spec struct {
+		Query string `yaml:"query"`
+	} `yaml:"spec"`
+}
+
+// flaggerVariables renders the variables Flagger provides to metric
+// templates for a canary named podinfo.
+var flaggerVariables = strings.NewReplacer(
+	"{{ target }}", "podinfo",
+	"{{ namespace }}", "test",
+	"{{ interval }}", "1m",
+)
+
+func TestExampleMetricTemplates(t *testing.T) {
+	data, err := os.ReadFile("../honeycomb-metric-templates.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var templates []metricTemplate
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var tmpl metricTemplate
+		if err := decoder.Decode(&tmpl); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatalf("failed to parse template %d: %v", len(templates)+1, err)
+		}
+		templates = append(templates, tmpl)
+	}
+
+	expected := []struct {
+		name   string
+		metric string
+		// canaryOnly templates must select the canary workload alone
+		canaryOnly bool
+	}{
+		{name: "honeycomb-success-rate", metric: "http_requests_total", canaryOnly: true},
+		{name: "honeycomb-latency", metric: "http_request_duration_seconds_bucket", canaryOnly: true},
+		{name: "honeycomb-request-rate", metric: "http_requests_total", canaryOnly: true},
+		{name: "honeycomb-latency-vs-primary", metric: "http_request_duration_seconds_bucket"},
+	}
+	if len(templates) != len(expected) {
+		t.Fatalf("expected %d MetricTemplates, got %d", len(expected), len(templates))
+	}
+
+	adapter := &HoneycombAdapter{queryTimeWindow: 3 * time.Minute}
+	for i, want := range expected {
+		tmpl := templates[i]
+		t.Run(want.name, func(t *testing.T) {
+			if tmpl.Kind != "MetricTemplate" || tmpl.Metadata.Name != want.name {
+				t.Fatalf("expected MetricTemplate %s, got %s %s", want.name, tmpl.Kind, tmpl.Metadata.Name)
+			}
+			plan, err := adapter.translatePromQL(flaggerVariables.Replace(tmpl.Spec.Query))
+			if err != nil {
+				t.Fatalf("query does not translate: %v", err)
+			}
+			for _, leaf := range honeycombPlanLeaves(t, adapter, plan) {
+				if leaf.Metric != want.metric || leaf.Service != "podinfo" {
+					t.Errorf("expected %s of podinfo, got %s of %q", want.metric, leaf.Metric, leaf.Service)
+				}
+				canaryFilter := Filter{Column: "k8s.deployment.name", Op: "=", Value: "podinfo"}
+				if want.canaryOnly && !containsFilter(leaf.Query.Filters, canaryFilter) {
+					t.Errorf("expected the canary workload filter %+v, got %+v", canaryFilter, leaf.Query.Filters)
+				}
+			}
+		})
+	}
+}
+
+func containsFilter(filters []Filter, f Filter) bool {
+	for _, filter := range filters {
+		if reflect.DeepEqual(filter, f) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,762 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TranslationError is returned for PromQL that parses correctly but uses a
+// construct the adapter cannot express as a Honeycomb query.
+type TranslationError struct {
+	Pos   PositionRange
+	Query string
+	Expr  string
+	Err   string
+}
+
+func (e *TranslationError) Error() string {
+	return fmt.Sprintf("%s: cannot translate %q: %s", e.Pos.describe(e.Query), e.Expr, e.Err)
+}
+
+// queryPlan is the translated form of a PromQL expression. Its leaves are
+// queries for a Backend; inner nodes are operations the adapter applies to
+// the leaf results itself.
+type queryPlan struct {
+	Expr Expr
+	Root planNode
+	// Warnings describe where the translation approximated the query.
+	Warnings []string
+	// Mapping is the metric mapping the plan was translated with. Its leaf
+	// queries carry it to the backend.
+	Mapping *mappingConfig
+}
+
+type planNode interface {
+	planNode()
+}
+
+// leafNode is a vector selector, run as a single query on the Backend.
+type leafNode struct {
+	LeafQuery
+	// Per converts a value over the queried window into a value per second
+	// for rate() and irate(), or per requested range for increase(). Zero
+	// leaves the value as the backend returns it.
+	Per  time.Duration
+	Expr Expr
+	// WindowWarning is the warning that the window was raised or lowered to
+	// a bound, if it was.
+	WindowWarning string
+}
+
+// honeycombLeaf is the Honeycomb query a leaf query maps onto.
+type honeycombLeaf struct {
+	*LeafQuery
+	Query     *HoneycombQuery
+	Service   string
+	Namespace string
+	// Role is the Flagger role selected by a -canary or -primary service
+	// name or a role label.
+	Role string
+	// Dataset is set by a dataset="..." matcher and overrides the dataset
+	// resolution strategy.
+	Dataset    string
+	Breakdowns []breakdown
+	// Scale converts Honeycomb values into the unit of the Prometheus
+	// metric, e.g. 0.001 for duration_ms behind a *_seconds metric.
+	Scale float64
+}
+
+// breakdown maps a PromQL grouping label onto the Honeycomb column the query
+// is broken down by.
+type breakdown struct {
+	Label  string
+	Column string
+}
+
+// maxBreakdownGroups is the largest number of groups Honeycomb returns for a
+// broken-down query.
+const maxBreakdownGroups = 1000
+
+// binaryNode combines the results of two sub-plans with a PromQL operator.
+type binaryNode struct {
+	Op         string
+	LHS        planNode
+	RHS        planNode
+	ReturnBool bool
+	Expr       *BinaryExpr
+}
+
+// scalarNode is a constant scalar value.
+type scalarNode struct {
+	Value float64
+}
+
+// vectorNode is the result of vector(<scalar>): a single series with no labels.
+type vectorNode struct {
+	Value float64
+}
+
+// funcNode applies a PromQL function to the results of its arguments.
+type funcNode struct {
+	Func string
+	Args []planNode
+}
+
+// aggregateNode aggregates the series of a sub-plan in the adapter, for
+// aggregations the grouping of a leaf query cannot express.
+type aggregateNode struct {
+	Op       string
+	Grouping []string
+	Without  bool
+	// Param is the k of topk() and bottomk().
+	Param planNode
+	Inner planNode
+}
+
+func (*leafNode) planNode()      {}
+func (*binaryNode) planNode()    {}
+func (*scalarNode) planNode()    {}
+func (*vectorNode) planNode()    {}
+func (*funcNode) planNode()      {}
+func (*aggregateNode) planNode() {}
+
+// leaves returns the leaves of the plan in left-to-right order.
+func (p *queryPlan) leaves() []*leafNode {
+	var out []*leafNode
+	var walk func(n planNode)
+	walk = func(n planNode) {
+		switch n := n.(type) {
+		case *leafNode:
+			out = append(out, n)
+		case *binaryNode:
+			walk(n.LHS)
+			walk(n.RHS)
+		case *canaryNode:
+			walk(n.Leaf)
+		case *funcNode:
+			for _, arg := range n.Args {
+				walk(arg)
+			}
+		case *aggregateNode:
+			if n.Param != nil {
+				walk(n.Param)
+			}
+			walk(n.Inner)
+		}
+	}
+	walk(p.Root)
+	return out
+}
+
+// queries returns the leaf queries of the plan in the order of leaves(),
+// which is the order a Backend returns their results in.
+func (p *queryPlan) queries() []*LeafQuery {
+	leaves := p.leaves()
+	out := make([]*LeafQuery, len(leaves))
+	for i, leaf := range leaves {
+		out[i] = &leaf.LeafQuery
+	}
+	return out
+}
+
+// translateContext carries information from enclosing expressions down to the
+// selectors being translated.
+type translateContext struct {
+	// quantile is set when translating the argument of histogram_quantile().
+	quantile *float64
+	// aggregation is the *_over_time function enclosing the selector.
+	aggregation string
+}
+
+// promQLTranslator walks a PromQL AST and builds a queryPlan.
+type promQLTranslator struct {
+	adapter *HoneycombAdapter
+	query   string
+	// mapper uses the metric mapping in effect when translation started, so
+	// a reload cannot change the mapping halfway through a query.
+	mapper   *honeycombMapper
+	warnings []string
+}
+
+func (t *promQLTranslator) errorf(expr Expr, format string, args ...interface{}) error {
+	return &TranslationError{
+		Pos:   expr.PositionRange(),
+		Query: t.query,
+		Expr:  expr.String(),
+		Err:   fmt.Sprintf(format, args...),
+	}
+}
+
+// warnf records a warning for the response, once per distinct message.
+func (t *promQLTranslator) warnf(format string, args ...interface{}) {
+	warning := fmt.Sprintf(format, args...)
+	if !containsString(t.warnings, warning) {
+		t.warnings = append(t.warnings, warning)
+	}
+}
+
+// translatePromQL parses a PromQL expression and translates it into a plan of
+// leaf queries, checking that each one maps onto a Honeycomb query.
+func (h *HoneycombAdapter) translatePromQL(promQL string) (*queryPlan, error) {
+	h.ensureTelemetry()
+
+	if err := checkTemplates(promQL); err != nil {
+		return nil, err
+	}
+	expr, err := ParsePromQL(promQL)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &promQLTranslator{adapter: h, query: promQL, mapper: &honeycombMapper{config: h.metricConfig()}}
+	root, err := t.translate(expr, translateContext{})
+	if err != nil {
+		return nil, err
+	}
+	return &queryPlan{Expr: expr, Root: root, Warnings: t.warnings, Mapping: t.mapper.config}, nil
+}
+
+func (t *promQLTranslator) translate(expr Expr, ctx translateContext) (planNode, error) {
+	switch e := expr.(type) {
+	case *ParenExpr:
+		return t.translate(e.Expr, ctx)
+
+	case *NumberLiteral:
+		return &scalarNode{Value: e.Val}, nil
+
+	case *UnaryExpr:
+		inner, err := t.translate(e.Expr, ctx)
+		if err != nil || e.Op == "+" {
+			return inner, err
+		}
+		return &binaryNode{Op: "*", LHS: inner, RHS: &scalarNode{Value: -1}}, nil
+
+	case *BinaryExpr:
+		return t.translateBinary(e, ctx)
+
+	case *AggregateExpr:
+		return t.translateAggregation(e, ctx)
+
+	case *Call:
+		return t.translateCall(e, ctx)
+
+	case *VectorSelector:
+		return t.translateSelector(e, 0, ctx)
+
+	case *MatrixSelector:
+		return nil, t.errorf(e, "range vector selectors must be wrapped in a function such as rate()")
+
+	case *SubqueryExpr:
+		return nil, t.errorf(e, "subqueries are not supported")
+
+	case *StringLiteral:
+		return nil, t.errorf(e, "string literals are not supported")
+	}
+	return nil, t.errorf(expr, "unsupported expression type %T", expr)
+}
+
+func (t *promQLTranslator) translateBinary(e *BinaryExpr, ctx translateContext) (planNode, error) {
+	if isSetOperator(e.Op) {
+		return nil, t.errorf(e, "set operator %q is not supported", e.Op)
+	}
+	if e.VectorMatching != nil {
+		return nil, t.errorf(e, "vector matching modifiers are not supported")
+	}
+
+	lhs, err := t.translate(e.LHS, ctx)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := t.translate(e.RHS, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &binaryNode{Op: e.Op, LHS: lhs, RHS: rhs, ReturnBool: e.ReturnBool, Expr: e}, nil
+}
+
+func (t *promQLTranslator) translateAggregation(e *AggregateExpr, ctx translateContext) (planNode, error) {
+	switch e.Op {
+	case "sum", "avg", "min", "max", "count", "topk", "bottomk":
+	default:
+		return nil, t.errorf(e, "aggregation %q is not supported", e.Op)
+	}
+
+	var grouping []string
+	for _, label := range e.Grouping {
+		// histogram_quantile() needs the buckets grouped by "le"; Honeycomb
+		// computes the percentile directly, so the grouping is implicit.
+		if label == "le" && ctx.quantile != nil {
+			continue
+		}
+		grouping = append(grouping, label)
+	}
+
+	inner, err := t.translate(e.Expr, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leaf, ok := inner.(*leafNode); ok {
+		if t.pushDownAggregation(e, leaf, grouping) {
+			return leaf, nil
+		}
+		// Honeycomb returns the total of the matching events of each group,
+		// never the individual series the other aggregations work on.
+		if len(leaf.Grouping) == 0 {
+			switch e.Op {
+			case "count":
+				return nil, t.errorf(e, "count of a selector is not supported: Honeycomb returns one total per group, so every count would be 1; count the series of a sum by (...) instead")
+			case "topk", "bottomk":
+				return nil, t.errorf(e, "%s of a selector is not supported: Honeycomb returns one total per group, so it would rank the totals rather than the series; rank a sum by (...) instead", e.Op)
+			default:
+				return nil, t.errorf(e, "%s of a selector is not supported: Honeycomb returns the total of the matching events, not their individual series; aggregate a sum by (...) instead", e.Op)
+			}
+		}
+	}
+
+	node := &aggregateNode{Op: e.Op, Grouping: grouping, Without: e.Without, Inner: inner}
+	if e.Param != nil {
+		if node.Param, err = t.translate(e.Param, translateContext{}); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// pushDownAggregation turns an aggregation of a leaf into the grouping of
+// the leaf's query where that gives the same result, and reports whether it
+// did. Other aggregations are evaluated on the leaf's results.
+func (t *promQLTranslator) pushDownAggregation(e *AggregateExpr, leaf *leafNode, grouping []string) bool {
+	// Only a sum is the same whether Honeycomb totals the events of a group
+	// or the adapter adds up the group's series.
+	if e.Op != "sum" {
+		return false
+	}
+
+	if len(leaf.Grouping) == 0 {
+		// The backend returns one series per group. Without a grouping a
+		// leaf has no labels for "without" to drop.
+		if !e.Without {
+			leaf.Grouping = grouping
+		}
+		return true
+	}
+
+	// Re-summing a grouped count by a subset of its labels gives the same
+	// result as grouping by that subset directly.
+	if e.Without {
+		var kept []string
+		for _, label := range leaf.Grouping {
+			if !containsString(grouping, label) {
+				kept = append(kept, label)
+			}
+		}
+		leaf.Grouping = kept
+		return true
+	}
+	for _, label := range grouping {
+		if !containsString(leaf.Grouping, label) {
+			return false
+		}
+	}
+	leaf.Grouping = grouping
+	return true
+}
+
+// planLabels returns the labels the results of a plan node may carry.
+func planLabels(node planNode) []string {
+	var labels []string
+	switch n := node.(type) {
+	case *leafNode:
+		labels = append(labels, n.Grouping...)
+	case *binaryNode:
+		labels = append(planLabels(n.LHS), planLabels(n.RHS)...)
+	case *canaryNode:
+		for _, label := range planLabels(n.Leaf) {
+			if label != workloadLabel {
+				labels = append(labels, label)
+			}
+		}
+	case *funcNode:
+		for _, arg := range n.Args {
+			labels = append(labels, planLabels(arg)...)
+		}
+	case *aggregateNode:
+		switch {
+		case n.Op == "topk" || n.Op == "bottomk":
+			labels = planLabels(n.Inner)
+		case n.Without:
+			for _, label := range planLabels(n.Inner) {
+				if !containsString(n.Grouping, label) {
+					labels = append(labels, label)
+				}
+			}
+		default:
+			labels = n.Grouping
+		}
+	}
+	return labels
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *promQLTranslator) translateCall(e *Call, ctx translateContext) (planNode, error) {
+	switch e.Func.Name {
+	case "rate", "irate", "increase":
+		ms, ok := unwrapParens(e.Args[0]).(*MatrixSelector)
+		if !ok {
+			return nil, t.errorf(e.Args[0], "%s() is only supported on range vector selectors", e.Func.Name)
+		}
+		node, err := t.translateSelector(ms.VectorSelector, ms.Range, ctx)
+		if err != nil || ctx.quantile != nil {
+			// Percentiles are computed from the raw column, the rate of
+			// the buckets does not change them.
+			return node, err
+		}
+		leaf := node.(*leafNode)
+		switch e.Func.Name {
+		case "irate":
+			t.warnf("irate() of %s is approximated by rate() over the whole range", ms)
+			leaf.Per = time.Second
+		case "rate":
+			leaf.Per = time.Second
+		case "increase":
+			leaf.Per = ms.Range
+		}
+		return leaf, nil
+
+	case "sum_over_time", "avg_over_time", "min_over_time", "max_over_time", "count_over_time":
+		ms, ok := unwrapParens(e.Args[0]).(*MatrixSelector)
+		if !ok {
+			return nil, t.errorf(e.Args[0], "%s() is only supported on range vector selectors", e.Func.Name)
+		}
+		ctx.aggregation = e.Func.Name
+		return t.translateSelector(ms.VectorSelector, ms.Range, ctx)
+
+	case "histogram_quantile":
+		phi, ok := unwrapParens(e.Args[0]).(*NumberLiteral)
+		if !ok {
+			return nil, t.errorf(e.Args[0], "quantile must be a number literal")
+		}
+		if ctx.quantile != nil {
+			return nil, t.errorf(e, "nested histogram_quantile() is not supported")
+		}
+		ctx.quantile = &phi.Val
+		return t.translate(e.Args[1], ctx)
+
+	case "vector":
+		if s, ok := unwrapParens(e.Args[0]).(*NumberLiteral); ok {
+			return &vectorNode{Value: s.Val}, nil
+		}
+		return t.translateLocalCall(e, ctx)
+
+	case "scalar", "abs", "round", "clamp", "clamp_min", "clamp_max":
+		return t.translateLocalCall(e, ctx)
+
+	case canaryDeltaFunc, canaryRatioFunc:
+		return t.translateCanaryComparison(e, ctx)
+	}
+	return nil, t.errorf(e, "function %q is not supported", e.Func.Name)
+}
+
+// translateLocalCall translates a function the adapter evaluates itself on
+// the results of its arguments.
+func (t *promQLTranslator) translateLocalCall(e *Call, ctx translateContext) (planNode, error) {
+	node := &funcNode{Func: e.Func.Name}
+	for _, arg := range e.Args {
+		translated, err := t.translate(arg, ctx)
+		if err != nil {
+			return nil, err
+		}
+		node.Args = append(node.Args, translated)
+	}
+	return node, nil
+}
+
+// translateSelector translates a selector queried over window, or over the
+// minimum window of its metric if window is zero.
+func (t *promQLTranslator) translateSelector(vs *VectorSelector, window time.Duration, ctx translateContext) (planNode, error) {
+	leaf := &leafNode{
+		LeafQuery: LeafQuery{
+			Metric:      vs.Name,
+			Matchers:    vs.Matchers,
+			Aggregation: ctx.aggregation,
+			Quantile:    ctx.quantile,
+			Offset:      vs.Offset,
+			At:          vs.At,
+			mapping:     t.mapper.config,
+		},
+		Expr: vs,
+	}
+
+	// Mapping the selector checks that Honeycomb can run it, and resolves the
+	// dataset the window bounds depend on
+	mapped, err := t.mapper.leaf(&leaf.LeafQuery)
+	if err != nil {
+		return nil, t.mappingError(vs, err)
+	}
+	policy := t.adapter.windowPolicy(t.mapper.config, vs.Name, t.adapter.knownDataset(mapped))
+	if window == 0 {
+		window = time.Duration(policy.Min)
+	}
+	leaf.Window = t.adapter.clampWindow(window, policy)
+	switch {
+	case leaf.Window > window:
+		leaf.WindowWarning = fmt.Sprintf("range of %s raised from %s to the minimum query window of %s", vs, formatDuration(window), formatDuration(leaf.Window))
+	case leaf.Window < window:
+		leaf.WindowWarning = fmt.Sprintf("range of %s lowered from %s to the maximum query window of %s", vs, formatDuration(window), formatDuration(leaf.Window))
+	}
+	if leaf.WindowWarning != "" {
+		t.warnf("%s", leaf.WindowWarning)
+	}
+	return leaf, nil
+}
+
+// mappingError reports an error mapping expr onto a Honeycomb query, at the
+// matcher that caused it if there is one.
+func (t *promQLTranslator) mappingError(expr Expr, err error) error {
+	var matcherErr *matcherError
+	if errors.As(err, &matcherErr) {
+		m := matcherErr.Matcher
+		return &TranslationError{Pos: m.Pos, Query: t.query, Expr: m.String(), Err: matcherErr.Err}
+	}
+	return t.errorf(expr, "%v", err)
+}
+
+// matcherError is a mapping error caused by a single label matcher.
+type matcherError struct {
+	Matcher *LabelMatcher
+	Err     string
+}
+
+func (e *matcherError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Matcher, e.Err)
+}
+
+// honeycombMapper maps leaf queries onto Honeycomb queries with a metric
+// mapping.
+type honeycombMapper struct {
+	config *mappingConfig
+}
+
+// leaf returns the Honeycomb query for a leaf query.
+func (mp *honeycombMapper) leaf(q *LeafQuery) (*honeycombLeaf, error) {
+	mapping, ok := mp.config.Metrics[q.Metric]
+	if !ok {
+		return nil, fmt.Errorf("no Honeycomb mapping for metric %q", q.Metric)
+	}
+
+	query := &HoneycombQuery{
+		Filters: append([]Filter{}, mapping.Filters...),
+	}
+
+	scale := 1.0
+	switch mapping.Calculation {
+	case histogramCalculation:
+		if q.Quantile == nil {
+			return nil, fmt.Errorf("histogram metric %q can only be queried through histogram_quantile()", q.Metric)
+		}
+		op, err := percentileOp(*q.Quantile)
+		if err != nil {
+			return nil, err
+		}
+		query.Calculations = []Calculation{{Op: op, Column: mapping.Column}}
+		scale = mapping.unitScale(q.Metric)
+
+	default:
+		if q.Quantile != nil {
+			return nil, fmt.Errorf("histogram_quantile() requires a histogram bucket metric, %q is not one", q.Metric)
+		}
+		calculation, err := overTimeCalculation(mapping, overTimeCalculations[q.Aggregation])
+		if err != nil {
+			return nil, err
+		}
+		query.Calculations = []Calculation{calculation}
+		if calculation.Op == "COUNT" {
+			query.Orders = []Order{{Op: "COUNT", Order: "descending"}}
+		}
+		if calculation.Column != "" && calculation.Op != "COUNT_DISTINCT" {
+			scale = mapping.unitScale(q.Metric)
+		}
+	}
+
+	leaf := &honeycombLeaf{LeafQuery: q, Query: query, Scale: scale}
+	explicitNamespace := false
+	for _, m := range q.Matchers {
+		if err := mp.applyMatcher(leaf, m); err != nil {
+			return nil, err
+		}
+		explicitNamespace = explicitNamespace || m.Name == "namespace"
+	}
+
+	// A namespace-qualified service name filters like a namespace matcher
+	if leaf.Namespace != "" && !explicitNamespace {
+		query.Filters = append(query.Filters, Filter{Column: mp.config.labelColumn(q.Metric, "namespace"), Op: "=", Value: leaf.Namespace})
+	}
+	if leaf.Role != "" {
+		if leaf.Service == "" {
+			return nil, fmt.Errorf("the %s label requires a service", roleLabel)
+		}
+		target := flaggerTarget{Name: leaf.Service, Role: leaf.Role}
+		query.Filters = append(query.Filters, Filter{Column: mp.config.labelColumn(q.Metric, workloadLabel), Op: "=", Value: target.workload()})
+	}
+
+	var breakdowns []breakdown
+	for _, label := range q.Grouping {
+		breakdowns = append(breakdowns, breakdown{Label: label, Column: mp.config.labelColumn(q.Metric, label)})
+	}
+	leaf.setBreakdowns(breakdowns)
+	query.TimeRange = int(q.Window.Seconds())
+	return leaf, nil
+}
+
+// setBreakdowns replaces the breakdowns of the leaf's Honeycomb query.
+func (l *honeycombLeaf) setBreakdowns(breakdowns []breakdown) {
+	l.Breakdowns = breakdowns
+	l.Query.Breakdowns = nil
+	l.Query.Limit = 0
+	for _, b := range breakdowns {
+		l.Query.Breakdowns = append(l.Query.Breakdowns, b.Column)
+	}
+	if len(breakdowns) > 0 {
+		l.Query.Limit = maxBreakdownGroups
+	}
+}
+
+// setRole records the Flagger role selected by matcher m, rejecting a
+// selector that asks for both roles.
+func setRole(leaf *honeycombLeaf, m *LabelMatcher, role string) error {
+	if role == "" {
+		return nil
+	}
+	if leaf.Role != "" && leaf.Role != role {
+		return &matcherError{Matcher: m, Err: fmt.Sprintf("conflicts with the %s role selected earlier", leaf.Role)}
+	}
+	leaf.Role = role
+	return nil
+}
+
+// overTimeCalculations maps the *_over_time functions onto the Honeycomb
+// calculation applied to the metric's column over the range.
+var overTimeCalculations = map[string]string{
+	"sum_over_time":   "SUM",
+	"avg_over_time":   "AVG",
+	"min_over_time":   "MIN",
+	"max_over_time":   "MAX",
+	"count_over_time": "COUNT",
+}
+
+// overTimeCalculation returns the Honeycomb calculation for a metric, with
+// the calculation of an enclosing *_over_time function if there is one.
+// count_over_time() keeps a COUNT_DISTINCT metric's calculation, so that
+// counting distinct values over a range still counts each value once.
+func overTimeCalculation(mapping metricMapping, op string) (Calculation, error) {
+	switch {
+	case op == "":
+		return Calculation{Op: mapping.Calculation, Column: mapping.Column}, nil
+	case op == "COUNT" && mapping.Calculation == "COUNT_DISTINCT":
+		return Calculation{Op: mapping.Calculation, Column: mapping.Column}, nil
+	case op == "COUNT":
+		return Calculation{Op: op}, nil
+	case mapping.Column == "":
+		return Calculation{}, fmt.Errorf("%s needs a column, the metric mapping has none", op)
+	}
+	return Calculation{Op: op, Column: mapping.Column}, nil
+}
+
+// honeycombPercentiles maps quantiles onto the percentile calculations
+// Honeycomb offers.
+var honeycombPercentiles = []struct {
+	phi float64
+	op  string
+}{
+	{0.001, "P001"},
+	{0.01, "P01"},
+	{0.05, "P05"},
+	{0.1, "P10"},
+	{0.2, "P20"},
+	{0.25, "P25"},
+	{0.5, "P50"},
+	{0.75, "P75"},
+	{0.8, "P80"},
+	{0.9, "P90"},
+	{0.95, "P95"},
+	{0.99, "P99"},
+	{0.999, "P999"},
+}
+
+// percentileOp returns the Honeycomb calculation for a histogram_quantile().
+func percentileOp(phi float64) (string, error) {
+	supported := make([]string, 0, len(honeycombPercentiles))
+	for _, p := range honeycombPercentiles {
+		if math.Abs(phi-p.phi) < 1e-9 {
+			return p.op, nil
+		}
+		supported = append(supported, strconv.FormatFloat(p.phi, 'f', -1, 64))
+	}
+	return "", fmt.Errorf("quantile %v is not supported by Honeycomb, use one of %s", phi, strings.Join(supported, ", "))
+}
+
+func (mp *honeycombMapper) applyMatcher(leaf *honeycombLeaf, m *LabelMatcher) error {
+	switch m.Name {
+	case "__name__":
+		return nil
+	case "le":
+		// Bucket boundaries have no Honeycomb equivalent; the percentile is
+		// computed from the raw column instead.
+		return nil
+	case "service", "job":
+		// An exact service selects the dataset; any other matcher on these
+		// labels is an ordinary filter. Flagger's -canary and -primary
+		// names select the target's service and the workload of that role.
+		// The target's namespace and role only filter the query; result
+		// series do not carry them as labels.
+		if m.Type == MatchEqual && m.Value != "" {
+			target := parseFlaggerTarget(m.Value)
+			if leaf.Service != "" && leaf.Service != target.Name {
+				return &matcherError{Matcher: m, Err: fmt.Sprintf("conflicts with the service %q selected earlier", leaf.Service)}
+			}
+			leaf.Service = target.Name
+			if target.Namespace != "" {
+				if leaf.Namespace != "" && leaf.Namespace != target.Namespace {
+					return &matcherError{Matcher: m, Err: fmt.Sprintf("conflicts with the namespace %q selected earlier", leaf.Namespace)}
+				}
+				leaf.Namespace = target.Namespace
+			}
+			return setRole(leaf, m, target.Role)
+		}
+	case roleLabel:
+		if m.Type != MatchEqual || (m.Value != roleCanary && m.Value != rolePrimary) {
+			return &matcherError{Matcher: m, Err: fmt.Sprintf("the role label only supports %s=%q or %s=%q", roleLabel, roleCanary, roleLabel, rolePrimary)}
+		}
+		return setRole(leaf, m, m.Value)
+	case datasetLabel:
+		if m.Type != MatchEqual || m.Value == "" {
+			return &matcherError{Matcher: m, Err: "the dataset label only supports a single non-empty = matcher"}
+		}
+		leaf.Dataset = m.Value
+		return nil
+	case "namespace":
+		// The namespace is also a filter; it is recorded for dataset lookup.
+		if m.Type == MatchEqual {
+			leaf.Namespace = m.Value
+		}
+	}
+
+	filters, err := matcherFilters(m, mp.config.labelColumn(leaf.Metric, m.Name))
+	if err != nil {
+		return &matcherError{Matcher: m, Err: err.Error()}
+	}
+	leaf.Query.Filters = append(leaf.Query.Filters, filters...)
+	return nil
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// honeycombPlanLeaves maps the leaves of a plan onto Honeycomb queries.
+func honeycombPlanLeaves(t *testing.T, adapter *HoneycombAdapter, plan *queryPlan) []*honeycombLeaf {
+	t.Helper()
+	leaves, err := adapter.honeycombLeaves(plan.queries())
+	if err != nil {
+		t.Fatalf("unexpected mapping error: %v", err)
+	}
+	return leaves
+}
+
+func TestTranslatePromQLPlan(t *testing.T) {
+	adapter := &HoneycombAdapter{
+		queryTimeWindow: 3 * time.Minute,
+	}
+
+	plan, err := adapter.translatePromQL(`sum(rate(http_requests_total{code!~"5.*",service="test"}[5m])) / sum(rate(http_requests_total{service="test"}[5m])) * 100`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	leaves := honeycombPlanLeaves(t, adapter, plan)
+	if len(leaves) != 2 {
+		t.Fatalf("expected 2 Honeycomb queries, got %d", len(leaves))
+	}
+	if len(leaves[0].Query.Filters) != 1 || leaves[0].Query.Filters[0].Op != "<" {
+		t.Errorf("expected numerator to filter on status code, got %+v", leaves[0].Query.Filters)
+	}
+	if len(leaves[1].Query.Filters) != 0 {
+		t.Errorf("expected denominator without filters, got %+v", leaves[1].Query.Filters)
+	}
+	for _, leaf := range leaves {
+		if leaf.Service != "test" {
+			t.Errorf("expected service test, got %q", leaf.Service)
+		}
+		if leaf.Query.TimeRange != 300 {
+			t.Errorf("expected time range 300, got %d", leaf.Query.TimeRange)
+		}
+	}
+
+	mul, ok := plan.Root.(*binaryNode)
+	if !ok || mul.Op != "*" {
+		t.Fatalf("expected multiplication at the root, got %#v", plan.Root)
+	}
+	if div, ok := mul.LHS.(*binaryNode); !ok || div.Op != "/" {
+		t.Errorf("expected division on the left-hand side, got %#v", mul.LHS)
+	}
+}
+
+func TestTranslatePromQLErrors(t *testing.T) {
+	adapter := &HoneycombAdapter{
+		queryTimeWindow: 3 * time.Minute,
+	}
+
+	tests := []struct {
+		name    string
+		promQL  string
+		wantErr string
+	}{
+		{
+			name:    "unknown metric",
+			promQL:  `sum(rate(node_cpu_seconds_total[5m]))`,
+			wantErr: `1:10: cannot translate "node_cpu_seconds_total": no Honeycomb mapping for metric "node_cpu_seconds_total"`,
+		},
+		{
+			name:    "unsupported function",
+			promQL:  `sum(http_requests_total) + deriv(http_requests_total[5m])`,
+			wantErr: `1:28: cannot translate "deriv(http_requests_total[5m])": function "deriv" is not supported`,
+		},
+		{
+			name:    "inexpressible regex matcher",
+			promQL:  `http_requests_total{route=~"/api/v[0-9]+/users"}`,
+			wantErr: `1:21: cannot translate "route=~\"/api/v[0-9]+/users\"": regex "/api/v[0-9]+/users" cannot be expressed as a Honeycomb filter`,
+		},
+		{
+			name:    "histogram without quantile",
+			promQL:  `rate(http_request_duration_seconds_bucket[5m])`,
+			wantErr: `can only be queried through histogram_quantile()`,
+		},
+		{
+			name:    "parse error",
+			promQL:  `sum(rate(http_requests_total[5m])`,
+			wantErr: `1:34: parse error`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := adapter.translatePromQL(tt.promQL)
+			if err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %q", tt.wantErr, err.Error())
+			}
+		})
+	}
+}
+
+func TestTranslateGrouping(t *testing.T) {
+	adapter := &HoneycombAdapter{
+		queryTimeWindow: 3 * time.Minute,
+	}
+
+	tests := []struct {
+		name           string
+		promQL         string
+		wantBreakdowns []string
+		wantLabels     []string
+		wantErr        string
+	}{
+		{
+			name:           "sum by service",
+			promQL:         `sum(rate(http_requests_total{service="test"}[5m])) by (service)`,
+			wantBreakdowns: []string{"service.name"},
+			wantLabels:     []string{"service"},
+		},
+		{
+			name:           "histogram quantile by service and le",
+			promQL:         `histogram_quantile(0.95, sum(rate(http_request_duration_seconds_bucket{service="test"}[5m])) by (service, le))`,
+			wantBreakdowns: []string{"service.name"},
+			wantLabels:     []string{"service"},
+		},
+		{
+			name:           "unmapped label uses its own column",
+			promQL:         `sum by (version, route) (rate(http_requests_total[5m]))`,
+			wantBreakdowns: []string{"version", "http.route"},
+			wantLabels:     []string{"version", "route"},
+		},
+		{
+			name:           "nested sum by subset",
+			promQL:         `sum by (service) (sum by (service, route) (rate(http_requests_total[5m])))`,
+			wantBreakdowns: []string{"service.name"},
+			wantLabels:     []string{"service"},
+		},
+		{
+			name:           "without drops inner breakdown",
+			promQL:         `sum without (route) (sum by (service, route) (rate(http_requests_total[5m])))`,
+			wantBreakdowns: []string{"service.name"},
+			wantLabels:     []string{"service"},
+		},
+		{
+			name:           "nested avg over groups is evaluated locally",
+			promQL:         `avg(sum by (service) (rate(http_requests_total[5m])))`,
+			wantBreakdowns: []string{"service.name"},
+			wantLabels:     []string{"service"},
+		},
+		{
+			name:           "topk over groups is evaluated locally",
+			promQL:         `topk(3, sum by (route) (rate(http_requests_total[5m])))`,
+			wantBreakdowns: []string{"http.route"},
+			wantLabels:     []string{"route"},
+		},
+		{
+			name:    "avg of a selector",
+			promQL:  `avg(rate(http_requests_total[5m]))`,
+			wantErr: "avg of a selector is not supported",
+		},
+		{
+			name:    "max by of a selector",
+			promQL:  `max by (route) (rate(http_requests_total[5m]))`,
+			wantErr: "max of a selector is not supported",
+		},
+		{
+			name:    "min of a selector",
+			promQL:  `min(http_requests_total)`,
+			wantErr: "min of a selector is not supported",
+		},
+		{
+			name:    "count by of a selector",
+			promQL:  `count by (route) (rate(http_requests_total[5m]))`,
+			wantErr: "count of a selector is not supported: Honeycomb returns one total per group, so every count would be 1",
+		},
+		{
+			name:    "topk by of a selector",
+			promQL:  `topk by (service) (1, rate(http_requests_total[5m]))`,
+			wantErr: "topk of a selector is not supported: Honeycomb returns one total per group, so it would rank the totals",
+		},
+		{
+			name:    "bottomk of a selector",
+			promQL:  `bottomk(3, rate(http_requests_total[5m]))`,
+			wantErr: "bottomk of a selector is not supported",
+		},
+		{
+			name:    "count without of a selector",
+			promQL:  `count without (route) (http_requests_total)`,
+			wantErr: "count of a selector is not supported",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := adapter.translatePromQL(tt.promQL)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			leaf := honeycombPlanLeaves(t, adapter, plan)[0]
+			if strings.Join(leaf.Query.Breakdowns, ",") != strings.Join(tt.wantBreakdowns, ",") {
+				t.Errorf("expected breakdowns %v, got %v", tt.wantBreakdowns, leaf.Query.Breakdowns)
+			}
+			var labels []string
+			for _, b := range leaf.Breakdowns {
+				labels = append(labels, b.Label)
+			}
+			if strings.Join(labels, ",") != strings.Join(tt.wantLabels, ",") {
+				t.Errorf("expected labels %v, got %v", tt.wantLabels, labels)
+			}
+		})
+	}
+}
+
+func TestTranslateHistogramQuantile(t *testing.T) {
+	adapter := &HoneycombAdapter{
+		queryTimeWindow: 3 * time.Minute,
+	}
+	config, err := parseMappingConfig([]byte(`
+metrics:
+  request_latency_milliseconds_bucket:
+    calculation: HISTOGRAM
+    column: duration_ms
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	adapter.mappings.Store(config)
+
+	tests := []struct {
+		name      string
+		promQL    string
+		wantOp    string
+		wantScale float64
+		wantErr   string
+	}{
+		{
+			name:      "p99 in seconds",
+			promQL:    `histogram_quantile(0.99, sum(rate(http_request_duration_seconds_bucket[5m])) by (le))`,
+			wantOp:    "P99",
+			wantScale: 0.001,
+		},
+		{
+			name:      "median",
+			promQL:    `histogram_quantile(0.5, sum(rate(http_request_duration_seconds_bucket[5m])) by (le))`,
+			wantOp:    "P50",
+			wantScale: 0.001,
+		},
+		{
+			name:      "p999",
+			promQL:    `histogram_quantile(0.999, sum(rate(http_request_duration_seconds_bucket[5m])) by (le))`,
+			wantOp:    "P999",
+			wantScale: 0.001,
+		},
+		{
+			name:      "milliseconds metric needs no conversion",
+			promQL:    `histogram_quantile(0.9, sum(rate(request_latency_milliseconds_bucket[5m])) by (le))`,
+			wantOp:    "P90",
+			wantScale: 1,
+		},
+		{
+			name:    "unsupported quantile",
+			promQL:  `histogram_quantile(0.42, sum(rate(http_request_duration_seconds_bucket[5m])) by (le))`,
+			wantErr: `quantile 0.42 is not supported by Honeycomb`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := adapter.translatePromQL(tt.promQL)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			leaf := honeycombPlanLeaves(t, adapter, plan)[0]
+			if op := leaf.Query.Calculations[0].Op; op != tt.wantOp {
+				t.Errorf("expected calculation %s, got %s", tt.wantOp, op)
+			}
+			if leaf.Scale != tt.wantScale {
+				t.Errorf("expected scale %v, got %v", tt.wantScale, leaf.Scale)
+			}
+		})
+	}
+}
+
+func TestTranslateRangeFunctions(t *testing.T) {
+	adapter := &HoneycombAdapter{
+		queryTimeWindow: 3 * time.Minute,
+	}
+	config, err := parseMappingConfig([]byte(`
+metrics:
+  http_request_duration_seconds_sum:
+    calculation: SUM
+    column: duration_ms
+  active_users:
+    calculation: COUNT_DISTINCT
+    column: user.id
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	adapter.mappings.Store(config)
+
+	tests := []struct {
+		name        string
+		promQL      string
+		wantCalc    Calculation
+		wantPer     time.Duration
+		wantScale   float64
+		wantWarning string
+		wantErr     string
+	}{
+		{
+			name:      "rate per second",
+			promQL:    `rate(http_requests_total[5m])`,
+			wantCalc:  Calculation{Op: "COUNT"},
+			wantPer:   time.Second,
+			wantScale: 1,
+		},
+		{
+			name:        "irate approximated by rate",
+			promQL:      `irate(http_requests_total[5m])`,
+			wantCalc:    Calculation{Op: "COUNT"},
+			wantPer:     time.Second,
+			wantScale:   1,
+			wantWarning: "irate() of http_requests_total[5m] is approximated by rate()",
+		},
+		{
+			name:      "increase over the range",
+			promQL:    `increase(http_requests_total[10m])`,
+			wantCalc:  Calculation{Op: "COUNT"},
+			wantPer:   10 * time.Minute,
+			wantScale: 1,
+		},
+		{
+			name:      "rate of buckets inside histogram_quantile",
+			promQL:    `histogram_quantile(0.99, rate(http_request_duration_seconds_bucket[5m]))`,
+			wantCalc:  Calculation{Op: "P99", Column: "duration_ms"},
+			wantScale: 0.001,
+		},
+		{
+			name:      "sum over time",
+			promQL:    `sum_over_time(http_request_duration_seconds_sum[5m])`,
+			wantCalc:  Calculation{Op: "SUM", Column: "duration_ms"},
+			wantScale: 0.001,
+		},
+		{
+			name:      "max over time",
+			promQL:    `max_over_time(http_request_duration_seconds_sum[5m])`,
+			wantCalc:  Calculation{Op: "MAX", Column: "duration_ms"},
+			wantScale: 0.001,
+		},
+		{
+			name:      "count over time",
+			promQL:    `count_over_time(http_request_duration_seconds_sum[5m])`,
+			wantCalc:  Calculation{Op: "COUNT"},
+			wantScale: 1,
+		},
+		{
+			name:      "count over time of distinct values",
+			promQL:    `count_over_time(active_users[5m])`,
+			wantCalc:  Calculation{Op: "COUNT_DISTINCT", Column: "user.id"},
+			wantScale: 1,
+		},
+		{
+			name:    "over time without a column",
+			promQL:  `avg_over_time(http_requests_total[5m])`,
+			wantErr: `AVG needs a column, the metric mapping has none`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := adapter.translatePromQL(tt.promQL)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			leaf := honeycombPlanLeaves(t, adapter, plan)[0]
+			if calc := leaf.Query.Calculations[0]; calc != tt.wantCalc {
+				t.Errorf("expected calculation %+v, got %+v", tt.wantCalc, calc)
+			}
+			if per := plan.leaves()[0].Per; per != tt.wantPer {
+				t.Errorf("expected per %v, got %v", tt.wantPer, per)
+			}
+			if leaf.Scale != tt.wantScale {
+				t.Errorf("expected scale %v, got %v", tt.wantScale, leaf.Scale)
+			}
+			warnings := strings.Join(plan.Warnings, "\n")
+			if tt.wantWarning == "" && warnings != "" || !strings.Contains(warnings, tt.wantWarning) {
+				t.Errorf("expected warning %q, got %q", tt.wantWarning, warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"gopkg.in/yaml.v3"
+)
+
+// promDuration is a duration written in Prometheus syntax in the metric
+// mapping file, e.g. "90s", "1h30m" or "1d".
+type promDuration time.Duration
+
+func (d *promDuration) UnmarshalYAML(node *yaml.Node) error {
+	var s string
+	if err := node.Decode(&s); err != nil {
+		return err
+	}
+	parsed, err := parseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = promDuration(parsed)
+	return nil
+}
+
+// windowPolicy bounds the time window of the Honeycomb queries for a metric
+// or dataset. A zero bound leaves that side unbounded.
+type windowPolicy struct {
+	// Min is the shortest window queried. Shorter PromQL ranges are raised
+	// to it, since Honeycomb needs enough events for stable results.
+	Min promDuration `yaml:"min,omitempty"`
+	// Max is the longest window queried. Longer PromQL ranges are lowered to
+	// it to keep Honeycomb queries fast.
+	Max promDuration `yaml:"max,omitempty"`
+}
+
+func (p windowPolicy) validate() error {
+	if p.Min < 0 || p.Max < 0 {
+		return fmt.Errorf("window bounds must not be negative")
+	}
+	if p.Max != 0 && p.Min > p.Max {
+		return fmt.Errorf("minimum window %s exceeds the maximum %s", formatDuration(time.Duration(p.Min)), formatDuration(time.Duration(p.Max)))
+	}
+	return nil
+}
+
+// override returns p with the bounds that o sets replaced.
+func (p windowPolicy) override(o windowPolicy) windowPolicy {
+	if o.Min != 0 {
+		p.Min = o.Min
+	}
+	if o.Max != 0 {
+		p.Max = o.Max
+	}
+	return p
+}
+
+// windowPolicy returns the window bounds for a metric queried in a dataset,
+// under the metric mapping config. Bounds of the metric's mapping win over
+// those of the dataset, which win over QUERY_TIME_WINDOW as the minimum.
+func (h *HoneycombAdapter) windowPolicy(config *mappingConfig, metricName, dataset string) windowPolicy {
+	policy := windowPolicy{Min: promDuration(h.queryTimeWindow)}
+	if p, ok := config.Datasets.Windows[dataset]; ok && dataset != "" {
+		policy = policy.override(p)
+	}
+	if p := config.Metrics[metricName].Window; p != nil {
+		policy = policy.override(*p)
+	}
+	return policy
+}
+
+// clampWindow applies a window policy to a requested window.
+func (h *HoneycombAdapter) clampWindow(requestedWindow time.Duration, policy windowPolicy) time.Duration {
+	h.ensureTelemetry()
+	window, bound := requestedWindow, ""
+	switch {
+	case policy.Min != 0 && requestedWindow < time.Duration(policy.Min):
+		window, bound = time.Duration(policy.Min), "min"
+		log.Printf("📊 Requested window %v optimized to %v (configured minimum)", requestedWindow, window)
+	case policy.Max != 0 && requestedWindow > time.Duration(policy.Max):
+		window, bound = time.Duration(policy.Max), "max"
+		log.Printf("📊 Requested window %v limited to %v (configured maximum)", requestedWindow, window)
+	default:
+		return requestedWindow
+	}
+
+	// Track window enforcement
+	h.windowEnforcements.Add(context.Background(), 1, metric.WithAttributes(
+		attribute.String("requested_window", requestedWindow.String()),
+		attribute.String("enforced_window", window.String()),
+		attribute.String("bound", bound),
+	))
+	return window
+}
+
+// knownDataset returns the dataset a leaf will be queried in, or "" if it
+// cannot be resolved yet. Resolution errors are reported when the leaf runs.
+func (h *HoneycombAdapter) knownDataset(leaf *honeycombLeaf) string {
+	if leaf.Dataset != "" {
+		return leaf.Dataset
+	}
+	dataset, _, err := h.queryDatasetResolver().Resolve(leaf)
+	if err != nil {
+		return ""
+	}
+	return dataset
+}
+
+// time returns the timestamp of an @ modifier, resolving start() and end()
+// to the start and end of the evaluated range.
+func (a *AtModifier) time(start, end time.Time) time.Time {
+	switch {
+	case a.Start:
+		return start
+	case a.End:
+		return end
+	}
+	sec, frac := math.Modf(a.Timestamp)
+	return time.Unix(int64(sec), int64(frac*1e9)).UTC()
+}
+
+// windowEnd returns the end of the leaf query's time window for an instant
+// evaluation at ts, as moved by the selector's offset and @ modifiers. It
+// returns false for a window that ends now, relative to Honeycomb's clock:
+// ts is zero and the selector has no modifiers.
+func (l *LeafQuery) windowEnd(ts time.Time) (time.Time, bool) {
+	if ts.IsZero() {
+		if l.Offset == 0 && l.At == nil {
+			return time.Time{}, false
+		}
+		ts = time.Now()
+	}
+	if l.At != nil {
+		ts = l.At.time(ts, ts)
+	}
+	return ts.Add(-l.Offset), true
+}
+
+// shiftRange returns the range the leaf query covers for a range evaluation
+// over rng: shifted back by the offset, or the single step at the
+// @ modifier's timestamp.
+func (l *LeafQuery) shiftRange(rng RangeParams) RangeParams {
+	if l.At != nil {
+		ts := l.At.time(rng.Start, rng.End).Add(-l.Offset)
+		return RangeParams{Start: ts, End: ts, Step: rng.Step}
+	}
+	return RangeParams{Start: rng.Start.Add(-l.Offset), End: rng.End.Add(-l.Offset), Step: rng.Step}
+}
+
+// alignMatrix moves the points of a leaf query's matrix, queried over
+// l.shiftRange(rng), onto the steps of rng.
+func (l *LeafQuery) alignMatrix(m Matrix, rng RangeParams) Matrix {
+	if l.Offset == 0 && l.At == nil {
+		return m
+	}
+	out := make(Matrix, 0, len(m))
+	for _, s := range m {
+		var points []Point
+		if l.At != nil {
+			// The value at the @ timestamp applies to every step
+			if len(s.Points) == 1 {
+				for _, ts := range rng.steps() {
+					points = append(points, Point{T: ts, V: s.Points[0].V})
+				}
+			}
+		} else {
+			for _, p := range s.Points {
+				points = append(points, Point{T: p.T.Add(l.Offset), V: p.V})
+			}
+		}
+		out = append(out, Series{Metric: s.Metric, Points: points})
+	}
+	return out
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTranslateWindowBounds(t *testing.T) {
+	config, err := parseMappingConfig([]byte(`
+datasets:
+  windows:
+    checkout:
+      min: 5m
+      max: 1d
+metrics:
+  http_requests_total:
+    calculation: COUNT
+    window:
+      max: 1h
+  cart_size:
+    calculation: SUM
+    column: cart_size
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	adapter := &HoneycombAdapter{queryTimeWindow: 3 * time.Minute}
+	adapter.mappings.Store(config)
+
+	tests := []struct {
+		name        string
+		promQL      string
+		wantRange   int
+		wantWarning string
+	}{
+		{
+			name:        "metric maximum",
+			promQL:      `increase(http_requests_total{service="checkout"}[2h])`,
+			wantRange:   3600,
+			wantWarning: `lowered from 2h to the maximum query window of 1h`,
+		},
+		{
+			name:        "dataset minimum under a metric maximum",
+			promQL:      `increase(http_requests_total{service="checkout"}[1m])`,
+			wantRange:   300,
+			wantWarning: `raised from 1m to the minimum query window of 5m`,
+		},
+		{
+			name:        "dataset maximum",
+			promQL:      `sum_over_time(cart_size{service="checkout"}[2d])`,
+			wantRange:   86400,
+			wantWarning: `lowered from 2d to the maximum query window of 1d`,
+		},
+		{
+			name:      "compound range within bounds",
+			promQL:    `sum_over_time(cart_size{service="checkout"}[1h30m])`,
+			wantRange: 5400,
+		},
+		{
+			name:      "selector without range in a bounded dataset",
+			promQL:    `cart_size{service="checkout"}`,
+			wantRange: 300,
+		},
+		{
+			name:      "global minimum",
+			promQL:    `cart_size{service="podinfo"}`,
+			wantRange: 180,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := adapter.translatePromQL(tt.promQL)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			leaves := honeycombPlanLeaves(t, adapter, plan)
+			if len(leaves) != 1 || leaves[0].Query.TimeRange != tt.wantRange {
+				t.Fatalf("expected a %ds time range, got %+v", tt.wantRange, leaves[0].Query)
+			}
+			warnings := strings.Join(plan.Warnings, "\n")
+			if tt.wantWarning == "" && warnings != "" || !strings.Contains(warnings, tt.wantWarning) {
+				t.Errorf("expected warning %q, got %q", tt.wantWarning, warnings)
+			}
+		})
+	}
+}
+
+func TestOffsetAndAtModifiers(t *testing.T) {
+	var sent []HoneycombQuery
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/1/queries/test":
+			var q HoneycombQuery
+			json.NewDecoder(r.Body).Decode(&q)
+			sent = append(sent, q)
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": "modified-query"})
+		case "/1/query_results/test":
+			q := sent[len(sent)-1]
+			if q.Granularity == 0 {
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"complete": true,
+					"data":     map[string]interface{}{"results": []interface{}{map[string]interface{}{"data": map[string]interface{}{"COUNT": 42.0}}}},
+				})
+				return
+			}
+			// One bucket per step, counting the bucket's start time
+			var buckets []interface{}
+			for ts := q.StartTime; ts < q.EndTime; ts += int64(q.Granularity) {
+				buckets = append(buckets, map[string]interface{}{
+					"time": time.Unix(ts, 0).UTC().Format(time.RFC3339),
+					"data": map[string]interface{}{"COUNT": float64(ts)},
+				})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{"series": buckets},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mockServer.Close()
+
+	tests := []struct {
+		name      string
+		handler   string
+		params    url.Values
+		wantStart int64
+		wantEnd   int64
+		// wantValues are the values of the range query's steps
+		wantValues []string
+	}{
+		{
+			name:      "offset",
+			handler:   "query",
+			params:    url.Values{"query": {`sum(increase(http_requests_total{service="test"}[5m] offset 1h))`}, "time": {"1700000000"}},
+			wantStart: 1700000000 - 3600 - 300,
+			wantEnd:   1700000000 - 3600,
+		},
+		{
+			name:      "@ timestamp",
+			handler:   "query",
+			params:    url.Values{"query": {`sum(increase(http_requests_total{service="test"}[5m] @ 1700000000))`}},
+			wantStart: 1700000000 - 300,
+			wantEnd:   1700000000,
+		},
+		{
+			name:      "@ end() with offset",
+			handler:   "query",
+			params:    url.Values{"query": {`sum(increase(http_requests_total{service="test"}[5m] @ end() offset -1m))`}, "time": {"1700000000"}},
+			wantStart: 1700000060 - 300,
+			wantEnd:   1700000060,
+		},
+		{
+			name:    "range query with offset",
+			handler: "query_range",
+			params: url.Values{
+				"query": {`sum(increase(http_requests_total{service="test"}[1m] offset 1h))`},
+				"start": {"1700003600"},
+				"end":   {"1700003720"},
+				"step":  {"60"},
+			},
+			wantStart:  1700000000 - 60,
+			wantEnd:    1700000120,
+			wantValues: []string{"1699999940", "1700000000", "1700000060"},
+		},
+		{
+			name:    "range query with @",
+			handler: "query_range",
+			params: url.Values{
+				"query": {`sum(increase(http_requests_total{service="test"}[1m] @ start()))`},
+				"start": {"1700000000"},
+				"end":   {"1700000120"},
+				"step":  {"60"},
+			},
+			wantStart:  1700000000 - 60,
+			wantEnd:    1700000000,
+			wantValues: []string{"1699999940", "1699999940", "1699999940"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent = nil
+			adapter := &HoneycombAdapter{
+				honeycombAPIKey:  "test-key",
+				honeycombBaseURL: mockServer.URL,
+				queryTimeWindow:  time.Minute,
+			}
+			handler := adapter.handleQuery
+			if tt.handler == "query_range" {
+				handler = adapter.handleQueryRange
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/"+tt.handler+"?"+tt.params.Encode(), nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+
+			if len(sent) != 1 {
+				t.Fatalf("expected 1 Honeycomb query, got %d", len(sent))
+			}
+			if q := sent[0]; q.StartTime != tt.wantStart || q.EndTime != tt.wantEnd || q.TimeRange != 0 {
+				t.Errorf("expected start=%d end=%d, got start=%d end=%d range=%d", tt.wantStart, tt.wantEnd, q.StartTime, q.EndTime, q.TimeRange)
+			}
+			if tt.wantValues == nil {
+				return
+			}
+
+			var response PrometheusResponse
+			if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if len(response.Data.Result) != 1 {
+				t.Fatalf("expected 1 series, got %+v", response.Data.Result)
+			}
+			var values []string
+			start, _ := parseTimeParam(tt.params.Get("start"))
+			for i, v := range response.Data.Result[0].Values {
+				if want := float64(start.Unix() + int64(60*i)); v[0] != want {
+					t.Errorf("expected step %d at %v, got %v", i, want, v[0])
+				}
+				values = append(values, v[1].(string))
+			}
+			if strings.Join(values, ",") != strings.Join(tt.wantValues, ",") {
+				t.Errorf("expected values %v, got %v", tt.wantValues, values)
+			}
+		})
+	}
+}